@@ -1,42 +1,186 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
 	"enigma-protocol-go/pkg/api"
+	"enigma-protocol-go/pkg/bus"
 	"enigma-protocol-go/pkg/db"
+	"enigma-protocol-go/pkg/utils"
+	"flag"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
+
+	"github.com/redis/go-redis/v9"
 )
 
+// defaultDrainTimeout is how long the sessions are drained on shutdown.
+const defaultDrainTimeout = 30 * time.Second
+
 type opts struct {
-	port           string
-	databasePath   string
-	allowedOrigins []string
+	port               string
+	databaseDriver     string
+	databasePath       string
+	allowedOrigins     []string
+	messageTTL         time.Duration
+	mailboxMaxMessages int
+	mailboxMaxBytes    int64
+	userRetention      time.Duration
+	adminToken         string
+	logSigningKey      ed25519.PrivateKey
+	devMode            bool
+	userIDs            utils.IDFormat
+	reservedHandles    []string
+	tokenKeys          []utils.TokenKey
+	accessTokenTTL     time.Duration
+	refreshTokenTTL    time.Duration
+	outboundQueueSize  int
+	stallTimeout       time.Duration
+	sessionPolicy      string
+	pingInterval       time.Duration
+	pingTimeout        time.Duration
+	idleTimeout        time.Duration
+	drainTimeout       time.Duration
+	redisURL           string
+	nodeID             string
 }
 
 func main() {
+	dryRun := flag.Bool("migrate-dry-run", false, "print the pending database migrations and exit")
+	flag.Parse()
+
 	env := getEnv()
+	if *dryRun {
+		printPendingMigrations(env)
+		return
+	}
+
+	// clients pin the log key, one that changes on restart is only good
+	// for development
+	if env.logSigningKey == nil && !env.devMode {
+		log.Fatal("LOG_SIGNING_KEY is required, set DEV_MODE=true to sign the key log with a random key")
+	}
+
 	apiOpts, err := api.NewAPIOpts(
 		&db.DatabaseOpts{
-			Driver: "sqlite3",
-			Uri:    env.databasePath,
+			Driver:  env.databaseDriver,
+			Uri:     env.databasePath,
+			UserIDs: env.userIDs,
 		},
 		env.allowedOrigins,
 	)
 	if err != nil {
 		panic(err)
 	}
+	apiOpts.MessageTTL = env.messageTTL
+	apiOpts.MailboxMaxMessages = env.mailboxMaxMessages
+	apiOpts.MailboxMaxBytes = env.mailboxMaxBytes
+	apiOpts.UserRetention = env.userRetention
+	apiOpts.AdminToken = env.adminToken
+	apiOpts.LogSigningKey = env.logSigningKey
+	apiOpts.ReservedHandles = env.reservedHandles
+	apiOpts.TokenKeys = env.tokenKeys
+	apiOpts.AccessTokenTTL = env.accessTokenTTL
+	apiOpts.RefreshTokenTTL = env.refreshTokenTTL
+	apiOpts.OutboundQueueSize = env.outboundQueueSize
+	apiOpts.StallTimeout = env.stallTimeout
+	apiOpts.SessionPolicy = env.sessionPolicy
+	apiOpts.PingInterval = env.pingInterval
+	apiOpts.PingTimeout = env.pingTimeout
+	apiOpts.IdleTimeout = env.idleTimeout
+
+	if env.redisURL != "" {
+		redisOpts, err := redis.ParseURL(env.redisURL)
+		if err != nil {
+			log.Fatalf("Invalid REDIS_URL: %v", err)
+		}
+		client := redis.NewClient(redisOpts)
+		defer client.Close()
+		apiOpts.Bus = bus.NewRedisBus(client, env.nodeID)
+	}
 
-	router := apiOpts.NewRouter()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := apiOpts.NewServer()
+	go server.RunSweeper(ctx)
 
 	log.Println("Server Configuration")
 	log.Printf("Port: %s\n", env.port)
-	log.Printf("Database Path: %s\n", env.databasePath)
+	log.Printf("Database Driver: %s\n", env.databaseDriver)
+	if env.databaseDriver == "sqlite3" {
+		log.Printf("Database Path: %s\n", env.databasePath)
+	}
 	log.Printf("Allowed Origins: %s\n", env.allowedOrigins)
+	log.Printf("Message TTL: %s\n", env.messageTTL)
+	log.Printf("Mailbox Limits: %d messages, %d bytes\n", env.mailboxMaxMessages, env.mailboxMaxBytes)
+	if env.userRetention > 0 {
+		log.Printf("User Retention: %s\n", env.userRetention)
+	}
+	if env.redisURL != "" {
+		log.Printf("Node: %s\n", env.nodeID)
+	}
+
+	httpServer := &http.Server{Addr: ":" + env.port, Handler: server}
+	go func() {
+		log.Println("Starting server on :" + env.port)
+		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	log.Printf("Shutting down, draining connections for up to %s\n", env.drainTimeout)
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), env.drainTimeout)
+	defer cancel()
+
+	// websockets are hijacked, http.Server.Shutdown only stops accepting
+	// connections and waits for the other requests
+	if err := httpServer.Shutdown(drainCtx); err != nil {
+		log.Printf("Failed to stop the HTTP server: %v\n", err)
+	}
+	if err := server.Shutdown(drainCtx); err != nil {
+		log.Printf("Failed to drain the connections: %v\n", err)
+	}
+	log.Println("Server stopped")
+}
+
+func printPendingMigrations(env opts) {
+	if env.databaseDriver == "memory" {
+		log.Println("The memory database has no schema to migrate")
+		return
+	}
 
-	log.Println("Starting server on :" + env.port)
-	http.ListenAndServe(":"+env.port, router)
+	database, err := db.NewDatabase(db.DatabaseOpts{
+		Driver: env.databaseDriver,
+		Uri:    env.databasePath,
+		DryRun: true,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer database.Close()
+
+	pending, err := database.PendingMigrations()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(pending) == 0 {
+		log.Println("Database schema is up to date")
+		return
+	}
+	for _, migration := range pending {
+		log.Printf("Pending migration: %04d_%s\n", migration.Version, migration.Name)
+	}
 }
 
 func getEnv() opts {
@@ -45,14 +189,141 @@ func getEnv() opts {
 		port = "5000"
 	}
 
+	databaseDriver := os.Getenv("DATABASE_DRIVER")
+	if databaseDriver == "" {
+		databaseDriver = "sqlite3"
+	}
+
 	databasePath := os.Getenv("DATABASE_PATH")
 	if databasePath == "" {
 		databasePath = "sqlite3.db"
 	}
 
+	messageTTL := getEnvDuration("MESSAGE_TTL", api.DefaultMessageTTL)
+
+	var logSigningKey ed25519.PrivateKey
+	if value := os.Getenv("LOG_SIGNING_KEY"); value != "" {
+		seed, err := utils.DecodeBase64(value)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			log.Fatalf("Invalid LOG_SIGNING_KEY: expected a base64 encoded %d byte Ed25519 seed", ed25519.SeedSize)
+		}
+		logSigningKey = ed25519.NewKeyFromSeed(seed)
+	}
+
+	userIDs := utils.IDFormat{
+		Alphabet: os.Getenv("USER_ID_ALPHABET"),
+		Length:   int(getEnvInt("USER_ID_LENGTH", 0)),
+	}
+	userIDs.Checksum = getEnvBool("USER_ID_CHECKSUM", false)
+	if err := userIDs.Validate(); err != nil {
+		log.Fatalf("Invalid user id format: %v", err)
+	}
+
+	var reservedHandles []string
+	if value, ok := os.LookupEnv("RESERVED_HANDLES"); ok {
+		reservedHandles = []string{}
+		for _, handle := range strings.Split(value, ",") {
+			if handle = strings.TrimSpace(handle); handle != "" {
+				reservedHandles = append(reservedHandles, handle)
+			}
+		}
+	}
+
+	tokenKeys, err := utils.ParseTokenKeys(os.Getenv("TOKEN_KEYS"))
+	if err != nil {
+		log.Fatalf("Invalid TOKEN_KEYS: %v", err)
+	}
+
+	sessionPolicy := os.Getenv("SESSION_POLICY")
+	switch sessionPolicy {
+	case "", api.SessionPolicyReject, api.SessionPolicyReplace, api.SessionPolicyCoexist:
+	default:
+		log.Fatalf("Invalid SESSION_POLICY: %q", sessionPolicy)
+	}
+
+	// a connection answering every ping must never look idle
+	pingInterval := getEnvDuration("PING_INTERVAL", api.DefaultPingInterval)
+	idleTimeout := getEnvDuration("IDLE_TIMEOUT", api.DefaultIdleTimeout)
+	if idleTimeout <= pingInterval {
+		log.Fatalf("Invalid IDLE_TIMEOUT: %s must be longer than the PING_INTERVAL of %s", idleTimeout, pingInterval)
+	}
+
+	// node ids must be unique, a restarted node does not reuse the id of
+	// the node it replaces
+	nodeID := os.Getenv("NODE_ID")
+	if nodeID == "" {
+		hostname, _ := os.Hostname()
+		suffix, err := utils.RandomHex(4)
+		if err != nil {
+			log.Fatalf("Failed to generate a node id: %v", err)
+		}
+		nodeID = hostname + "-" + suffix
+	}
+
 	return opts{
-		port:           port,
-		databasePath:   databasePath,
-		allowedOrigins: strings.Split(os.Getenv("ALLOWED_ORIGINS"), ","),
+		port:               port,
+		databaseDriver:     databaseDriver,
+		databasePath:       databasePath,
+		allowedOrigins:     strings.Split(os.Getenv("ALLOWED_ORIGINS"), ","),
+		messageTTL:         messageTTL,
+		mailboxMaxMessages: int(getEnvInt("MAILBOX_MAX_MESSAGES", api.DefaultMailboxMaxMessages)),
+		mailboxMaxBytes:    getEnvInt("MAILBOX_MAX_BYTES", api.DefaultMailboxMaxBytes),
+		userRetention:      time.Duration(getEnvInt("USER_RETENTION_DAYS", 0)) * 24 * time.Hour,
+		adminToken:         os.Getenv("ADMIN_TOKEN"),
+		logSigningKey:      logSigningKey,
+		devMode:            getEnvBool("DEV_MODE", false),
+		userIDs:            userIDs,
+		reservedHandles:    reservedHandles,
+		tokenKeys:          tokenKeys,
+		accessTokenTTL:     getEnvDuration("ACCESS_TOKEN_TTL", api.DefaultAccessTokenTTL),
+		refreshTokenTTL:    getEnvDuration("REFRESH_TOKEN_TTL", api.DefaultRefreshTokenTTL),
+		outboundQueueSize:  int(getEnvInt("OUTBOUND_QUEUE_SIZE", api.DefaultOutboundQueueSize)),
+		stallTimeout:       getEnvDuration("STALL_TIMEOUT", api.DefaultStallTimeout),
+		sessionPolicy:      sessionPolicy,
+		pingInterval:       pingInterval,
+		pingTimeout:        getEnvDuration("PING_TIMEOUT", api.DefaultPingTimeout),
+		idleTimeout:        idleTimeout,
+		drainTimeout:       getEnvDuration("DRAIN_TIMEOUT", defaultDrainTimeout),
+		redisURL:           os.Getenv("REDIS_URL"),
+		nodeID:             nodeID,
+	}
+}
+
+func getEnvInt(name string, defaultValue int64) int64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return n
+}
+
+func getEnvBool(name string, defaultValue bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return b
+}
+
+func getEnvDuration(name string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
 	}
+	return d
 }
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"strings"
+	"time"
+
+	"enigma-protocol-go/pkg/db"
+	"enigma-protocol-go/pkg/models"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// AdminAPI exposes maintenance endpoints for the operators of the server,
+// requests need the admin token as bearer token.
+type AdminAPI struct {
+	db            db.Store
+	token         string
+	userRetention time.Duration
+}
+
+func NewAdminAPI(opts APIOpts) *AdminAPI {
+	return &AdminAPI{
+		db:            opts.Database,
+		token:         opts.AdminToken,
+		userRetention: opts.UserRetention,
+	}
+}
+
+func (a *AdminAPI) Register(r *httprouter.Router) {
+	r.GET("/admin/retention", inJSON(a.admin(a.retentionReport)))
+	r.GET("/admin/metrics", inJSON(a.admin(a.metrics)))
+}
+
+// admin only calls api when the request carries the admin token.
+func (a *AdminAPI) admin(api APIFunc) APIFunc {
+	return func(r *http.Request, ps httprouter.Params) (interface{}, *models.APIError) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if a.token == "" || !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			return nil, forbidden("invalid admin token")
+		}
+		return api(r, ps)
+	}
+}
+
+// retentionReport lists the users the retention job would delete now,
+// without deleting them.
+func (a *AdminAPI) retentionReport(_ *http.Request, _ httprouter.Params) (interface{}, *models.APIError) {
+	if a.userRetention <= 0 {
+		return nil, badRequest(models.CodeRetentionOff, "user retention is not configured")
+	}
+
+	cutoff := time.Now().Add(-a.userRetention)
+	users, err := a.db.GetInactiveUsers(cutoff)
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	return &models.RetentionReport{Cutoff: cutoff, Users: users}, nil
+}
+
+// metrics returns the published expvar variables, like the runtime memory
+// statistics and the websocket sessions reaped by the keepalive.
+func (a *AdminAPI) metrics(_ *http.Request, _ httprouter.Params) (interface{}, *models.APIError) {
+	vars := make(map[string]json.RawMessage)
+	expvar.Do(func(kv expvar.KeyValue) {
+		vars[kv.Key] = json.RawMessage(kv.Value.String())
+	})
+	return vars, nil
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"enigma-protocol-go/pkg/models"
+)
+
+func TestRetentionReportDisabled(t *testing.T) {
+	router := setupWith(func(opts *APIOpts) {
+		opts.AdminToken = "test-admin-token"
+	})
+	defer cleanup()
+
+	req, _ := http.NewRequest("GET", "/admin/retention", nil)
+	req.Header.Set("Authorization", "Bearer test-admin-token")
+	rr := httptest.NewRecorder()
+
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("Expected status %v, but got %v", http.StatusBadRequest, status)
+	}
+
+	var res models.ErrorMessage
+	json.NewDecoder(rr.Body).Decode(&res)
+	if res.Code != models.CodeRetentionOff {
+		t.Errorf("Expected code %v, but got %v", models.CodeRetentionOff, res.Code)
+	}
+}
+
+func TestRetentionReport(t *testing.T) {
+	router := setupWith(func(opts *APIOpts) {
+		opts.AdminToken = "test-admin-token"
+		opts.UserRetention = time.Nanosecond
+	})
+	defer cleanup()
+
+	user := createUser(t, router)
+	time.Sleep(time.Millisecond)
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"no token", "", http.StatusForbidden},
+		{"wrong token", "Bearer random-token", http.StatusForbidden},
+		{"valid", "Bearer test-admin-token", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/admin/retention", nil)
+			req.Header.Set("Authorization", tt.token)
+			rr := httptest.NewRecorder()
+
+			router.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tt.status {
+				t.Fatalf("Expected status %v, but got %v", tt.status, status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			var res models.RetentionReport
+			if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if len(res.Users) != 1 || res.Users[0].ID != user.id {
+				t.Errorf("Expected user %s, got %v", user.id, res.Users)
+			}
+		})
+	}
+
+	// the report does not delete anything
+	req, _ := http.NewRequest("GET", "/connect/"+user.id, nil)
+	rr := httptest.NewRecorder()
+
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("Expected status %v, but got %v", http.StatusOK, status)
+	}
+}
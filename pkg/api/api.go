@@ -1,11 +1,15 @@
 package api
 
 import (
+	"crypto/ed25519"
 	"encoding/json"
 	"net/http"
+	"time"
 
+	"enigma-protocol-go/pkg/bus"
 	"enigma-protocol-go/pkg/db"
 	"enigma-protocol-go/pkg/models"
+	"enigma-protocol-go/pkg/utils"
 
 	"github.com/julienschmidt/httprouter"
 	"github.com/rs/cors"
@@ -13,22 +17,181 @@ import (
 
 type APIFunc func(r *http.Request, ps httprouter.Params) (interface{}, *models.APIError)
 
+const (
+	DefaultMessageTTL         = 30 * 24 * time.Hour
+	DefaultMailboxMaxMessages = 1000
+	DefaultMailboxMaxBytes    = 10 << 20
+	DefaultAccessTokenTTL     = 15 * time.Minute
+	DefaultRefreshTokenTTL    = 30 * 24 * time.Hour
+	DefaultOutboundQueueSize  = 256
+	DefaultStallTimeout       = 10 * time.Second
+	DefaultPingInterval       = 30 * time.Second
+	DefaultPingTimeout        = 10 * time.Second
+	DefaultIdleTimeout        = 90 * time.Second
+)
+
 type APIOpts struct {
-	Database       *db.Database
+	Database       db.Store
 	AllowedOrigins []string
+	// MessageTTL is how long undelivered messages are kept.
+	MessageTTL time.Duration
+	// MailboxMaxMessages and MailboxMaxBytes limit the pending messages of a
+	// single recipient, messages over the limit are rejected.
+	MailboxMaxMessages int
+	MailboxMaxBytes    int64
+	// UserRetention is how long users can stay inactive before they are
+	// deleted, zero keeps them forever.
+	UserRetention time.Duration
+	// AdminToken protects the /admin endpoints, they are disabled when it
+	// is empty.
+	AdminToken string
+	// LogSigningKey signs the tree heads of the key log, a random key is
+	// used when it is nil.
+	LogSigningKey ed25519.PrivateKey
+	// UserIDs is the format of the user ids, the one the database generates
+	// them with.
+	UserIDs utils.IDFormat
+	// ReservedHandles cannot be claimed, nor handles looking like them.
+	// utils.DefaultReservedHandles are used when it is nil.
+	ReservedHandles []string
+	// TokenKeys sign the session tokens, the first one signs new tokens and
+	// the others only verify them. A random key is used when it is empty.
+	TokenKeys []utils.TokenKey
+	// AccessTokenTTL and RefreshTokenTTL are how long session tokens are
+	// valid.
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	// OutboundQueueSize is the number of frames queued for a websocket
+	// session, messages which do not fit stay pending until the session
+	// catches up.
+	OutboundQueueSize int
+	// StallTimeout is how long writing a frame to a websocket session can
+	// take before the session is closed as too slow.
+	StallTimeout time.Duration
+	// SessionPolicy is one of the SessionPolicy constants, it decides what
+	// happens when a device connects while it is connected already.
+	// SessionPolicyReject is used when it is empty.
+	SessionPolicy string
+	// SessionEvents is called with the events emitted by the session
+	// policy, they are logged either way.
+	SessionEvents func(SessionEvent)
+	// PingInterval is how often websocket sessions are pinged and
+	// PingTimeout how long the pong can take before the session is closed.
+	PingInterval time.Duration
+	PingTimeout  time.Duration
+	// IdleTimeout closes websocket sessions which sent neither a frame nor
+	// a pong for that long, it must be longer than PingInterval.
+	IdleTimeout time.Duration
+	// Bus connects the servers sharing the database, so messages reach the
+	// users connected to the other servers. bus.NewLocalBus is used when it
+	// is nil, for a server running alone.
+	Bus bus.Bus
+}
+
+func (opts APIOpts) messageTTL() time.Duration {
+	if opts.MessageTTL <= 0 {
+		return DefaultMessageTTL
+	}
+	return opts.MessageTTL
+}
+
+func (opts APIOpts) mailboxMaxMessages() int {
+	if opts.MailboxMaxMessages <= 0 {
+		return DefaultMailboxMaxMessages
+	}
+	return opts.MailboxMaxMessages
+}
+
+func (opts APIOpts) mailboxMaxBytes() int64 {
+	if opts.MailboxMaxBytes <= 0 {
+		return DefaultMailboxMaxBytes
+	}
+	return opts.MailboxMaxBytes
+}
+
+func (opts APIOpts) accessTokenTTL() time.Duration {
+	if opts.AccessTokenTTL <= 0 {
+		return DefaultAccessTokenTTL
+	}
+	return opts.AccessTokenTTL
+}
+
+func (opts APIOpts) refreshTokenTTL() time.Duration {
+	if opts.RefreshTokenTTL <= 0 {
+		return DefaultRefreshTokenTTL
+	}
+	return opts.RefreshTokenTTL
+}
+
+func (opts APIOpts) outboundQueueSize() int {
+	if opts.OutboundQueueSize <= 0 {
+		return DefaultOutboundQueueSize
+	}
+	return opts.OutboundQueueSize
+}
+
+func (opts APIOpts) stallTimeout() time.Duration {
+	if opts.StallTimeout <= 0 {
+		return DefaultStallTimeout
+	}
+	return opts.StallTimeout
+}
+
+func (opts APIOpts) pingInterval() time.Duration {
+	if opts.PingInterval <= 0 {
+		return DefaultPingInterval
+	}
+	return opts.PingInterval
+}
+
+func (opts APIOpts) pingTimeout() time.Duration {
+	if opts.PingTimeout <= 0 {
+		return DefaultPingTimeout
+	}
+	return opts.PingTimeout
+}
+
+func (opts APIOpts) idleTimeout() time.Duration {
+	if opts.IdleTimeout <= 0 {
+		return DefaultIdleTimeout
+	}
+	return opts.IdleTimeout
+}
+
+func (opts APIOpts) bus() bus.Bus {
+	if opts.Bus == nil {
+		return bus.NewLocalBus()
+	}
+	return opts.Bus
+}
+
+func (opts APIOpts) sessionPolicy() string {
+	if opts.SessionPolicy == "" {
+		return SessionPolicyReject
+	}
+	return opts.SessionPolicy
+}
+
+func (opts APIOpts) reservedHandles() []string {
+	if opts.ReservedHandles == nil {
+		return utils.DefaultReservedHandles
+	}
+	return opts.ReservedHandles
 }
 
 func NewAPIOpts(
 	dbopts *db.DatabaseOpts,
 	allowedOrigins []string,
 ) (*APIOpts, error) {
-	var database *db.Database
+	var database db.Store
+	var userIDs utils.IDFormat
 	var err error
 
 	if dbopts == nil {
 		database, err = db.NewDefaultDatabase()
 	} else {
-		database, err = db.NewDatabase(*dbopts)
+		database, err = db.NewStore(*dbopts)
+		userIDs = dbopts.UserIDs
 	}
 
 	if err != nil {
@@ -38,44 +201,77 @@ func NewAPIOpts(
 	return &APIOpts{
 		Database:       database,
 		AllowedOrigins: allowedOrigins,
+		UserIDs:        userIDs,
 	}, nil
 }
 
 func inJSON(api APIFunc) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		w.Header().Set("Content-Type", "application/json")
-
 		res, err := api(r, ps)
 		if err != nil {
-			w.WriteHeader(err.Code)
-			json.NewEncoder(w).Encode(err.Message)
+			writeJSON(w, err.Code, err.Message)
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(res)
+		writeJSON(w, http.StatusOK, res)
 	}
 }
 
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// NewRouter returns the handler of the API, see NewServer to shut it down.
 func (opts APIOpts) NewRouter() http.Handler {
+	return opts.NewServer()
+}
+
+// NewServer returns the handler of the API together with what it has to
+// drain when shutting down.
+func (opts APIOpts) NewServer() *Server {
 	router := httprouter.New()
 
-	protocolAPI := NewProtocolAPI(opts)
-	protocolAPI.Register(router)
+	tokenAPI := NewTokenAPI(opts)
+	tokenAPI.Register(router)
 
-	websocketAPI := NewWebsocketAPI(opts)
+	websocketAPI := NewWebsocketAPI(opts, tokenAPI)
 	websocketAPI.Register(router)
 
+	protocolAPI := NewProtocolAPI(opts, websocketAPI, websocketAPI, tokenAPI)
+	protocolAPI.Register(router)
+
+	preKeyAPI := NewPreKeyAPI(opts, websocketAPI, tokenAPI)
+	preKeyAPI.Register(router)
+
+	handleAPI := NewHandleAPI(opts)
+	handleAPI.Register(router)
+
+	groupAPI := NewGroupAPI(opts, tokenAPI)
+	groupAPI.Register(router)
+
+	transparencyAPI := NewTransparencyAPI(opts)
+	transparencyAPI.Register(router)
+
+	adminAPI := NewAdminAPI(opts)
+	adminAPI.Register(router)
+
 	router.GET("/", inJSON(index))
 	router.GET("/version", inJSON(version))
 
 	_cors := cors.Options{
 		AllowedOrigins: opts.AllowedOrigins,
-		AllowedMethods: []string{"GET", "POST"},
+		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE"},
+		AllowedHeaders: []string{"Authorization", "Content-Type", signatureHeader},
 	}
 
-	handler := cors.New(_cors).Handler(router)
-	return handler
+	return &Server{
+		Handler:    cors.New(_cors).Handler(router),
+		db:         opts.Database,
+		websockets: websocketAPI,
+		opts:       opts,
+	}
 }
 
 func index(r *http.Request, ps httprouter.Params) (interface{}, *models.APIError) {
@@ -0,0 +1,184 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"enigma-protocol-go/pkg/bus"
+	"enigma-protocol-go/pkg/models"
+)
+
+const (
+	// busTimeout bounds every request to the bus made for a session.
+	busTimeout = 5 * time.Second
+	// listenMinBackoff and listenMaxBackoff bound the wait before listening
+	// on the bus again after it failed.
+	listenMinBackoff = 100 * time.Millisecond
+	listenMaxBackoff = 30 * time.Second
+	// presenceRetryInterval is the wait before registering or unregistering
+	// a user with the bus again after it failed.
+	presenceRetryInterval = time.Second
+)
+
+// listen handles the events of the other nodes until shutdown. Listening
+// starts again when the bus fails, waiting longer after every failure.
+func (w *WebsocketAPI) listen() {
+	backoff := listenMinBackoff
+	for {
+		started := time.Now()
+		err := w.bus.Listen(w.ctx, w.handleEvent)
+		if w.ctx.Err() != nil {
+			return
+		}
+
+		// a bus which worked for a while is retried quickly again
+		if time.Since(started) > listenMaxBackoff {
+			backoff = listenMinBackoff
+		}
+		log.Printf("Failed to listen on the bus of node %s, retrying in %s: %v\n", w.bus.Node(), backoff, err)
+
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > listenMaxBackoff {
+			backoff = listenMaxBackoff
+		}
+	}
+}
+
+// handleEvent passes an event of another node on to the sessions of this
+// node, it must not block.
+func (w *WebsocketAPI) handleEvent(event bus.Event) {
+	switch event.Type {
+	case bus.EventMessage:
+		if event.Message != nil {
+			w.deliverLocal(*event.Message)
+		}
+	case bus.EventFrame:
+		w.notifyLocal(event.User, event.Frame)
+	case bus.EventPresence:
+		w.mu.Lock()
+		subscribers := w.subscribersOf(event.User)
+		w.mu.Unlock()
+		notifyPresence(subscribers, event.User, event.Presence)
+	case bus.EventDisconnect:
+		w.disconnectLocal(event.User, event.Reason)
+	}
+}
+
+// publish sends event to the other nodes of its user, the sessions on this
+// node are handled by the caller.
+func (w *WebsocketAPI) publish(ctx context.Context, event bus.Event) {
+	if err := w.bus.Publish(ctx, event); err != nil {
+		log.Printf("Failed to publish %s for user %s: %v\n", event.Type, event.User, err)
+	}
+}
+
+// publishFrame sends frame to the sessions of user on the other nodes.
+func (w *WebsocketAPI) publishFrame(ctx context.Context, user string, frame interface{}) {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return
+	}
+	w.publish(ctx, bus.Event{Type: bus.EventFrame, User: user, Frame: data})
+}
+
+// syncPresence registers user with the bus while it has sessions on this
+// node. The subscribers on every node are told when the user connected to
+// its first node or left its last one. It runs after every change of the
+// sessions and again a while after the bus failed. Only one call syncs a
+// user at a time, a call made meanwhile leaves it to that one, which syncs
+// again until the sessions stopped changing.
+func (w *WebsocketAPI) syncPresence(user string) {
+	w.busMu.Lock()
+	if _, ok := w.syncing[user]; ok {
+		w.syncing[user] = true
+		w.busMu.Unlock()
+		return
+	}
+	w.syncing[user] = false
+	w.busMu.Unlock()
+
+	for {
+		ok := w.updatePresence(user)
+
+		w.busMu.Lock()
+		if !ok || !w.syncing[user] {
+			delete(w.syncing, user)
+			w.busMu.Unlock()
+			if !ok {
+				w.retryPresence(user)
+			}
+			return
+		}
+		w.syncing[user] = false
+		w.busMu.Unlock()
+	}
+}
+
+// retryPresence syncs user again after presenceRetryInterval, so it does
+// not stay off the bus until its sessions change.
+func (w *WebsocketAPI) retryPresence(user string) {
+	time.AfterFunc(presenceRetryInterval, func() {
+		if w.ctx.Err() == nil {
+			w.syncPresence(user)
+		}
+	})
+}
+
+// updatePresence registers or unregisters user with the bus when its
+// sessions changed, it reports false when the bus failed. The user counts as
+// joined only once the bus registered it.
+func (w *WebsocketAPI) updatePresence(user string) bool {
+	connected := len(w.sessions(user)) > 0
+	w.busMu.Lock()
+	joined := w.joined[user]
+	w.busMu.Unlock()
+	if connected == joined {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), busTimeout)
+	defer cancel()
+
+	var changed bool
+	var err error
+	presence := models.FrameOnline
+	if connected {
+		changed, err = w.bus.Connect(ctx, user)
+	} else {
+		changed, err = w.bus.Disconnect(ctx, user)
+		presence = models.FrameOffline
+	}
+	if err != nil {
+		log.Printf("Failed to update the presence of user %s on the bus: %v\n", user, err)
+		return false
+	}
+
+	w.busMu.Lock()
+	if connected {
+		w.joined[user] = true
+	} else {
+		delete(w.joined, user)
+	}
+	w.busMu.Unlock()
+	if !changed {
+		return true
+	}
+
+	w.mu.Lock()
+	subscribers := w.subscribersOf(user)
+	w.mu.Unlock()
+	notifyPresence(subscribers, user, presence)
+
+	err = w.bus.Broadcast(ctx, bus.Event{Type: bus.EventPresence, User: user, Presence: presence})
+	if err != nil {
+		log.Printf("Failed to broadcast the presence of user %s: %v\n", user, err)
+	}
+	return true
+}
@@ -0,0 +1,177 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"enigma-protocol-go/pkg/bus"
+	"enigma-protocol-go/pkg/models"
+	"enigma-protocol-go/pkg/utils"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"nhooyr.io/websocket"
+)
+
+func TestBus(t *testing.T) {
+	tests := []struct {
+		name  string
+		nodes func(t *testing.T) (bus.Bus, bus.Bus)
+	}{
+		{"hub", func(t *testing.T) (bus.Bus, bus.Bus) {
+			hub := bus.NewHub()
+			return hub.Node("a"), hub.Node("b")
+		}},
+		{"redis", func(t *testing.T) (bus.Bus, bus.Bus) {
+			client := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+			t.Cleanup(func() { client.Close() })
+			return bus.NewRedisBus(client, "a"), bus.NewRedisBus(client, "b")
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := tt.nodes(t)
+			testBus(t, a, b)
+		})
+	}
+}
+
+func testBus(t *testing.T, a bus.Bus, b bus.Bus) {
+	// two nodes sharing the database, the bus and the token keys
+	var opts APIOpts
+	routerA := setupWith(func(nodeOpts *APIOpts) {
+		nodeOpts.TokenKeys = []utils.TokenKey{{ID: "test", Secret: bytes.Repeat([]byte{1}, utils.MinTokenSecretSize)}}
+		nodeOpts.Bus = a
+		opts = *nodeOpts
+	})
+	defer cleanup()
+	opts.Bus = b
+	routerB := opts.NewRouter()
+
+	user1 := createUser(t, routerA)
+	user2 := createUser(t, routerB)
+
+	sA := httptest.NewServer(routerA)
+	defer sA.Close()
+	sB := httptest.NewServer(routerB)
+	defer sB.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	c1 := dialUser(t, ctx, "ws"+sA.URL[4:]+"/ws/", user1)
+	defer c1.Close(websocket.StatusNormalClosure, "")
+	subscribe(t, ctx, c1, models.FrameSubscribe, user2.id)
+	if presence := readPresence(t, ctx, c1); presence.Type != models.FrameOffline {
+		t.Errorf("Expected %s, got %+v", models.FrameOffline, presence)
+	}
+
+	// the presence of users on the other node reaches the subscribers
+	c2 := dialUser(t, ctx, "ws"+sB.URL[4:]+"/ws/", user2)
+	if presence := readPresence(t, ctx, c1); presence.Type != models.FrameOnline || presence.User != user2.id {
+		t.Errorf("Expected %s for %s, got %+v", models.FrameOnline, user2.id, presence)
+	}
+
+	// messages and their receipts go to the node of the receiver
+	sendMessage(t, ctx, c1, models.TransmissionData{To: user2.id, Payload: "Hello from a"})
+	message := readMessage(t, ctx, c2)
+	if message.From != user1.id || message.Payload != "Hello from a" {
+		t.Errorf("Expected the message of %s, got %+v", user1.id, message)
+	}
+
+	var receipt models.TransmissionData
+	json.Unmarshal(readFrame(t, ctx, c1, models.FrameDelivered), &receipt)
+	if receipt.Ref != message.ID || receipt.From != user2.id {
+		t.Errorf("Expected a delivered receipt for %d, got %+v", message.ID, receipt)
+	}
+
+	// frames which are not stored too
+	data, _ := json.Marshal(models.TransmissionData{Type: models.FrameTyping, To: user1.id})
+	if err := c2.Write(ctx, websocket.MessageText, data); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	var typing models.TransmissionData
+	json.Unmarshal(readFrame(t, ctx, c1, models.FrameTyping), &typing)
+	if typing.From != user2.id {
+		t.Errorf("Expected %s to be typing, got %+v", user2.id, typing)
+	}
+
+	c2.Close(websocket.StatusNormalClosure, "")
+	if presence := readPresence(t, ctx, c1); presence.Type != models.FrameOffline || presence.User != user2.id {
+		t.Errorf("Expected %s for %s, got %+v", models.FrameOffline, user2.id, presence)
+	}
+}
+
+// failingBus fails to listen the first failures times.
+type failingBus struct {
+	bus.Bus
+	failures int32
+	listens  atomic.Int32
+}
+
+func (b *failingBus) Listen(ctx context.Context, handle func(bus.Event)) error {
+	if b.listens.Add(1) <= b.failures {
+		return errors.New("bus unreachable")
+	}
+	return b.Bus.Listen(ctx, handle)
+}
+
+func TestListenRetry(t *testing.T) {
+	hub := bus.NewHub()
+	a := &failingBus{Bus: hub.Node("a"), failures: 2}
+	setupWith(func(opts *APIOpts) {
+		opts.Bus = a
+	})
+	defer cleanup()
+
+	// the node listens again after every failure
+	for start := time.Now(); a.listens.Load() <= a.failures; {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("Expected node a to listen again, it tried %d times", a.listens.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPresenceRetry(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	router := setupWith(func(opts *APIOpts) {
+		opts.Bus = bus.NewRedisBus(client, "a")
+	})
+	defer cleanup()
+	other := bus.NewRedisBus(client, "b")
+
+	user := createUser(t, router)
+	s := httptest.NewServer(router)
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// the user connects while Redis fails, it is registered once Redis is
+	// back
+	server.SetError("ERR unavailable")
+	c := dialUser(t, ctx, "ws"+s.URL[4:]+"/ws/", user)
+	defer c.Close(websocket.StatusNormalClosure, "")
+	time.Sleep(100 * time.Millisecond)
+	server.SetError("")
+
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		online, err := other.Online(ctx, user.id)
+		if err == nil && online {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("Expected %s to be online on node b, got %v, %v", user.id, online, err)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"enigma-protocol-go/pkg/db"
+	"enigma-protocol-go/pkg/models"
+	"enigma-protocol-go/pkg/utils"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// GroupAPI manages group membership, messages to groups are sent over the
+// websocket.
+type GroupAPI struct {
+	db      db.Store
+	tokens  *TokenAPI
+	userIDs utils.IDFormat
+}
+
+func NewGroupAPI(opts APIOpts, tokens *TokenAPI) *GroupAPI {
+	return &GroupAPI{db: opts.Database, tokens: tokens, userIDs: opts.UserIDs}
+}
+
+func (g *GroupAPI) Register(r *httprouter.Router) {
+	r.POST("/groups", inJSON(g.createGroup))
+	r.GET("/groups/:id/members", inJSON(g.tokens.authenticated(g.getMembers)))
+	r.POST("/groups/:id/members", inJSON(g.addMember))
+	r.DELETE("/groups/:id/members/:member", inJSON(g.removeMember))
+}
+
+func (g *GroupAPI) getGroup(id string) (models.Group, *models.APIError) {
+	group, err := g.db.GetGroup(id)
+	if errors.Is(err, db.ErrNotFound) {
+		return group, notFound(models.CodeGroupNotFound)
+	} else if err != nil {
+		return group, internalError(err)
+	}
+	return group, nil
+}
+
+// verifyUser checks that the request was signed by user.
+func (g *GroupAPI) verifyUser(r *http.Request, user string, body []byte) *models.APIError {
+	publicKey, apiErr := userPublicKey(g.db, user)
+	if apiErr != nil {
+		return apiErr
+	}
+	return verifySignedBody(r, g.db, publicKey, body)
+}
+
+// checkMemberRequest checks that req is about the change of member in group
+// being requested.
+func checkMemberRequest(req models.GroupMemberRequest, group string, member string, action string) *models.APIError {
+	if req.Group != group || req.Member != member || req.Action != action {
+		return unauthorized(models.CodeRequestMismatch, "the request must "+action+" member "+member+" of group "+group)
+	}
+	return nil
+}
+
+func (g *GroupAPI) createGroup(r *http.Request, _ httprouter.Params) (interface{}, *models.APIError) {
+	var req models.CreateGroupRequest
+	body, apiErr := readBody(r, &req)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	req.Owner = g.userIDs.Normalize(req.Owner)
+	for i, member := range req.Members {
+		req.Members[i] = g.userIDs.Normalize(member)
+	}
+
+	if apiErr := g.verifyUser(r, req.Owner, body); apiErr != nil {
+		return nil, apiErr
+	}
+
+	for _, member := range req.Members {
+		if !g.db.IsUserExists(member) {
+			return nil, badRequest(models.CodeUserNotFound, "user "+member+" not found")
+		}
+	}
+
+	id, err := g.db.CreateGroup(req.Owner, req.Members)
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	group, apiErr := g.getGroup(id)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	return &group, nil
+}
+
+// getMembers lists the members of the group, only to its members.
+func (g *GroupAPI) getMembers(r *http.Request, ps httprouter.Params) (interface{}, *models.APIError) {
+	group, apiErr := g.getGroup(ps.ByName("id"))
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	for _, member := range group.Members {
+		if member == requester(r) {
+			return &group, nil
+		}
+	}
+	return nil, forbidden("only members can list the members")
+}
+
+// addMember adds a member to the group, only the owner can add members.
+func (g *GroupAPI) addMember(r *http.Request, ps httprouter.Params) (interface{}, *models.APIError) {
+	group, apiErr := g.getGroup(ps.ByName("id"))
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	var req models.GroupMemberRequest
+	body, apiErr := readBody(r, &req)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	req.User, req.Member = g.userIDs.Normalize(req.User), g.userIDs.Normalize(req.Member)
+
+	if apiErr := checkMemberRequest(req, group.ID, req.Member, models.GroupActionAdd); apiErr != nil {
+		return nil, apiErr
+	}
+	if apiErr := g.verifyUser(r, req.User, body); apiErr != nil {
+		return nil, apiErr
+	}
+
+	if req.User != group.Owner {
+		return nil, forbidden("only the owner can add members")
+	}
+
+	if !g.db.IsUserExists(req.Member) {
+		return nil, badRequest(models.CodeUserNotFound, "user "+req.Member+" not found")
+	}
+
+	err := g.db.AddGroupMember(group.ID, req.Member)
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	group, apiErr = g.getGroup(group.ID)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	return &group, nil
+}
+
+// removeMember removes a member from the group, either done by the owner or
+// by the member leaving the group. The owner cannot leave its group.
+func (g *GroupAPI) removeMember(r *http.Request, ps httprouter.Params) (interface{}, *models.APIError) {
+	group, apiErr := g.getGroup(ps.ByName("id"))
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	member := g.userIDs.Normalize(ps.ByName("member"))
+
+	var req models.GroupMemberRequest
+	body, apiErr := readBody(r, &req)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	req.User, req.Member = g.userIDs.Normalize(req.User), g.userIDs.Normalize(req.Member)
+
+	if apiErr := checkMemberRequest(req, group.ID, member, models.GroupActionRemove); apiErr != nil {
+		return nil, apiErr
+	}
+	if apiErr := g.verifyUser(r, req.User, body); apiErr != nil {
+		return nil, apiErr
+	}
+
+	if req.User != group.Owner && req.User != member {
+		return nil, forbidden("only the owner can remove other members")
+	}
+	if member == group.Owner {
+		return nil, forbidden("the owner cannot leave the group")
+	}
+
+	err := g.db.RemoveGroupMember(group.ID, member)
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	group, apiErr = g.getGroup(group.ID)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	return &group, nil
+}
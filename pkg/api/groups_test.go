@@ -0,0 +1,201 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"enigma-protocol-go/pkg/models"
+)
+
+// createGroup creates a group owned by owner, signed by the owner.
+// getMembers lists the members of group with the access token of requester.
+func getMembers(router http.Handler, requester testUser, group string) (int, models.Group) {
+	req, _ := http.NewRequest("GET", "/groups/"+group+"/members", nil)
+	req.Header.Set("Authorization", "Bearer "+requester.token)
+	rr := httptest.NewRecorder()
+
+	router.ServeHTTP(rr, req)
+
+	var res models.Group
+	json.NewDecoder(rr.Body).Decode(&res)
+	return rr.Code, res
+}
+
+func createGroup(t *testing.T, router http.Handler, owner testUser, members ...testUser) models.Group {
+	request := models.CreateGroupRequest{
+		SignedRequest: models.SignedRequest{Timestamp: time.Now().Unix()},
+		Owner:         owner.id,
+	}
+	for _, member := range members {
+		request.Members = append(request.Members, member.id)
+	}
+
+	req := signedRequest(t, "POST", "/groups", request, owner.privateKey)
+	rr := httptest.NewRecorder()
+
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Expected status %v, but got %v", http.StatusOK, status)
+	}
+
+	var group models.Group
+	if err := json.NewDecoder(rr.Body).Decode(&group); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return group
+}
+
+func sortedIDs(users ...testUser) []string {
+	var ids []string
+	for _, user := range users {
+		ids = append(ids, user.id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestGroups(t *testing.T) {
+	router := setup()
+	defer cleanup()
+
+	owner := createUser(t, router)
+	member1 := createUser(t, router)
+	member2 := createUser(t, router)
+
+	group := createGroup(t, router, owner, member1)
+	if group.Owner != owner.id || !reflect.DeepEqual(group.Members, sortedIDs(owner, member1)) {
+		t.Errorf("Expected group of %v and %v, got %v", owner.id, member1.id, group)
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		member  string
+		user    testUser
+		status  int
+		code    string
+		members []string
+	}{
+		{"add by member", "POST", member2.id, member1, http.StatusForbidden, models.CodeForbidden, nil},
+		{"add unknown user", "POST", "random-user", owner, http.StatusBadRequest, models.CodeUserNotFound, nil},
+		{"add by owner", "POST", member2.id, owner, http.StatusOK, "", sortedIDs(owner, member1, member2)},
+		{"remove other by member", "DELETE", member2.id, member1, http.StatusForbidden, models.CodeForbidden, nil},
+		{"remove owner", "DELETE", owner.id, owner, http.StatusForbidden, models.CodeForbidden, nil},
+		{"leave", "DELETE", member1.id, member1, http.StatusOK, "", sortedIDs(owner, member2)},
+		{"remove by owner", "DELETE", member2.id, owner, http.StatusOK, "", sortedIDs(owner)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := "/groups/" + group.ID + "/members"
+			request := models.GroupMemberRequest{
+				SignedRequest: models.SignedRequest{Timestamp: time.Now().Unix()},
+				User:          tt.user.id,
+				Group:         group.ID,
+				Member:        tt.member,
+				Action:        models.GroupActionAdd,
+			}
+			if tt.method == "DELETE" {
+				url += "/" + tt.member
+				request.Action = models.GroupActionRemove
+			}
+
+			req := signedRequest(t, tt.method, url, request, tt.user.privateKey)
+			rr := httptest.NewRecorder()
+
+			router.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tt.status {
+				t.Fatalf("Expected status %v, but got %v", tt.status, status)
+			}
+
+			if tt.code != "" {
+				var res models.ErrorMessage
+				json.NewDecoder(rr.Body).Decode(&res)
+				if res.Code != tt.code {
+					t.Errorf("Expected code %v, but got %v", tt.code, res.Code)
+				}
+				return
+			}
+
+			var res models.Group
+			json.NewDecoder(rr.Body).Decode(&res)
+			if !reflect.DeepEqual(res.Members, tt.members) {
+				t.Errorf("Expected members %v, got %v", tt.members, res.Members)
+			}
+		})
+	}
+
+	status, res := getMembers(router, owner, group.ID)
+	if status != http.StatusOK || !reflect.DeepEqual(res.Members, []string{owner.id}) {
+		t.Errorf("Expected members %v, got %v %v", []string{owner.id}, status, res.Members)
+	}
+
+	// the members are only listed to members with an access token
+	if status, _ := getMembers(router, member1, group.ID); status != http.StatusForbidden {
+		t.Errorf("Expected status %v, but got %v", http.StatusForbidden, status)
+	}
+	if status, _ := getMembers(router, testUser{}, group.ID); status != http.StatusUnauthorized {
+		t.Errorf("Expected status %v, but got %v", http.StatusUnauthorized, status)
+	}
+
+	if status, _ := getMembers(router, owner, "random-group"); status != http.StatusNotFound {
+		t.Errorf("Expected status %v, but got %v", http.StatusNotFound, status)
+	}
+}
+
+func TestGroupMemberRequestMismatch(t *testing.T) {
+	router := setup()
+	defer cleanup()
+
+	owner := createUser(t, router)
+	member1 := createUser(t, router)
+	member2 := createUser(t, router)
+	group := createGroup(t, router, owner, member1, member2)
+	other := createGroup(t, router, owner, member1)
+
+	tests := []struct {
+		name   string
+		url    string
+		group  string
+		member string
+		action string
+	}{
+		{"other group", "/groups/" + group.ID + "/members/" + member1.id, other.ID, member1.id, models.GroupActionRemove},
+		{"other member", "/groups/" + group.ID + "/members/" + member2.id, group.ID, member1.id, models.GroupActionRemove},
+		{"other action", "/groups/" + group.ID + "/members/" + member1.id, group.ID, member1.id, models.GroupActionAdd},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := signedRequest(t, "DELETE", tt.url, models.GroupMemberRequest{
+				SignedRequest: models.SignedRequest{Timestamp: time.Now().Unix()},
+				User:          owner.id,
+				Group:         tt.group,
+				Member:        tt.member,
+				Action:        tt.action,
+			}, owner.privateKey)
+			rr := httptest.NewRecorder()
+
+			router.ServeHTTP(rr, req)
+
+			var res models.ErrorMessage
+			json.NewDecoder(rr.Body).Decode(&res)
+			if rr.Code != http.StatusUnauthorized || res.Code != models.CodeRequestMismatch {
+				t.Errorf("Expected status %v with %s, but got %v with %s", http.StatusUnauthorized, models.CodeRequestMismatch, rr.Code, res.Code)
+			}
+		})
+	}
+
+	// nobody was removed
+	_, res := getMembers(router, member2, group.ID)
+	if members := sortedIDs(owner, member1, member2); !reflect.DeepEqual(res.Members, members) {
+		t.Errorf("Expected members %v, got %v", members, res.Members)
+	}
+}
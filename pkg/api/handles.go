@@ -0,0 +1,110 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"enigma-protocol-go/pkg/db"
+	"enigma-protocol-go/pkg/models"
+	"enigma-protocol-go/pkg/utils"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// HandleAPI lets users claim a handle like @alice, which others can use
+// instead of the user id.
+type HandleAPI struct {
+	db db.Store
+	// reserved holds the skeletons of the reserved handles
+	reserved map[string]bool
+	userIDs  utils.IDFormat
+}
+
+func NewHandleAPI(opts APIOpts) *HandleAPI {
+	reserved := make(map[string]bool)
+	for _, handle := range opts.reservedHandles() {
+		reserved[utils.HandleSkeleton(handle)] = true
+	}
+	return &HandleAPI{db: opts.Database, reserved: reserved, userIDs: opts.UserIDs}
+}
+
+func (h *HandleAPI) Register(r *httprouter.Router) {
+	r.PUT("/users/:id/handle", inJSON(h.claimHandle))
+	r.DELETE("/users/:id/handle", inJSON(h.releaseHandle))
+}
+
+// readHandleRequest reads a request signed by the user and returns the
+// normalized handle of the body.
+func (h *HandleAPI) readHandleRequest(r *http.Request, id string) (string, *models.APIError) {
+	var req models.HandleRequest
+	body, apiErr := readBody(r, &req)
+	if apiErr != nil {
+		return "", apiErr
+	}
+
+	publicKey, apiErr := userPublicKey(h.db, id)
+	if apiErr != nil {
+		return "", apiErr
+	}
+
+	if apiErr := verifySignedBody(r, h.db, publicKey, body); apiErr != nil {
+		return "", apiErr
+	}
+
+	handle, err := utils.NormalizeHandle(req.Handle)
+	if err != nil {
+		return "", invalidField(models.CodeInvalidHandle, "handle", err.Error())
+	}
+	return handle, nil
+}
+
+// claimHandle gives the user a handle or changes its handle, handles which
+// look like a reserved one or the handle of another user are refused.
+func (h *HandleAPI) claimHandle(r *http.Request, ps httprouter.Params) (interface{}, *models.APIError) {
+	id := h.userIDs.Normalize(ps.ByName("id"))
+
+	handle, apiErr := h.readHandleRequest(r, id)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	skeleton := utils.HandleSkeleton(handle)
+	if h.reserved[skeleton] {
+		return nil, invalidField(models.CodeHandleReserved, "handle", "the handle or one looking like it is reserved")
+	}
+
+	err := h.db.SetHandle(id, handle, skeleton)
+	if errors.Is(err, db.ErrHandleTaken) {
+		return nil, conflict(models.CodeHandleTaken, "the handle or one looking like it belongs to another user")
+	} else if err != nil {
+		return nil, internalError(err)
+	}
+
+	return &models.HandleResponse{User: id, Handle: handle}, nil
+}
+
+// releaseHandle removes the handle of the user. Claims have the same body,
+// but signed requests are bound to their method, so a claim cannot be
+// replayed to release the handle. The body names the handle being released.
+func (h *HandleAPI) releaseHandle(r *http.Request, ps httprouter.Params) (interface{}, *models.APIError) {
+	id := h.userIDs.Normalize(ps.ByName("id"))
+
+	handle, apiErr := h.readHandleRequest(r, id)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	current, err := h.db.GetHandle(id)
+	if errors.Is(err, db.ErrNotFound) || (err == nil && current != handle) {
+		return nil, notFound(models.CodeHandleNotFound)
+	} else if err != nil {
+		return nil, internalError(err)
+	}
+
+	err = h.db.DeleteHandle(id)
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	return &models.HandleResponse{User: id}, nil
+}
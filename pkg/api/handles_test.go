@@ -0,0 +1,113 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"enigma-protocol-go/pkg/models"
+)
+
+func handleRequest(t *testing.T, router http.Handler, method string, user testUser, handle string) *httptest.ResponseRecorder {
+	req := signedRequest(t, method, "/users/"+user.id+"/handle", models.HandleRequest{
+		SignedRequest: models.SignedRequest{Timestamp: time.Now().Unix()},
+		Handle:        handle,
+	}, user.privateKey)
+	rr := httptest.NewRecorder()
+
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestHandles(t *testing.T) {
+	router := setupWith(func(opts *APIOpts) {
+		opts.ReservedHandles = []string{"enigma"}
+	})
+	defer cleanup()
+
+	alice := createUser(t, router)
+	bob := createUser(t, router)
+
+	tests := []struct {
+		name   string
+		user   testUser
+		handle string
+		status int
+	}{
+		{"claim", alice, "@Alice", http.StatusOK},
+		{"taken", bob, "alice", http.StatusConflict},
+		{"confusable", bob, "a1ice", http.StatusConflict},
+		{"other script", bob, "аlice", http.StatusBadRequest},
+		{"too short", bob, "bo", http.StatusBadRequest},
+		{"reserved", bob, "En1gma", http.StatusBadRequest},
+		{"not reserved", bob, "admin", http.StatusOK},
+		{"change", bob, "@bob.smith", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := handleRequest(t, router, "PUT", tt.user, tt.handle)
+			if status := rr.Code; status != tt.status {
+				t.Errorf("Expected status %v, but got %v: %s", tt.status, status, rr.Body)
+			}
+		})
+	}
+
+	var connected models.ConnectResponse
+	if status := getJSON(t, router, "/connect/@ALICE", &connected); status != http.StatusOK {
+		t.Fatalf("Expected status %v, but got %v", http.StatusOK, status)
+	}
+	if connected.User != alice.id || connected.Handle != "alice" {
+		t.Errorf("Expected user %s with handle alice, got %v", alice.id, connected)
+	}
+	if status := getJSON(t, router, "/connect/@admin", &connected); status != http.StatusNotFound {
+		t.Errorf("Expected status %v for a changed handle, but got %v", http.StatusNotFound, status)
+	}
+
+	// the body must name the handle being released
+	if rr := handleRequest(t, router, "DELETE", alice, "bob.smith"); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status %v, but got %v", http.StatusNotFound, rr.Code)
+	}
+	if rr := handleRequest(t, router, "DELETE", alice, "alice"); rr.Code != http.StatusOK {
+		t.Errorf("Expected status %v, but got %v", http.StatusOK, rr.Code)
+	}
+	if status := getJSON(t, router, "/connect/@alice", &connected); status != http.StatusNotFound {
+		t.Errorf("Expected status %v for a released handle, but got %v", http.StatusNotFound, status)
+	}
+	if rr := handleRequest(t, router, "PUT", bob, "alice"); rr.Code != http.StatusOK {
+		t.Errorf("Expected status %v for a released handle, but got %v", http.StatusOK, rr.Code)
+	}
+}
+
+func TestHandleReplay(t *testing.T) {
+	router := setup()
+	defer cleanup()
+
+	alice := createUser(t, router)
+
+	req := signedRequest(t, "PUT", "/users/"+alice.id+"/handle", models.HandleRequest{
+		SignedRequest: models.SignedRequest{Timestamp: time.Now().Unix()},
+		Handle:        "alice",
+	}, alice.privateKey)
+	body, _ := io.ReadAll(req.Body)
+
+	if rr := resend(router, req, body, "PUT", "/users/"+alice.id+"/handle"); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %v, but got %v", http.StatusOK, rr.Code)
+	}
+
+	// a claim is signed for PUT, it cannot release the handle
+	rr := resend(router, req, body, "DELETE", "/users/"+alice.id+"/handle")
+	var res models.ErrorMessage
+	json.NewDecoder(rr.Body).Decode(&res)
+	if rr.Code != http.StatusUnauthorized || res.Code != models.CodeRequestMismatch {
+		t.Errorf("Expected status %v with %s, but got %v with %s", http.StatusUnauthorized, models.CodeRequestMismatch, rr.Code, res.Code)
+	}
+
+	var connected models.ConnectResponse
+	if status := getJSON(t, router, "/connect/@alice", &connected); status != http.StatusOK || connected.User != alice.id {
+		t.Errorf("Expected @alice to belong to %s, got %v %v", alice.id, status, connected)
+	}
+}
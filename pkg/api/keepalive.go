@@ -0,0 +1,74 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"log"
+	"sync"
+	"time"
+)
+
+// Reasons a websocket session is reaped, the keys of reapedSessions.
+const (
+	reapPingTimeout = "ping_timeout"
+	reapIdleTimeout = "idle_timeout"
+)
+
+// reapedSessions counts the websocket sessions closed because their peer
+// seemed dead, by reason.
+var reapedSessions = expvar.NewMap("websocket_reaped_sessions")
+
+// keepalive pings the client of chat every ping interval until ctx is done.
+// reap is called when the peer seems dead: a pong does not arrive within the
+// ping timeout, or neither a frame nor a pong arrived for the idle timeout.
+// The returned function resets the idle timeout, it is called for every
+// frame read.
+func (w *WebsocketAPI) keepalive(ctx context.Context, reap context.CancelFunc, chat *Chat) func() {
+	var once sync.Once
+	reaped := func(reason string) {
+		once.Do(func() {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Disconnecting user %s on device %s, its connection is dead: %s\n", chat.user, chat.device, reason)
+			reapedSessions.Add(reason, 1)
+			reap()
+		})
+	}
+
+	idle := time.AfterFunc(w.idleTimeout, func() { reaped(reapIdleTimeout) })
+	go func() {
+		defer idle.Stop()
+
+		ticker := time.NewTicker(w.pingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			// Ping needs the handler to read the pong
+			pingCtx, cancel := context.WithTimeout(ctx, w.pingTimeout)
+			err := chat.connection.Ping(pingCtx)
+			cancel()
+			if err != nil {
+				// other errors mean the connection is closed already
+				if errors.Is(err, context.DeadlineExceeded) {
+					reaped(reapPingTimeout)
+				}
+				return
+			}
+			idle.Reset(w.idleTimeout)
+		}
+	}()
+
+	return func() {
+		if ctx.Err() == nil {
+			idle.Reset(w.idleTimeout)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// reapedCount returns how many sessions were reaped for reason.
+func reapedCount(reason string) int64 {
+	if count, ok := reapedSessions.Get(reason).(*expvar.Int); ok {
+		return count.Value()
+	}
+	return 0
+}
+
+func TestKeepalive(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(opts *APIOpts)
+	}{
+		{reapPingTimeout, func(opts *APIOpts) {
+			opts.PingInterval = 50 * time.Millisecond
+			opts.PingTimeout = 50 * time.Millisecond
+			opts.IdleTimeout = time.Hour
+		}},
+		{reapIdleTimeout, func(opts *APIOpts) {
+			opts.PingInterval = time.Hour
+			opts.IdleTimeout = 100 * time.Millisecond
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := setupWith(tt.configure)
+			defer cleanup()
+
+			user1 := createUser(t, router)
+			websockets := router.(*Server).websockets
+
+			s := httptest.NewServer(router)
+			defer s.Close()
+			wsEndpoint := "ws" + s.URL[4:] + "/ws/"
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+
+			// the client stops reading, so it answers no pings either
+			reaped := reapedCount(tt.name)
+			c1 := dialUser(t, ctx, wsEndpoint, user1)
+			defer c1.Close(websocket.StatusNormalClosure, "")
+
+			for len(websockets.sessions(user1.id)) > 0 {
+				if ctx.Err() != nil {
+					t.Fatalf("Expected the session to be reaped")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if count := reapedCount(tt.name); count != reaped+1 {
+				t.Errorf("Expected %d sessions reaped for %s, got %d", reaped+1, tt.name, count)
+			}
+
+			// the device can connect again right away
+			c2 := dialUser(t, ctx, wsEndpoint, user1)
+			c2.Close(websocket.StatusNormalClosure, "")
+		})
+	}
+}
+
+func TestKeepaliveAlive(t *testing.T) {
+	router := setupWith(func(opts *APIOpts) {
+		opts.PingInterval = 20 * time.Millisecond
+		opts.IdleTimeout = 100 * time.Millisecond
+		opts.AdminToken = "test-admin-token"
+	})
+	defer cleanup()
+
+	user1 := createUser(t, router)
+	websockets := router.(*Server).websockets
+
+	s := httptest.NewServer(router)
+	defer s.Close()
+	wsEndpoint := "ws" + s.URL[4:] + "/ws/"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// reading answers the pings, which keep the quiet session alive
+	c1 := dialUser(t, ctx, wsEndpoint, user1)
+	defer c1.Close(websocket.StatusNormalClosure, "")
+	c1.CloseRead(ctx)
+
+	time.Sleep(500 * time.Millisecond)
+	if len(websockets.sessions(user1.id)) != 1 {
+		t.Fatalf("Expected the session to stay connected")
+	}
+
+	req, _ := http.NewRequest("GET", "/admin/metrics", nil)
+	req.Header.Set("Authorization", "Bearer test-admin-token")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %v, but got %v", http.StatusOK, rr.Code)
+	}
+
+	var metrics map[string]json.RawMessage
+	json.NewDecoder(rr.Body).Decode(&metrics)
+	if _, ok := metrics["websocket_reaped_sessions"]; !ok {
+		t.Errorf("Expected the reaped sessions in the metrics, got %s", rr.Body)
+	}
+}
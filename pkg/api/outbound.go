@@ -0,0 +1,293 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log"
+	"time"
+
+	"enigma-protocol-go/pkg/models"
+
+	"nhooyr.io/websocket"
+)
+
+var errOutboundFull = errors.New("outbound queue is full")
+
+// droppedFrames counts the frames which are not stored, like typing
+// indicators, dropped because the queue of their chat was full, by type.
+var droppedFrames = expvar.NewMap("websocket_dropped_frames")
+
+// outboundFrame is a frame waiting in the queue of a chat.
+type outboundFrame struct {
+	data []byte
+	// message is set for stored messages, their sender gets a delivered
+	// receipt once the frame is written
+	message *models.TransmissionData
+}
+
+func newChat(user string, device string, conn *websocket.Conn, queueSize int) *Chat {
+	return &Chat{
+		user:       user,
+		device:     device,
+		connection: conn,
+		outbound:   make(chan outboundFrame, queueSize),
+		written:    make(map[int64]bool),
+		resync:     make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+}
+
+// enqueue adds frame to the queue of chat without waiting. Stored messages
+// are not queued once one of them did not fit, so they are not written out
+// of order, they are sent again when the writer caught up.
+func (chat *Chat) enqueue(frame outboundFrame) error {
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+
+	if frame.message != nil && chat.deferred {
+		chat.missed = true
+		return errOutboundFull
+	}
+	if chat.closed || (frame.message != nil && chat.spilled) {
+		return errOutboundFull
+	}
+	return chat.push(frame)
+}
+
+// push adds frame to the queue of chat, chat.mu must be held. A stored
+// message which does not fit spills the chat.
+func (chat *Chat) push(frame outboundFrame) error {
+	select {
+	case chat.outbound <- frame:
+		return nil
+	default:
+		if frame.message == nil {
+			droppedFrames.Add(frameType(frame.data), 1)
+			return errOutboundFull
+		}
+
+		chat.spill()
+		return errOutboundFull
+	}
+}
+
+// spill makes the writer send the pending messages of chat again once it
+// caught up, chat.mu must be held.
+func (chat *Chat) spill() {
+	chat.spilled = true
+	select {
+	case chat.resync <- struct{}{}:
+	default:
+	}
+}
+
+// frameType returns the type of the frame encoded in data.
+func frameType(data []byte) string {
+	var frame models.Frame
+	json.Unmarshal(data, &frame)
+	if frame.Type == "" {
+		return "unknown"
+	}
+	return frame.Type
+}
+
+// markWritten records that the message id was written to the client of chat
+// and waits for its acknowledgement.
+func (chat *Chat) markWritten(id int64) {
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+	chat.written[id] = true
+}
+
+// isWritten returns whether the message id was written to the client of
+// chat during this session.
+func (chat *Chat) isWritten(id int64) bool {
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+	return chat.written[id]
+}
+
+// acknowledged forgets the message id once the client acknowledged it.
+func (chat *Chat) acknowledged(id int64) {
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+	delete(chat.written, id)
+}
+
+// storedFrame is the frame of a message stored as pending.
+func storedFrame(message models.TransmissionData) (outboundFrame, error) {
+	// messages stored before receipts existed have no type
+	if message.Type == "" {
+		message.Type = models.FrameMessage
+	}
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return outboundFrame{}, err
+	}
+	return outboundFrame{data: data, message: &message}, nil
+}
+
+// sendStored queues a message which was stored as pending for the device
+// of chat.
+func (chat *Chat) sendStored(message models.TransmissionData) error {
+	frame, err := storedFrame(message)
+	if err != nil {
+		return err
+	}
+	return chat.enqueue(frame)
+}
+
+// takeSpilled clears and returns the spilled flag of chat.
+func (chat *Chat) takeSpilled() bool {
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+
+	spilled := chat.spilled
+	chat.spilled = false
+	return spilled
+}
+
+// deferStored keeps the stored messages for chat pending until sendPending
+// queued the messages loaded when the session started.
+func (chat *Chat) deferStored() {
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+	chat.deferred = true
+}
+
+// sendPending queues the pending messages of a new session ahead of the
+// stored messages arriving later. Those which arrived after messages were
+// loaded are sent again by the writer.
+func (chat *Chat) sendPending(messages []models.TransmissionData) {
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+
+	chat.deferred = false
+	for _, message := range messages {
+		if chat.closed || chat.spilled {
+			break
+		}
+
+		frame, err := storedFrame(message)
+		if err != nil {
+			continue
+		}
+		chat.push(frame)
+	}
+
+	if chat.missed {
+		chat.missed = false
+		chat.spill()
+	}
+}
+
+// flush stops the writer of chat once it wrote the queued frames, it waits
+// at most timeout.
+func (chat *Chat) flush(timeout time.Duration) {
+	chat.mu.Lock()
+	if !chat.closed {
+		chat.closed = true
+		close(chat.outbound)
+	}
+	chat.mu.Unlock()
+
+	select {
+	case <-chat.done:
+	case <-time.After(timeout):
+	}
+}
+
+// writeLoop writes the frames queued for chat until the queue is closed.
+// Once a write fails the connection is unusable, the remaining frames are
+// dropped and the stored ones stay pending.
+func (w *WebsocketAPI) writeLoop(chat *Chat) {
+	defer close(chat.done)
+
+	for {
+		select {
+		case frame, ok := <-chat.outbound:
+			if !ok {
+				return
+			}
+			if err := w.write(chat, frame); err != nil {
+				w.dropOutbound(chat, err)
+				return
+			}
+		case <-chat.resync:
+		}
+
+		// resend the spilled messages once the queue is empty, so the
+		// session does not fall behind again right away
+		if len(chat.outbound) == 0 && chat.takeSpilled() {
+			if err := w.resend(chat); err != nil {
+				w.dropOutbound(chat, err)
+				return
+			}
+		}
+	}
+}
+
+// write writes frame to the connection of chat. A write taking longer than
+// the stall timeout closes the connection, the client is too slow to keep up.
+func (w *WebsocketAPI) write(chat *Chat, frame outboundFrame) error {
+	// the message was sent again meanwhile, the client has it
+	if frame.message != nil && chat.isWritten(frame.message.ID) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), w.stallTimeout)
+	defer cancel()
+
+	err := chat.connection.Write(ctx, websocket.MessageText, frame.data)
+	if err != nil {
+		return err
+	}
+
+	if frame.message != nil {
+		chat.markWritten(frame.message.ID)
+		w.delivered(context.Background(), chat.device, *frame.message)
+	}
+	return nil
+}
+
+// resend writes the pending messages of chat which were not written during
+// this session yet, the client has the others and acknowledges them later.
+func (w *WebsocketAPI) resend(chat *Chat) error {
+	messages, err := w.db.GetPendingMessages(chat.user, chat.device)
+	if err != nil {
+		log.Printf("Failed to load the pending messages of %s on device %s: %v\n", chat.user, chat.device, err)
+		return nil
+	}
+
+	for _, message := range messages {
+		if chat.isWritten(message.ID) {
+			continue
+		}
+
+		frame, err := storedFrame(message)
+		if err != nil {
+			return err
+		}
+
+		err = w.write(chat, frame)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropOutbound closes the connection of chat after a failed write and
+// discards the frames queued until the chat is closed.
+func (w *WebsocketAPI) dropOutbound(chat *Chat, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("Disconnecting user %s on device %s, it stalled for %s\n", chat.user, chat.device, w.stallTimeout)
+	}
+	chat.connection.Close(websocket.StatusPolicyViolation, "too slow")
+
+	for range chat.outbound {
+	}
+}
@@ -0,0 +1,176 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"enigma-protocol-go/pkg/models"
+
+	"nhooyr.io/websocket"
+)
+
+// droppedCount returns how many frames of frameType were dropped.
+func droppedCount(frameType string) int64 {
+	if count, ok := droppedFrames.Get(frameType).(*expvar.Int); ok {
+		return count.Value()
+	}
+	return 0
+}
+
+func TestOutboundOverflow(t *testing.T) {
+	chat := newChat("test-user", models.PrimaryDevice, nil, 2)
+
+	if err := chat.sendJSON(context.Background(), models.Presence{Type: models.FrameOnline, User: "other"}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := chat.sendStored(models.TransmissionData{ID: 1, To: "test-user"}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := chat.sendStored(models.TransmissionData{ID: 2, To: "test-user"}); !errors.Is(err, errOutboundFull) {
+		t.Fatalf("Expected %v, got %v", errOutboundFull, err)
+	}
+
+	// later messages wait for the spilled one instead of overtaking it
+	<-chat.outbound
+	if err := chat.sendStored(models.TransmissionData{ID: 3, To: "test-user"}); !errors.Is(err, errOutboundFull) {
+		t.Errorf("Expected %v, got %v", errOutboundFull, err)
+	}
+	if err := chat.sendJSON(context.Background(), models.Presence{Type: models.FrameOffline, User: "other"}); err != nil {
+		t.Errorf("Expected frames which are not stored to be queued, got %v", err)
+	}
+
+	// frames which are not stored are dropped and counted once it is full
+	dropped := droppedCount(models.FrameTyping)
+	if err := chat.sendJSON(context.Background(), models.TransmissionData{Type: models.FrameTyping, From: "other"}); !errors.Is(err, errOutboundFull) {
+		t.Errorf("Expected %v, got %v", errOutboundFull, err)
+	}
+	if count := droppedCount(models.FrameTyping); count != dropped+1 {
+		t.Errorf("Expected %d dropped typing frames, got %d", dropped+1, count)
+	}
+
+	if !chat.takeSpilled() {
+		t.Errorf("Expected the chat to be spilled")
+	}
+	select {
+	case <-chat.resync:
+	default:
+		t.Errorf("Expected the writer to be woken up")
+	}
+}
+
+func TestSlowConsumer(t *testing.T) {
+	router := setupWith(func(opts *APIOpts) {
+		opts.OutboundQueueSize = 4
+		opts.StallTimeout = 200 * time.Millisecond
+		opts.MailboxMaxMessages = 10000
+		opts.MailboxMaxBytes = 1 << 30
+	})
+	defer cleanup()
+
+	user1 := createUser(t, router)
+	user2 := createUser(t, router)
+
+	s := httptest.NewServer(router)
+	wsEndpoint := "ws" + s.URL[4:] + "/ws/"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	c1 := dialUser(t, ctx, wsEndpoint, user1)
+	defer c1.Close(websocket.StatusNormalClosure, "")
+	// user2 stops reading, until the buffers of the connection are full
+	c2 := dialUser(t, ctx, wsEndpoint, user2)
+
+	subscribe(t, ctx, c1, models.FrameSubscribe, user2.id)
+	readFrame(t, ctx, c1, models.FrameOnline)
+
+	// the sender keeps going while user2 is stuck, until user2 is dropped
+	payload := strings.Repeat("x", 16<<10)
+	data, _ := json.Marshal(models.TransmissionData{From: user1.id, To: user2.id, Payload: payload})
+	sent := 0
+	for offline := false; !offline; {
+		if err := c1.Write(ctx, websocket.MessageText, data); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		sent++
+
+		for {
+			_, msg, err := c1.Read(ctx)
+			if err != nil {
+				t.Fatalf("Expected no error after %d messages, got %v", sent, err)
+			}
+			var frame models.Frame
+			json.Unmarshal(msg, &frame)
+			if frame.Type == models.FrameOffline {
+				offline = true
+			}
+			if frame.Type == models.FrameSent || offline {
+				break
+			}
+		}
+	}
+
+	// the dropped connection is closed once the buffered frames are read
+	for {
+		if _, _, err := c2.Read(ctx); err != nil {
+			break
+		}
+	}
+
+	// every message is still pending
+	c2 = dialUser(t, ctx, wsEndpoint, user2)
+	defer c2.Close(websocket.StatusNormalClosure, "")
+	for i := 0; i < sent; i++ {
+		readFrame(t, ctx, c2, models.FrameMessage)
+	}
+}
+
+func TestResendSkipsWritten(t *testing.T) {
+	router := setupWith(func(opts *APIOpts) {
+		opts.OutboundQueueSize = 1
+	})
+	defer cleanup()
+
+	user1 := createUser(t, router)
+	user2 := createUser(t, router)
+
+	s := httptest.NewServer(router)
+	defer s.Close()
+	wsEndpoint := "ws" + s.URL[4:] + "/ws/"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	c1 := dialUser(t, ctx, wsEndpoint, user1)
+	defer c1.Close(websocket.StatusNormalClosure, "")
+	c2 := dialUser(t, ctx, wsEndpoint, user2)
+	defer c2.Close(websocket.StatusNormalClosure, "")
+
+	// the messages spill out of the queue of user2, who acknowledges none
+	const count = 20
+	for i := 0; i < count; i++ {
+		sendMessage(t, ctx, c1, models.TransmissionData{To: user2.id, Payload: "Hello"})
+	}
+
+	seen := make(map[int64]bool)
+	for len(seen) < count {
+		message := readMessage(t, ctx, c2)
+		if seen[message.ID] {
+			t.Fatalf("Expected message %d once, got it again", message.ID)
+		}
+		seen[message.ID] = true
+	}
+
+	// nothing is sent again while the session lasts
+	readCtx, stop := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer stop()
+	if _, msg, err := c2.Read(readCtx); err == nil {
+		t.Errorf("Expected no more frames, got %s", msg)
+	}
+}
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"enigma-protocol-go/pkg/db"
+	"enigma-protocol-go/pkg/models"
+	"enigma-protocol-go/pkg/utils"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// maxOneTimePreKeys limits how many one-time prekeys a user can store.
+	maxOneTimePreKeys = 100
+	// lowPreKeyThreshold is the number of one-time prekeys below which the
+	// owner is asked to upload more.
+	lowPreKeyThreshold = 10
+)
+
+// notifier pushes frames to the connected devices of a user, the frames are
+// not stored when the user is offline.
+type notifier interface {
+	notify(ctx context.Context, user string, frame interface{})
+}
+
+// PreKeyAPI stores the prekeys users need to start sessions with peers
+// which are offline.
+type PreKeyAPI struct {
+	db       db.Store
+	notifier notifier
+	// tokens authenticate the users fetching prekeys
+	tokens  *TokenAPI
+	userIDs utils.IDFormat
+}
+
+func NewPreKeyAPI(opts APIOpts, notifier notifier, tokens *TokenAPI) *PreKeyAPI {
+	return &PreKeyAPI{db: opts.Database, notifier: notifier, tokens: tokens, userIDs: opts.UserIDs}
+}
+
+func (p *PreKeyAPI) Register(r *httprouter.Router) {
+	r.PUT("/users/:id/prekeys", inJSON(p.uploadPreKeys))
+	r.GET("/prekeys/:id", inJSON(p.tokens.authenticated(p.getPreKeyBundle)))
+}
+
+// validPreKey accepts base64 X25519 or P-256 public keys.
+func validPreKey(publicKey string) ([]byte, bool) {
+	key, err := utils.DecodeBase64(publicKey)
+	if err != nil {
+		return nil, false
+	}
+	return key, len(key) == 32 || len(key) == 33 || len(key) == 65
+}
+
+// uploadPreKeys stores the prekeys of a user, the request must be signed by
+// the user and the signed prekey by its identity key.
+func (p *PreKeyAPI) uploadPreKeys(r *http.Request, ps httprouter.Params) (interface{}, *models.APIError) {
+	id := p.userIDs.Normalize(ps.ByName("id"))
+
+	var req models.UploadPreKeysRequest
+	body, apiErr := readBody(r, &req)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	identityKey, apiErr := userPublicKey(p.db, id)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	if apiErr := verifySignedBody(r, p.db, identityKey, body); apiErr != nil {
+		return nil, apiErr
+	}
+
+	if req.SignedPreKey != nil {
+		key, ok := validPreKey(req.SignedPreKey.PublicKey)
+		if !ok {
+			return nil, badRequest(models.CodeInvalidPreKey, "invalid signed prekey")
+		}
+
+		signature, err := utils.DecodeBase64(req.SignedPreKey.Signature)
+		if err == nil {
+			err = utils.VerifySignature(identityKey, key, signature)
+		}
+		if err != nil {
+			return nil, badRequest(models.CodeInvalidSignature, "signed prekey: "+err.Error())
+		}
+	}
+
+	for _, key := range req.OneTimePreKeys {
+		if _, ok := validPreKey(key.PublicKey); !ok {
+			return nil, badRequest(models.CodeInvalidPreKey, "invalid one-time prekey")
+		}
+	}
+
+	// key ids only grow, consumed keys cannot be uploaded again
+	count, err := p.db.AddOneTimePreKeys(id, req.OneTimePreKeys, maxOneTimePreKeys)
+	if errors.Is(err, db.ErrTooManyPreKeys) {
+		return nil, badRequest(models.CodeTooManyPreKeys, "at most 100 one-time prekeys can be stored")
+	} else if err != nil {
+		return nil, internalError(err)
+	}
+
+	if req.SignedPreKey != nil {
+		err = p.db.SetSignedPreKey(id, *req.SignedPreKey)
+		if err != nil {
+			return nil, internalError(err)
+		}
+	}
+	return &models.PreKeyCount{Count: count}, nil
+}
+
+// getPreKeyBundle returns the prekeys of a user to another user with an
+// access token, the one-time prekey in it is never handed out again.
+func (p *PreKeyAPI) getPreKeyBundle(r *http.Request, ps httprouter.Params) (interface{}, *models.APIError) {
+	id := p.userIDs.Normalize(ps.ByName("id"))
+
+	identityKey, apiErr := userPublicKey(p.db, id)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	signedPreKey, err := p.db.GetSignedPreKey(id)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, notFound(models.CodePreKeysNotFound)
+	} else if err != nil {
+		return nil, internalError(err)
+	}
+
+	bundle := &models.PreKeyBundle{User: id, IdentityKey: identityKey, SignedPreKey: signedPreKey}
+
+	oneTimePreKey, err := p.db.ConsumeOneTimePreKey(id)
+	if err == nil {
+		bundle.OneTimePreKey = &oneTimePreKey
+	} else if !errors.Is(err, db.ErrNotFound) {
+		return nil, internalError(err)
+	}
+
+	count, err := p.db.CountOneTimePreKeys(id)
+	if err == nil && count < lowPreKeyThreshold {
+		p.notifier.notify(r.Context(), id, models.PreKeyCount{Type: models.FramePreKeysLow, Count: count})
+	}
+
+	return bundle, nil
+}
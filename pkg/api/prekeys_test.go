@@ -0,0 +1,252 @@
+package api
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"enigma-protocol-go/pkg/models"
+	"enigma-protocol-go/pkg/utils"
+
+	"nhooyr.io/websocket"
+)
+
+func randomPreKey(t *testing.T) []byte {
+	key, err := utils.RandomBytes(32)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return key
+}
+
+func uploadPreKeys(t *testing.T, router http.Handler, user testUser, request models.UploadPreKeysRequest) *httptest.ResponseRecorder {
+	request.Timestamp = time.Now().Unix()
+	req := signedRequest(t, "PUT", "/users/"+user.id+"/prekeys", request, user.privateKey)
+	rr := httptest.NewRecorder()
+
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+// getPreKeyBundle fetches the prekey bundle of user with the access token
+// of requester.
+func getPreKeyBundle(t *testing.T, router http.Handler, requester testUser, user string) models.PreKeyBundle {
+	req, _ := http.NewRequest("GET", "/prekeys/"+user, nil)
+	req.Header.Set("Authorization", "Bearer "+requester.token)
+	rr := httptest.NewRecorder()
+
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Expected status %v, but got %v", http.StatusOK, status)
+	}
+
+	var bundle models.PreKeyBundle
+	if err := json.NewDecoder(rr.Body).Decode(&bundle); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return bundle
+}
+
+func TestUploadPreKeys(t *testing.T) {
+	router := setup()
+	defer cleanup()
+
+	user := createUser(t, router)
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+
+	signedKey := randomPreKey(t)
+	signedPreKey := &models.SignedPreKey{
+		KeyID:     1,
+		PublicKey: base64.StdEncoding.EncodeToString(signedKey),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(user.privateKey, signedKey)),
+	}
+
+	var tooMany []models.PreKey
+	for i := 0; i <= maxOneTimePreKeys; i++ {
+		tooMany = append(tooMany, models.PreKey{KeyID: int64(i), PublicKey: base64.StdEncoding.EncodeToString(randomPreKey(t))})
+	}
+
+	tests := []struct {
+		name    string
+		request models.UploadPreKeysRequest
+		status  int
+		code    string
+	}{
+		{"valid", models.UploadPreKeysRequest{
+			SignedPreKey:   signedPreKey,
+			OneTimePreKeys: tooMany[:3],
+		}, http.StatusOK, ""},
+		{"invalid signature", models.UploadPreKeysRequest{
+			SignedPreKey: &models.SignedPreKey{
+				KeyID:     2,
+				PublicKey: signedPreKey.PublicKey,
+				Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(otherKey, signedKey)),
+			},
+		}, http.StatusBadRequest, models.CodeInvalidSignature},
+		{"invalid prekey", models.UploadPreKeysRequest{
+			OneTimePreKeys: []models.PreKey{{KeyID: 1, PublicKey: "random-key"}},
+		}, http.StatusBadRequest, models.CodeInvalidPreKey},
+		{"too many", models.UploadPreKeysRequest{
+			OneTimePreKeys: tooMany,
+		}, http.StatusBadRequest, models.CodeTooManyPreKeys},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := uploadPreKeys(t, router, user, tt.request)
+
+			if status := rr.Code; status != tt.status {
+				t.Fatalf("Expected status %v, but got %v", tt.status, status)
+			}
+
+			if tt.code != "" {
+				var res models.ErrorMessage
+				json.NewDecoder(rr.Body).Decode(&res)
+				if res.Code != tt.code {
+					t.Errorf("Expected code %v, but got %v", tt.code, res.Code)
+				}
+				return
+			}
+
+			var res models.PreKeyCount
+			json.NewDecoder(rr.Body).Decode(&res)
+			if res.Count != len(tt.request.OneTimePreKeys) {
+				t.Errorf("Expected %d one-time prekeys, got %d", len(tt.request.OneTimePreKeys), res.Count)
+			}
+		})
+	}
+
+	// only the user can upload its prekeys
+	rr := uploadPreKeys(t, router, testUser{id: user.id, privateKey: otherKey}, models.UploadPreKeysRequest{})
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("Expected status %v, but got %v", http.StatusUnauthorized, status)
+	}
+}
+
+func TestPreKeyBundle(t *testing.T) {
+	router := setup()
+	defer cleanup()
+
+	user := createUser(t, router)
+	other := createUser(t, router)
+
+	signedKey := randomPreKey(t)
+	signedPreKey := models.SignedPreKey{
+		KeyID:     1,
+		PublicKey: base64.StdEncoding.EncodeToString(signedKey),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(user.privateKey, signedKey)),
+	}
+	oneTimePreKeys := []models.PreKey{
+		{KeyID: 1, PublicKey: base64.StdEncoding.EncodeToString(randomPreKey(t))},
+		{KeyID: 2, PublicKey: base64.StdEncoding.EncodeToString(randomPreKey(t))},
+	}
+
+	rr := uploadPreKeys(t, router, user, models.UploadPreKeysRequest{SignedPreKey: &signedPreKey, OneTimePreKeys: oneTimePreKeys})
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Expected status %v, but got %v", http.StatusOK, status)
+	}
+
+	s := httptest.NewServer(router)
+	wsEndpoint := "ws" + s.URL[4:] + "/ws/"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	readPreKeysLow := func(c *websocket.Conn, expected int) {
+		var low models.PreKeyCount
+		json.Unmarshal(readFrame(t, ctx, c, models.FramePreKeysLow), &low)
+		if low.Count != expected {
+			t.Errorf("Expected %d one-time prekeys left, got %d", expected, low.Count)
+		}
+	}
+
+	// the owner is warned when connecting and every time a key is used
+	c := dialUser(t, ctx, wsEndpoint, user)
+	readPreKeysLow(c, 2)
+
+	for i, expected := range oneTimePreKeys {
+		bundle := getPreKeyBundle(t, router, other, user.id)
+		if bundle.SignedPreKey != signedPreKey || bundle.OneTimePreKey == nil || *bundle.OneTimePreKey != expected {
+			t.Errorf("Expected bundle with one-time prekey %v, got %v", expected, bundle)
+		}
+		readPreKeysLow(c, len(oneTimePreKeys)-i-1)
+	}
+
+	// the bundle is still usable without one-time prekeys
+	bundle := getPreKeyBundle(t, router, other, user.id)
+	if bundle.OneTimePreKey != nil || bundle.IdentityKey == "" {
+		t.Errorf("Expected bundle without one-time prekey, got %v", bundle)
+	}
+
+	req, _ := http.NewRequest("GET", "/prekeys/"+other.id, nil)
+	req.Header.Set("Authorization", "Bearer "+user.token)
+	rr = httptest.NewRecorder()
+
+	router.ServeHTTP(rr, req)
+
+	var res models.ErrorMessage
+	json.NewDecoder(rr.Body).Decode(&res)
+	if rr.Code != http.StatusNotFound || res.Code != models.CodePreKeysNotFound {
+		t.Errorf("Expected %v, got %v %v", models.CodePreKeysNotFound, rr.Code, res.Code)
+	}
+}
+
+func TestPreKeyReplay(t *testing.T) {
+	router := setup()
+	defer cleanup()
+
+	user := createUser(t, router)
+	other := createUser(t, router)
+
+	signedKey := randomPreKey(t)
+	signedPreKey := models.SignedPreKey{
+		KeyID:     1,
+		PublicKey: base64.StdEncoding.EncodeToString(signedKey),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(user.privateKey, signedKey)),
+	}
+	oneTimePreKeys := []models.PreKey{
+		{KeyID: 1, PublicKey: base64.StdEncoding.EncodeToString(randomPreKey(t))},
+		{KeyID: 2, PublicKey: base64.StdEncoding.EncodeToString(randomPreKey(t))},
+	}
+	request := models.UploadPreKeysRequest{SignedPreKey: &signedPreKey, OneTimePreKeys: oneTimePreKeys}
+
+	if rr := uploadPreKeys(t, router, user, request); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %v, but got %v", http.StatusOK, rr.Code)
+	}
+
+	// fetching bundles without an access token does not drain the keys
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", "/prekeys/"+user.id, nil)
+		rr := httptest.NewRecorder()
+
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusUnauthorized {
+			t.Fatalf("Expected status %v, but got %v", http.StatusUnauthorized, status)
+		}
+	}
+
+	for _, expected := range oneTimePreKeys {
+		bundle := getPreKeyBundle(t, router, other, user.id)
+		if bundle.OneTimePreKey == nil || *bundle.OneTimePreKey != expected {
+			t.Errorf("Expected one-time prekey %v, got %v", expected, bundle.OneTimePreKey)
+		}
+	}
+
+	// uploading the consumed keys again does not restore them
+	rr := uploadPreKeys(t, router, user, request)
+	var res models.PreKeyCount
+	json.NewDecoder(rr.Body).Decode(&res)
+	if rr.Code != http.StatusOK || res.Count != 0 {
+		t.Errorf("Expected no one-time prekeys, got %v %+v", rr.Code, res)
+	}
+	if bundle := getPreKeyBundle(t, router, other, user.id); bundle.OneTimePreKey != nil {
+		t.Errorf("Expected no one-time prekey, got %v", bundle.OneTimePreKey)
+	}
+}
@@ -1,49 +1,410 @@
 package api
 
 import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"log"
 	"net/http"
+	"strings"
+	"time"
 
+	"enigma-protocol-go/pkg/crypto"
 	"enigma-protocol-go/pkg/db"
 	"enigma-protocol-go/pkg/models"
+	"enigma-protocol-go/pkg/utils"
 
 	"github.com/julienschmidt/httprouter"
 )
 
+// messageRouter stores a message for the receiver and delivers it when it
+// is connected.
+type messageRouter interface {
+	route(ctx context.Context, message models.TransmissionData) (int64, error)
+}
+
+// disconnecter closes the connected sessions of a user.
+type disconnecter interface {
+	disconnect(user string, reason string)
+}
+
 type ProtocolAPI struct {
-	db *db.Database
+	db       db.Store
+	router   messageRouter
+	sessions disconnecter
+	tokens   *TokenAPI
+	userIDs  utils.IDFormat
 }
 
-func NewProtocolAPI(opts APIOpts) *ProtocolAPI {
-	return &ProtocolAPI{db: opts.Database}
+func NewProtocolAPI(opts APIOpts, router messageRouter, sessions disconnecter, tokens *TokenAPI) *ProtocolAPI {
+	return &ProtocolAPI{db: opts.Database, router: router, sessions: sessions, tokens: tokens, userIDs: opts.UserIDs}
 }
 
 func (p *ProtocolAPI) Register(r *httprouter.Router) {
+	r.POST("/users", inJSON(p.register))
+	r.DELETE("/users/:id", inJSON(p.deleteUser))
 	r.GET("/login/:publicKey", inJSON(p.login))
 	r.GET("/connect/:id", inJSON(p.connect))
+	r.POST("/users/:id/devices", inJSON(p.registerDevice))
+	r.POST("/users/:id/key", inJSON(p.rotateKey))
+	r.GET("/users/:id/keys", inJSON(p.keyHistory))
+	r.GET("/fingerprint/:idA/:idB", inJSON(p.fingerprint))
+}
+
+// register creates a user with the key in the body, which is validated and
+// stored as base64 SPKI DER, and starts its first session.
+func (p *ProtocolAPI) register(r *http.Request, _ httprouter.Params) (interface{}, *models.APIError) {
+	var req models.RegisterRequest
+	if _, apiErr := readBody(r, &req); apiErr != nil {
+		return nil, apiErr
+	}
+
+	publicKey, keyType, apiErr := registrationKey(req)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	id, err := p.db.SaveUser(publicKey, keyType)
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	tokens, err := p.tokens.issue(id)
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	return &models.RegisterResponse{User: id, PublicKey: publicKey, KeyType: keyType, Tokens: tokens}, nil
+}
+
+// registrationKey parses the key of req, given either as publicKey or as
+// jwk, and returns its normalized form and type.
+func registrationKey(req models.RegisterRequest) (string, string, *models.APIError) {
+	switch req.KeyType {
+	case "", utils.KeyTypeEd25519, utils.KeyTypeX25519, utils.KeyTypeP256:
+	default:
+		return "", "", invalidField(models.CodeUnsupportedKey, "keyType", "unknown key type "+req.KeyType)
+	}
+
+	field := "publicKey"
+	var pub interface{}
+	var err error
+	switch {
+	case req.PublicKey != "" && len(req.JWK) > 0:
+		return "", "", invalidField(models.CodeInvalidRequest, "jwk", "only one of publicKey and jwk can be set")
+	case len(req.JWK) > 0:
+		field = "jwk"
+		pub, err = utils.ParseJWK(req.JWK)
+	case req.PublicKey != "":
+		pub, err = utils.ParseKeyOfType(req.PublicKey, req.KeyType)
+	default:
+		return "", "", invalidField(models.CodeInvalidRequest, "publicKey", "publicKey or jwk is required")
+	}
+
+	if errors.Is(err, utils.ErrUnsupportedPublicKey) {
+		return "", "", invalidField(models.CodeUnsupportedKey, field, err.Error())
+	} else if err != nil {
+		return "", "", invalidField(models.CodeInvalidPublicKey, field, err.Error())
+	}
+
+	publicKey, keyType, err := utils.NormalizePublicKey(pub)
+	if err != nil {
+		return "", "", invalidField(models.CodeInvalidPublicKey, field, err.Error())
+	}
+	if req.KeyType != "" && req.KeyType != keyType {
+		return "", "", invalidField(models.CodeKeyTypeMismatch, "keyType", "the key is a "+keyType+" key")
+	}
+	// users authenticate by signing with their key
+	if keyType == utils.KeyTypeX25519 {
+		return "", "", invalidField(models.CodeUnsupportedKey, field, "x25519 keys cannot sign, use an ed25519 or p256 key")
+	}
+	return publicKey, keyType, nil
+}
+
+// signingKey parses publicKey, a key a user or device signs with, and
+// returns its normalized form and type.
+func signingKey(publicKey string) (string, string, *models.APIError) {
+	pub, err := utils.ParsePublicKey(publicKey)
+	if errors.Is(err, utils.ErrUnsupportedPublicKey) {
+		return "", "", badRequest(models.CodeUnsupportedKey, err.Error())
+	} else if err != nil {
+		return "", "", badRequest(models.CodeInvalidPublicKey, err.Error())
+	}
+
+	normalized, keyType, err := utils.NormalizePublicKey(pub)
+	if err != nil {
+		return "", "", badRequest(models.CodeInvalidPublicKey, err.Error())
+	}
+	return normalized, keyType, nil
 }
 
+// login creates a user with the key in the path, which is validated and
+// normalized like by register, and starts its first session.
+// Deprecated in favour of POST /users.
 func (p *ProtocolAPI) login(_ *http.Request, ps httprouter.Params) (interface{}, *models.APIError) {
-	publicKey := ps.ByName("publicKey")
+	publicKey, keyType, apiErr := registrationKey(models.RegisterRequest{PublicKey: ps.ByName("publicKey")})
+	if apiErr != nil {
+		return nil, apiErr
+	}
 
-	id, err := p.db.SaveUser(publicKey)
+	id, err := p.db.SaveUser(publicKey, keyType)
 	if err != nil {
 		return nil, &models.APIError{Code: http.StatusInternalServerError,
 			Message: models.ErrorMessage{Error: "Internal Server Error", Detail: err.Error()},
 		}
 	}
 
-	return &models.LoginResponse{User: id}, nil
+	tokens, err := p.tokens.issue(id)
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	return &models.LoginResponse{User: id, Tokens: tokens}, nil
 }
 
-func (p *ProtocolAPI) connect(_ *http.Request, ps httprouter.Params) (interface{}, *models.APIError) {
+// connect returns the keys of a user, given by id or by handle with a
+// leading @. The requester, which must send its access token, is told when
+// they change.
+func (p *ProtocolAPI) connect(r *http.Request, ps httprouter.Params) (interface{}, *models.APIError) {
 	id := ps.ByName("id")
+	if strings.HasPrefix(id, "@") {
+		var apiErr *models.APIError
+		id, apiErr = p.resolveHandle(id)
+		if apiErr != nil {
+			return nil, apiErr
+		}
+	} else {
+		id = p.userIDs.Normalize(id)
+	}
 
 	publicKey, err := p.db.GetPublicKey(id)
-	if err != nil {
+	if errors.Is(err, db.ErrNotFound) {
+		// ids are shared by hand, tell typos apart from unknown users
+		if p.userIDs.CheckID(id) != nil {
+			return nil, badRequest(models.CodeInvalidUserID, "the checksum of the id does not match, it is probably mistyped")
+		}
 		return nil, &models.APIError{Code: http.StatusNotFound,
 			Message: models.ErrorMessage{Error: "Not Found"},
 		}
+	} else if err != nil {
+		return nil, &models.APIError{Code: http.StatusInternalServerError,
+			Message: models.ErrorMessage{Error: "Internal Server Error", Detail: err.Error()},
+		}
+	}
+
+	keyType, err := p.db.GetKeyType(id)
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	handle, err := p.db.GetHandle(id)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return nil, internalError(err)
+	}
+
+	devices, err := p.db.GetDevices(id)
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	requester := p.userIDs.Normalize(r.URL.Query().Get("requester"))
+	if requester != "" && requester != id && p.db.IsUserExists(requester) {
+		if apiErr := p.tokens.authenticate(r, requester); apiErr != nil {
+			return nil, apiErr
+		}
+		err = p.db.AddKeyFetcher(id, requester)
+		if err != nil {
+			return nil, internalError(err)
+		}
+	}
+
+	return &models.ConnectResponse{User: id, Handle: handle, Publickey: publicKey, KeyType: keyType, Devices: devices}, nil
+}
+
+// resolveHandle returns the id of the user with handle.
+func (p *ProtocolAPI) resolveHandle(handle string) (string, *models.APIError) {
+	handle, err := utils.NormalizeHandle(handle)
+	if err != nil {
+		return "", badRequest(models.CodeInvalidHandle, err.Error())
+	}
+
+	id, err := p.db.GetHandleUser(handle)
+	if errors.Is(err, db.ErrNotFound) {
+		return "", notFound(models.CodeUserNotFound)
+	} else if err != nil {
+		return "", internalError(err)
+	}
+	return id, nil
+}
+
+// deleteUser removes the user with everything stored for it and closes its
+// sessions, the request must be signed with the key of the user.
+func (p *ProtocolAPI) deleteUser(r *http.Request, ps httprouter.Params) (interface{}, *models.APIError) {
+	id := p.userIDs.Normalize(ps.ByName("id"))
+
+	var req models.DeleteUserRequest
+	body, apiErr := readBody(r, &req)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	publicKey, apiErr := userPublicKey(p.db, id)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	if apiErr := verifySignedBody(r, p.db, publicKey, body); apiErr != nil {
+		return nil, apiErr
+	}
+
+	// a body signed for another request must not delete the user
+	if p.userIDs.Normalize(req.Delete) != id {
+		return nil, invalidField(models.CodeInvalidRequest, "delete", "must be the id of the user")
+	}
+
+	err := p.db.DeleteUser(id)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	p.sessions.disconnect(id, "user deleted")
+	log.Printf("Deleted user %s on request\n", id)
+
+	return &models.DeletionReceipt{User: id, DeletedAt: time.Now().UTC()}, nil
+}
+
+// registerDevice adds a device to the user, the request must be signed with
+// the key of the primary device.
+func (p *ProtocolAPI) registerDevice(r *http.Request, ps httprouter.Params) (interface{}, *models.APIError) {
+	id := p.userIDs.Normalize(ps.ByName("id"))
+
+	var req models.RegisterDeviceRequest
+	body, apiErr := readBody(r, &req)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	publicKey, apiErr := userPublicKey(p.db, id)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	if apiErr := verifySignedBody(r, p.db, publicKey, body); apiErr != nil {
+		return nil, apiErr
+	}
+
+	deviceKey, _, apiErr := signingKey(req.PublicKey)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	device, err := p.db.AddDevice(id, deviceKey)
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	return &models.DeviceResponse{User: id, Device: device}, nil
+}
+
+// rotateKey replaces the key of a user, the request must be signed with the
+// current key which proves the new key belongs to the same user. Everyone who
+// fetched the old key gets a key_changed event.
+func (p *ProtocolAPI) rotateKey(r *http.Request, ps httprouter.Params) (interface{}, *models.APIError) {
+	id := p.userIDs.Normalize(ps.ByName("id"))
+
+	var req models.RotateKeyRequest
+	body, apiErr := readBody(r, &req)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	publicKey, apiErr := userPublicKey(p.db, id)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	if apiErr := verifySignedBody(r, p.db, publicKey, body); apiErr != nil {
+		return nil, apiErr
+	}
+
+	newKey, keyType, apiErr := signingKey(req.PublicKey)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	err := p.db.UpdatePublicKey(id, newKey, keyType)
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	fetchers, err := p.db.GetKeyFetchers(id)
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	for _, fetcher := range fetchers {
+		_, err = p.router.route(r.Context(), models.TransmissionData{
+			Type:    models.FrameKeyChanged,
+			From:    id,
+			To:      fetcher,
+			Payload: newKey,
+		})
+		if err != nil {
+			log.Printf("Failed to send key change of %s to %s: %v\n", id, fetcher, err)
+		}
+	}
+
+	return p.keyHistory(r, ps)
+}
+
+func (p *ProtocolAPI) keyHistory(_ *http.Request, ps httprouter.Params) (interface{}, *models.APIError) {
+	id := p.userIDs.Normalize(ps.ByName("id"))
+
+	publicKey, apiErr := userPublicKey(p.db, id)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	previous, err := p.db.GetKeyHistory(id)
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	return &models.KeyHistory{User: id, PublicKey: publicKey, Previous: previous}, nil
+}
+
+// fingerprintKey returns the bytes of publicKey the safety number is derived
+// from, the DER encoding so the encoding the user registered with does not
+// matter. Keys which cannot be parsed are used as they are.
+func fingerprintKey(publicKey string) []byte {
+	pub, err := utils.ParseKeyOfType(publicKey, "")
+	if err != nil {
+		return []byte(publicKey)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return []byte(publicKey)
+	}
+	return der
+}
+
+// fingerprint returns the safety number of two users, which they compare out
+// of band to verify each other's keys.
+func (p *ProtocolAPI) fingerprint(_ *http.Request, ps httprouter.Params) (interface{}, *models.APIError) {
+	idA, idB := p.userIDs.Normalize(ps.ByName("idA")), p.userIDs.Normalize(ps.ByName("idB"))
+
+	keyA, apiErr := userPublicKey(p.db, idA)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	keyB, apiErr := userPublicKey(p.db, idB)
+	if apiErr != nil {
+		return nil, apiErr
 	}
 
-	return &models.ConnectResponse{User: id, Publickey: publicKey}, nil
+	return &models.SafetyNumber{
+		Users:        []string{idA, idB},
+		SafetyNumber: crypto.SafetyNumber(idA, fingerprintKey(keyA), idB, fingerprintKey(keyB)),
+	}, nil
 }
@@ -1,22 +1,56 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"enigma-protocol-go/pkg/db"
 	"enigma-protocol-go/pkg/models"
+	"enigma-protocol-go/pkg/utils"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
 )
 
 const DATABSE_PATH = "test.db"
 
+// testDir holds the database of the current test, servers from previous
+// tests may still be writing to theirs while it is being removed.
+var testDir string
+
 func setup() http.Handler {
+	return setupWith(func(opts *APIOpts) {})
+}
+
+// setupWith is setup with opts changed by configure before the router is
+// created.
+func setupWith(configure func(opts *APIOpts)) http.Handler {
+	var err error
+	testDir, err = os.MkdirTemp("", "enigma-test")
+	if err != nil {
+		panic(err)
+	}
+
 	opts, err := NewAPIOpts(
 		&db.DatabaseOpts{
 			Driver: "sqlite3",
-			Uri:    DATABSE_PATH,
+			Uri:    filepath.Join(testDir, DATABSE_PATH),
 		},
 		nil,
 	)
@@ -24,12 +58,41 @@ func setup() http.Handler {
 		panic(err)
 	}
 
+	configure(opts)
+
 	router := opts.NewRouter()
 	return router
 }
 
 func cleanup() {
-	os.Remove(DATABSE_PATH)
+	os.RemoveAll(testDir)
+}
+
+// signedRequest creates a request with body signed by privateKey.
+// The method, path and a random nonce are added to the body unless it sets
+// them.
+func signedRequest(t *testing.T, method string, url string, body interface{}, privateKey ed25519.PrivateKey) *http.Request {
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	nonce, _ := utils.RandomHex(16)
+	path, _, _ := strings.Cut(url, "?")
+	for field, value := range map[string]string{"method": method, "path": path, "nonce": nonce} {
+		if fields[field] == nil || fields[field] == "" {
+			fields[field] = value
+		}
+	}
+	data, _ = json.Marshal(fields)
+
+	req, _ := http.NewRequest(method, url, bytes.NewReader(data))
+	req.Header.Set(signatureHeader, base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, data)))
+	return req
 }
 
 func TestIndexAPI(t *testing.T) {
@@ -49,11 +112,17 @@ func TestNewUser(t *testing.T) {
 	router := setup()
 	defer cleanup()
 
+	edPublicKey, _, _ := ed25519.GenerateKey(nil)
+	edDER, _ := x509.MarshalPKIXPublicKey(edPublicKey)
+
 	tests := []struct {
 		name      string
 		publicKey string
+		status    int
+		key       []byte
 	}{
-		{"test1", "random-public-key"},
+		{"raw ed25519", base64.RawURLEncoding.EncodeToString(edPublicKey), http.StatusOK, edDER},
+		{"invalid key", "random-public-key", http.StatusBadRequest, nil},
 	}
 
 	for _, tt := range tests {
@@ -63,8 +132,11 @@ func TestNewUser(t *testing.T) {
 
 			router.ServeHTTP(rr, req)
 
-			if status := rr.Code; status != http.StatusOK {
-				t.Errorf("Expected status %v, but got %v", http.StatusOK, status)
+			if status := rr.Code; status != tt.status {
+				t.Fatalf("Expected status %v, but got %v", tt.status, status)
+			}
+			if tt.status != http.StatusOK {
+				return
 			}
 
 			var res models.LoginResponse
@@ -86,8 +158,92 @@ func TestNewUser(t *testing.T) {
 				t.Fatalf("Expected no error, got %v", err)
 			}
 
-			if res2.Publickey != tt.publicKey {
-				t.Errorf("Expected public key %v, but got %v", tt.publicKey, res2.Publickey)
+			// the key is stored normalized, like by POST /users
+			if publicKey := base64.StdEncoding.EncodeToString(tt.key); res2.Publickey != publicKey {
+				t.Errorf("Expected public key %v, but got %v", publicKey, res2.Publickey)
+			}
+		})
+	}
+}
+
+func TestRegister(t *testing.T) {
+	router := setup()
+	defer cleanup()
+
+	edPublicKey, _, _ := ed25519.GenerateKey(nil)
+	edDER, _ := x509.MarshalPKIXPublicKey(edPublicKey)
+	ecPrivateKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecDER, _ := x509.MarshalPKIXPublicKey(&ecPrivateKey.PublicKey)
+	xPrivateKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	xDER, _ := x509.MarshalPKIXPublicKey(xPrivateKey.PublicKey())
+	rsaPrivateKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	rsaDER, _ := x509.MarshalPKIXPublicKey(&rsaPrivateKey.PublicKey)
+
+	pemKey := func(der []byte) string {
+		return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	}
+	b64url := base64.RawURLEncoding.EncodeToString
+
+	tests := []struct {
+		name    string
+		request models.RegisterRequest
+		status  int
+		keyType string
+		key     []byte
+		code    string
+		field   string
+	}{
+		{"raw ed25519", models.RegisterRequest{PublicKey: base64.StdEncoding.EncodeToString(edPublicKey)}, http.StatusOK, "ed25519", edDER, "", ""},
+		{"pem p256", models.RegisterRequest{PublicKey: pemKey(ecDER)}, http.StatusOK, "p256", ecDER, "", ""},
+		{"raw x25519", models.RegisterRequest{PublicKey: b64url(xPrivateKey.PublicKey().Bytes()), KeyType: "x25519"}, http.StatusBadRequest, "", nil, models.CodeUnsupportedKey, "publicKey"},
+		{"jwk ed25519", models.RegisterRequest{JWK: json.RawMessage(`{"kty":"OKP","crv":"Ed25519","x":"` + b64url(edPublicKey) + `"}`)}, http.StatusOK, "ed25519", edDER, "", ""},
+		{"jwk x25519", models.RegisterRequest{JWK: json.RawMessage(`{"kty":"OKP","crv":"X25519","x":"` + b64url(xPrivateKey.PublicKey().Bytes()) + `"}`)}, http.StatusBadRequest, "", nil, models.CodeUnsupportedKey, "jwk"},
+		{"pem x25519", models.RegisterRequest{PublicKey: pemKey(xDER)}, http.StatusBadRequest, "", nil, models.CodeUnsupportedKey, "publicKey"},
+		{"jwk p256", models.RegisterRequest{JWK: json.RawMessage(`{"kty":"EC","crv":"P-256","x":"` + b64url(ecPrivateKey.X.FillBytes(make([]byte, 32))) + `","y":"` + b64url(ecPrivateKey.Y.FillBytes(make([]byte, 32))) + `"}`)}, http.StatusOK, "p256", ecDER, "", ""},
+		{"jwk off curve", models.RegisterRequest{JWK: json.RawMessage(`{"kty":"EC","crv":"P-256","x":"` + b64url(make([]byte, 32)) + `","y":"` + b64url(make([]byte, 32)) + `"}`)}, http.StatusBadRequest, "", nil, models.CodeInvalidPublicKey, "jwk"},
+		{"invalid key", models.RegisterRequest{PublicKey: "random-public-key"}, http.StatusBadRequest, "", nil, models.CodeInvalidPublicKey, "publicKey"},
+		{"rsa", models.RegisterRequest{PublicKey: pemKey(rsaDER)}, http.StatusBadRequest, "", nil, models.CodeUnsupportedKey, "publicKey"},
+		{"unknown key type", models.RegisterRequest{PublicKey: pemKey(edDER), KeyType: "rsa"}, http.StatusBadRequest, "", nil, models.CodeUnsupportedKey, "keyType"},
+		{"key type mismatch", models.RegisterRequest{PublicKey: pemKey(edDER), KeyType: "p256"}, http.StatusBadRequest, "", nil, models.CodeKeyTypeMismatch, "keyType"},
+		{"missing key", models.RegisterRequest{}, http.StatusBadRequest, "", nil, models.CodeInvalidRequest, "publicKey"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(tt.request)
+			req, _ := http.NewRequest("POST", "/users", bytes.NewReader(body))
+			rr := httptest.NewRecorder()
+
+			router.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tt.status {
+				t.Fatalf("Expected status %v, but got %v: %s", tt.status, status, rr.Body)
+			}
+
+			if tt.status != http.StatusOK {
+				var res models.ErrorMessage
+				json.NewDecoder(rr.Body).Decode(&res)
+				if res.Code != tt.code || res.Field != tt.field {
+					t.Errorf("Expected code %s for %s, got %s for %s", tt.code, tt.field, res.Code, res.Field)
+				}
+				return
+			}
+
+			var res models.RegisterResponse
+			if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if res.KeyType != tt.keyType || res.PublicKey != base64.StdEncoding.EncodeToString(tt.key) {
+				t.Errorf("Expected %s key %x, got %s key %s", tt.keyType, tt.key, res.KeyType, res.PublicKey)
+			}
+			if res.AccessToken == "" || res.RefreshToken == "" {
+				t.Errorf("Expected session tokens, got %+v", res.Tokens)
+			}
+
+			var connected models.ConnectResponse
+			getJSON(t, router, "/connect/"+res.User, &connected)
+			if connected.Publickey != res.PublicKey || connected.KeyType != tt.keyType {
+				t.Errorf("Expected %s key %s, got %s key %s", tt.keyType, res.PublicKey, connected.KeyType, connected.Publickey)
 			}
 		})
 	}
@@ -107,3 +263,364 @@ func TestNotFound(t *testing.T) {
 		t.Errorf("Expected status %v, but got %v", http.StatusNotFound, status)
 	}
 }
+
+func TestRegisterDevice(t *testing.T) {
+	router := setup()
+	defer cleanup()
+
+	user := createUser(t, router)
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	devicePublicKey, _, _ := ed25519.GenerateKey(nil)
+	deviceKey := base64.StdEncoding.EncodeToString(devicePublicKey)
+	deviceDER, _ := x509.MarshalPKIXPublicKey(devicePublicKey)
+	xPrivateKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	xDER, _ := x509.MarshalPKIXPublicKey(xPrivateKey.PublicKey())
+
+	tests := []struct {
+		name       string
+		request    models.RegisterDeviceRequest
+		privateKey ed25519.PrivateKey
+		status     int
+		code       string
+	}{
+		{"valid", models.RegisterDeviceRequest{
+			SignedRequest: models.SignedRequest{Timestamp: time.Now().Unix()},
+			PublicKey:     deviceKey,
+		}, user.privateKey, http.StatusOK, ""},
+		{"wrong key", models.RegisterDeviceRequest{
+			SignedRequest: models.SignedRequest{Timestamp: time.Now().Unix()},
+			PublicKey:     deviceKey,
+		}, otherKey, http.StatusUnauthorized, models.CodeInvalidSignature},
+		{"expired", models.RegisterDeviceRequest{
+			SignedRequest: models.SignedRequest{Timestamp: time.Now().Add(-time.Hour).Unix()},
+			PublicKey:     deviceKey,
+		}, user.privateKey, http.StatusUnauthorized, models.CodeExpiredRequest},
+		{"invalid public key", models.RegisterDeviceRequest{
+			SignedRequest: models.SignedRequest{Timestamp: time.Now().Unix()},
+			PublicKey:     "random-public-key",
+		}, user.privateKey, http.StatusBadRequest, models.CodeInvalidPublicKey},
+		{"x25519", models.RegisterDeviceRequest{
+			SignedRequest: models.SignedRequest{Timestamp: time.Now().Unix()},
+			PublicKey:     base64.StdEncoding.EncodeToString(xDER),
+		}, user.privateKey, http.StatusBadRequest, models.CodeUnsupportedKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := signedRequest(t, "POST", "/users/"+user.id+"/devices", tt.request, tt.privateKey)
+			rr := httptest.NewRecorder()
+
+			router.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tt.status {
+				t.Errorf("Expected status %v, but got %v", tt.status, status)
+			}
+
+			if tt.code != "" {
+				var res models.ErrorMessage
+				json.NewDecoder(rr.Body).Decode(&res)
+				if res.Code != tt.code {
+					t.Errorf("Expected code %v, but got %v", tt.code, res.Code)
+				}
+			}
+		})
+	}
+
+	req, _ := http.NewRequest("GET", "/connect/"+user.id, nil)
+	rr := httptest.NewRecorder()
+
+	router.ServeHTTP(rr, req)
+
+	var res models.ConnectResponse
+	if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// the key is stored as SPKI DER
+	if len(res.Devices) != 2 || res.Devices[0].ID != models.PrimaryDevice || res.Devices[1].PublicKey != base64.StdEncoding.EncodeToString(deviceDER) {
+		t.Errorf("Expected the primary and the new device, got %v", res.Devices)
+	}
+}
+
+func rotateKey(t *testing.T, router http.Handler, user testUser, publicKey ed25519.PublicKey) *httptest.ResponseRecorder {
+	req := signedRequest(t, "POST", "/users/"+user.id+"/key", models.RotateKeyRequest{
+		SignedRequest: models.SignedRequest{Timestamp: time.Now().Unix()},
+		PublicKey:     base64.StdEncoding.EncodeToString(publicKey),
+	}, user.privateKey)
+	rr := httptest.NewRecorder()
+
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestRotateKey(t *testing.T) {
+	router := setup()
+	defer cleanup()
+
+	user1 := createUser(t, router)
+	user2 := createUser(t, router)
+	newPublicKey, newPrivateKey, _ := ed25519.GenerateKey(nil)
+
+	// only the requester itself can ask to be told about key changes
+	req, _ := http.NewRequest("GET", "/connect/"+user1.id+"?requester="+user2.id, nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("Expected status %v, but got %v", http.StatusUnauthorized, status)
+	}
+
+	req, _ = http.NewRequest("GET", "/connect/"+user1.id+"?requester="+user2.id, nil)
+	req.Header.Set("Authorization", "Bearer "+user2.token)
+	rr = httptest.NewRecorder()
+
+	router.ServeHTTP(rr, req)
+
+	var connected models.ConnectResponse
+	if err := json.NewDecoder(rr.Body).Decode(&connected); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	s := httptest.NewServer(router)
+	wsEndpoint := "ws" + s.URL[4:] + "/ws/"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	c2 := dialUser(t, ctx, wsEndpoint, user2)
+
+	// only the current key can rotate
+	rr = rotateKey(t, router, testUser{id: user1.id, privateKey: newPrivateKey}, newPublicKey)
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("Expected status %v, but got %v", http.StatusUnauthorized, status)
+	}
+
+	rr = rotateKey(t, router, user1, newPublicKey)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Expected status %v, but got %v", http.StatusOK, status)
+	}
+
+	var history models.KeyHistory
+	if err := json.NewDecoder(rr.Body).Decode(&history); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	newDER, _ := x509.MarshalPKIXPublicKey(newPublicKey)
+	newKey := base64.StdEncoding.EncodeToString(newDER)
+	if history.PublicKey != newKey || len(history.Previous) != 1 || history.Previous[0].PublicKey != connected.Publickey {
+		t.Errorf("Expected %s replacing %s, got %v", newKey, connected.Publickey, history)
+	}
+
+	var changed models.TransmissionData
+	json.Unmarshal(readFrame(t, ctx, c2, models.FrameKeyChanged), &changed)
+	if changed.From != user1.id || changed.Payload != newKey {
+		t.Errorf("Expected key change of %s to %s, got %v", user1.id, newKey, changed)
+	}
+
+	// the old key is not accepted anymore
+	rr = rotateKey(t, router, user1, newPublicKey)
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("Expected status %v, but got %v", http.StatusUnauthorized, status)
+	}
+	c1 := dialUser(t, ctx, wsEndpoint, testUser{id: user1.id, device: models.PrimaryDevice, privateKey: newPrivateKey, token: user1.token})
+	c1.Close(websocket.StatusNormalClosure, "")
+}
+
+func TestRotateKeyReplayedDevice(t *testing.T) {
+	router := setup()
+	defer cleanup()
+
+	user := createUser(t, router)
+	devicePublicKey, _, _ := ed25519.GenerateKey(nil)
+
+	// a device registration has the same fields as a key rotation
+	req := signedRequest(t, "POST", "/users/"+user.id+"/devices", models.RegisterDeviceRequest{
+		SignedRequest: models.SignedRequest{Timestamp: time.Now().Unix()},
+		PublicKey:     base64.StdEncoding.EncodeToString(devicePublicKey),
+	}, user.privateKey)
+	body, _ := io.ReadAll(req.Body)
+
+	rr := resend(router, req, body, "POST", "/users/"+user.id+"/key")
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("Expected status %v, but got %v", http.StatusUnauthorized, status)
+	}
+
+	req, _ = http.NewRequest("GET", "/users/"+user.id+"/keys", nil)
+	rr = httptest.NewRecorder()
+
+	router.ServeHTTP(rr, req)
+
+	var history models.KeyHistory
+	json.NewDecoder(rr.Body).Decode(&history)
+	if len(history.Previous) != 0 || history.PublicKey == base64.StdEncoding.EncodeToString(devicePublicKey) {
+		t.Errorf("Expected the key to be kept, got %v", history)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	router := setup()
+	defer cleanup()
+
+	user1 := createUser(t, router)
+	user2 := createUser(t, router)
+
+	var number models.SafetyNumber
+	if status := getJSON(t, router, "/fingerprint/"+user1.id+"/"+user2.id, &number); status != http.StatusOK {
+		t.Fatalf("Expected status %v, but got %v", http.StatusOK, status)
+	}
+
+	var reversed models.SafetyNumber
+	getJSON(t, router, "/fingerprint/"+user2.id+"/"+user1.id, &reversed)
+	if number.SafetyNumber == "" || reversed.SafetyNumber != number.SafetyNumber {
+		t.Errorf("Expected the same safety number in both orders, got %q and %q", number.SafetyNumber, reversed.SafetyNumber)
+	}
+
+	newPublicKey, _, _ := ed25519.GenerateKey(nil)
+	rotateKey(t, router, user1, newPublicKey)
+
+	getJSON(t, router, "/fingerprint/"+user1.id+"/"+user2.id, &reversed)
+	if reversed.SafetyNumber == number.SafetyNumber {
+		t.Errorf("Expected the safety number to change with the key, got %q", reversed.SafetyNumber)
+	}
+
+	if status := getJSON(t, router, "/fingerprint/"+user1.id+"/random-user", &number); status != http.StatusNotFound {
+		t.Errorf("Expected status %v, but got %v", http.StatusNotFound, status)
+	}
+}
+
+func deleteUser(t *testing.T, router http.Handler, user testUser, request models.DeleteUserRequest) *httptest.ResponseRecorder {
+	request.Timestamp = time.Now().Unix()
+	req := signedRequest(t, "DELETE", "/users/"+user.id, request, user.privateKey)
+	rr := httptest.NewRecorder()
+
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestDeleteUser(t *testing.T) {
+	router := setup()
+	defer cleanup()
+
+	user1 := createUser(t, router)
+	user2 := createUser(t, router)
+
+	s := httptest.NewServer(router)
+	defer s.Close()
+	wsEndpoint := "ws" + s.URL[4:] + "/ws/"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	c1 := dialUser(t, ctx, wsEndpoint, user1)
+
+	// only the user can delete itself
+	rr := deleteUser(t, router, testUser{id: user1.id, privateKey: user2.privateKey}, models.DeleteUserRequest{Delete: user1.id})
+	if status := rr.Code; status != http.StatusUnauthorized {
+		t.Errorf("Expected status %v, but got %v", http.StatusUnauthorized, status)
+	}
+	rr = deleteUser(t, router, user1, models.DeleteUserRequest{Delete: user2.id})
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("Expected status %v, but got %v", http.StatusBadRequest, status)
+	}
+
+	rr = deleteUser(t, router, user1, models.DeleteUserRequest{Delete: user1.id})
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Expected status %v, but got %v", http.StatusOK, status)
+	}
+
+	var receipt models.DeletionReceipt
+	if err := json.NewDecoder(rr.Body).Decode(&receipt); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if receipt.User != user1.id || receipt.DeletedAt.IsZero() {
+		t.Errorf("Expected a receipt for %s, got %v", user1.id, receipt)
+	}
+
+	// the session is closed
+	if _, _, err := c1.Read(ctx); websocket.CloseStatus(err) != websocket.StatusNormalClosure {
+		t.Errorf("Expected the connection to be closed, got %v", err)
+	}
+
+	var connected models.ConnectResponse
+	if status := getJSON(t, router, "/connect/"+user1.id, &connected); status != http.StatusNotFound {
+		t.Errorf("Expected status %v, but got %v", http.StatusNotFound, status)
+	}
+	rr = deleteUser(t, router, user1, models.DeleteUserRequest{Delete: user1.id})
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("Expected status %v, but got %v", http.StatusNotFound, status)
+	}
+}
+
+func TestUserIDChecksum(t *testing.T) {
+	format := utils.IDFormat{Alphabet: utils.IDAlphabetWords, Checksum: true}
+	opts, err := NewAPIOpts(&db.DatabaseOpts{Driver: "memory", UserIDs: format}, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	router := opts.NewRouter()
+
+	user := createUser(t, router)
+	if err := format.CheckID(user.id); err != nil || strings.Count(user.id, "-") != 5 {
+		t.Fatalf("Expected an id of 5 words and a check word, got %s", user.id)
+	}
+
+	words := strings.Split(user.id, "-")
+	if words[0] == "apple" {
+		words[0] = "acorn"
+	} else {
+		words[0] = "apple"
+	}
+	var connected models.ConnectResponse
+	if status := getJSON(t, router, "/connect/"+strings.Join(words, "-"), &connected); status != http.StatusBadRequest {
+		t.Errorf("Expected status %v for a mistyped id, but got %v", http.StatusBadRequest, status)
+	}
+
+	unknown, _ := format.NewID()
+	if status := getJSON(t, router, "/connect/"+unknown, &connected); status != http.StatusNotFound {
+		t.Errorf("Expected status %v for an unknown id, but got %v", http.StatusNotFound, status)
+	}
+}
+
+func TestUserIDNormalized(t *testing.T) {
+	format := utils.IDFormat{Alphabet: utils.IDAlphabetCrockford, Checksum: true}
+	opts, err := NewAPIOpts(&db.DatabaseOpts{Driver: "memory", UserIDs: format}, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	router := opts.NewRouter()
+
+	user1 := createUser(t, router)
+	user2 := createUser(t, router)
+
+	// ids read out or typed by hand in upper case and with lookalike letters
+	typed := func(id string) string {
+		return strings.NewReplacer("1", "L", "0", "O").Replace(strings.ToUpper(id))
+	}
+
+	var connected models.ConnectResponse
+	if status := getJSON(t, router, "/connect/"+typed(user2.id), &connected); status != http.StatusOK || connected.User != user2.id {
+		t.Errorf("Expected user %s, got %v %+v", user2.id, status, connected)
+	}
+
+	var number, typedNumber models.SafetyNumber
+	getJSON(t, router, "/fingerprint/"+user1.id+"/"+user2.id, &number)
+	getJSON(t, router, "/fingerprint/"+typed(user1.id)+"/"+typed(user2.id), &typedNumber)
+	if typedNumber.SafetyNumber != number.SafetyNumber {
+		t.Errorf("Expected safety number %s, got %s", number.SafetyNumber, typedNumber.SafetyNumber)
+	}
+
+	s := httptest.NewServer(router)
+	defer s.Close()
+	wsEndpoint := "ws" + s.URL[4:] + "/ws/"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	c1 := dialUser(t, ctx, wsEndpoint, user1)
+	defer c1.Close(websocket.StatusNormalClosure, "")
+	c2 := dialUser(t, ctx, wsEndpoint, user2)
+	defer c2.Close(websocket.StatusNormalClosure, "")
+
+	sendMessage(t, ctx, c1, models.TransmissionData{To: typed(user2.id), Payload: "Hello"})
+	if message := readMessage(t, ctx, c2); message.From != user1.id || message.Payload != "Hello" {
+		t.Errorf("Expected the message of %s, got %+v", user1.id, message)
+	}
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"enigma-protocol-go/pkg/db"
+	"enigma-protocol-go/pkg/models"
+
+	"github.com/julienschmidt/httprouter"
+	"nhooyr.io/websocket"
+)
+
+const (
+	// reconnectDelay is the least time clients are asked to wait before
+	// reconnecting after a shutdown, reconnectJitter spreads the reconnects
+	// so the next server is not hit by every client at once.
+	reconnectDelay  = time.Second
+	reconnectJitter = 10 * time.Second
+)
+
+// Server is the handler of the API.
+type Server struct {
+	http.Handler
+	db         db.Store
+	websockets *WebsocketAPI
+	// opts configure the sweeper
+	opts APIOpts
+}
+
+// Shutdown ends every websocket session and closes the database. New
+// connections must not reach the handler anymore, like after
+// http.Server.Shutdown. It returns when every session ended or ctx is done,
+// the database is closed either way.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.websockets.shutdown(ctx)
+	return errors.Join(err, s.db.Close())
+}
+
+// track refuses websocket connections once shutdown started and counts the
+// running handlers, so shutdown can wait for them.
+func (w *WebsocketAPI) track(handle httprouter.Handle) httprouter.Handle {
+	return func(wr http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		w.mu.Lock()
+		if w.closing {
+			w.mu.Unlock()
+			http.Error(wr, "Server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		w.handlers.Add(1)
+		w.mu.Unlock()
+		defer w.handlers.Done()
+
+		handle(wr, r, ps)
+	}
+}
+
+// shutdown tells every session that the server is going away, writes the
+// frames queued for it and closes it with StatusGoingAway. Stored messages
+// which could not be written stay pending, they are delivered when the
+// client reconnects. Sessions which did not authenticate yet are dropped.
+func (w *WebsocketAPI) shutdown(ctx context.Context) error {
+	w.mu.Lock()
+	w.closing = true
+	var chats []*Chat
+	for _, sessions := range w.chats {
+		chats = append(chats, sessions...)
+	}
+	w.mu.Unlock()
+
+	timeout := w.stallTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+
+	var wg sync.WaitGroup
+	for _, chat := range chats {
+		wg.Add(1)
+		go func(chat *Chat) {
+			defer wg.Done()
+
+			chat.sendJSON(ctx, models.GoingAway{
+				Type:           models.FrameGoingAway,
+				ReconnectAfter: reconnectAfter().Milliseconds(),
+			})
+			chat.flush(timeout)
+			chat.connection.Close(websocket.StatusGoingAway, "server shutting down")
+		}(chat)
+	}
+	wg.Wait()
+	w.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		w.handlers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func reconnectAfter() time.Duration {
+	return reconnectDelay + time.Duration(rand.Int63n(int64(reconnectJitter)))
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"enigma-protocol-go/pkg/models"
+
+	"nhooyr.io/websocket"
+)
+
+func TestShutdown(t *testing.T) {
+	router := setup()
+	defer cleanup()
+
+	user1 := createUser(t, router)
+	user2 := createUser(t, router)
+
+	s := httptest.NewServer(router)
+	defer s.Close()
+	wsEndpoint := "ws" + s.URL[4:] + "/ws/"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	c1 := dialUser(t, ctx, wsEndpoint, user1)
+	defer c1.Close(websocket.StatusNormalClosure, "")
+	c2 := dialUser(t, ctx, wsEndpoint, user2)
+	defer c2.Close(websocket.StatusNormalClosure, "")
+
+	// the sessions are read while shutting down, so their close handshake
+	// completes
+	frames := make(chan []models.Frame, 2)
+	closed := make(chan websocket.StatusCode, 2)
+	for _, c := range []*websocket.Conn{c1, c2} {
+		go func(c *websocket.Conn) {
+			var read []models.Frame
+			for {
+				_, msg, err := c.Read(ctx)
+				if err != nil {
+					frames <- read
+					closed <- websocket.CloseStatus(err)
+					return
+				}
+				var frame models.Frame
+				json.Unmarshal(msg, &frame)
+				read = append(read, frame)
+
+				if frame.Type == models.FrameGoingAway {
+					var goingAway models.GoingAway
+					json.Unmarshal(msg, &goingAway)
+					if goingAway.ReconnectAfter < reconnectDelay.Milliseconds() {
+						t.Errorf("Expected a reconnect hint of at least %v, got %dms", reconnectDelay, goingAway.ReconnectAfter)
+					}
+				}
+			}
+		}(c)
+	}
+
+	if err := router.(*Server).Shutdown(ctx); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		read := <-frames
+		if len(read) == 0 || read[len(read)-1].Type != models.FrameGoingAway {
+			t.Errorf("Expected the last frame to be %s, got %v", models.FrameGoingAway, read)
+		}
+		if status := <-closed; status != websocket.StatusGoingAway {
+			t.Errorf("Expected close status %v, got %v", websocket.StatusGoingAway, status)
+		}
+	}
+
+	// new connections are refused
+	_, res, err := websocket.Dial(ctx, wsEndpoint+user1.id, &websocket.DialOptions{
+		HTTPHeader: http.Header{"Authorization": []string{"Bearer " + user1.token}},
+	})
+	if err == nil {
+		t.Fatalf("Expected the connection to be refused")
+	}
+	if res == nil || res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %v, got %v", http.StatusServiceUnavailable, res)
+	}
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"log"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// Session policies decide what happens when a device connects while it is
+// connected already.
+const (
+	// SessionPolicyReject refuses the new connection.
+	SessionPolicyReject = "reject"
+	// SessionPolicyReplace closes the old connection with
+	// StatusSessionReplaced, the new one takes over.
+	SessionPolicyReplace = "replace"
+	// SessionPolicyCoexist keeps both connections, each gets the frames of
+	// the device.
+	SessionPolicyCoexist = "coexist"
+)
+
+// StatusSessionReplaced closes a connection taken over by a new connection
+// of the same device.
+const StatusSessionReplaced websocket.StatusCode = 4001
+
+// Types of the session events.
+const (
+	SessionRejected   = "session_rejected"
+	SessionReplaced   = "session_replaced"
+	SessionCoexisting = "session_coexisting"
+)
+
+// SessionEvent is emitted when a device connects while it is connected
+// already, Type tells what the session policy did about it.
+type SessionEvent struct {
+	Type   string    `json:"type"`
+	User   string    `json:"user"`
+	Device string    `json:"device"`
+	Policy string    `json:"policy"`
+	Time   time.Time `json:"time"`
+}
+
+// emit logs event and passes it to the session event handler.
+func (w *WebsocketAPI) emit(eventType string, chat *Chat) {
+	event := SessionEvent{
+		Type:   eventType,
+		User:   chat.user,
+		Device: chat.device,
+		Policy: w.sessionPolicy,
+		Time:   time.Now().UTC(),
+	}
+
+	log.Printf("event=%s user=%s device=%s policy=%s\n", event.Type, event.User, event.Device, event.Policy)
+	if w.sessionEvents != nil {
+		w.sessionEvents(event)
+	}
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"enigma-protocol-go/pkg/models"
+
+	"nhooyr.io/websocket"
+)
+
+func TestSessionPolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		event  string
+	}{
+		{SessionPolicyReject, SessionRejected},
+		{SessionPolicyReplace, SessionReplaced},
+		{SessionPolicyCoexist, SessionCoexisting},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			events := make(chan SessionEvent, 10)
+			router := setupWith(func(opts *APIOpts) {
+				opts.SessionPolicy = tt.policy
+				opts.SessionEvents = func(event SessionEvent) { events <- event }
+			})
+			defer cleanup()
+
+			user1 := createUser(t, router)
+
+			s := httptest.NewServer(router)
+			wsEndpoint := "ws" + s.URL[4:] + "/ws/"
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+
+			c1 := dialUser(t, ctx, wsEndpoint, user1)
+			defer c1.Close(websocket.StatusNormalClosure, "")
+
+			switch tt.policy {
+			case SessionPolicyReject:
+				c2 := dial(t, ctx, wsEndpoint+user1.id, user1.token)
+				answerChallenge(t, ctx, c2, func(nonce []byte) []byte {
+					return ed25519.Sign(user1.privateKey, nonce)
+				})
+				if error := readError(t, ctx, c2); error.Code != models.CodeDeviceConnected {
+					t.Errorf("Expected %v, got %v", models.CodeDeviceConnected, error.Code)
+				}
+
+				// the first session is untouched
+				sendMessage(t, ctx, c1, models.TransmissionData{To: user1.id, Payload: "Hello Myself"})
+				if message := readMessage(t, ctx, c1); message.Payload != "Hello Myself" {
+					t.Errorf("Expected Hello Myself, got %s", message.Payload)
+				}
+
+			case SessionPolicyReplace:
+				c2 := dialUser(t, ctx, wsEndpoint, user1)
+				defer c2.Close(websocket.StatusNormalClosure, "")
+
+				for {
+					_, _, err := c1.Read(ctx)
+					if err != nil {
+						if status := websocket.CloseStatus(err); status != StatusSessionReplaced {
+							t.Errorf("Expected close status %v, got %v", StatusSessionReplaced, err)
+						}
+						break
+					}
+				}
+
+				sendMessage(t, ctx, c2, models.TransmissionData{To: user1.id, Payload: "Hello Myself"})
+				if message := readMessage(t, ctx, c2); message.Payload != "Hello Myself" {
+					t.Errorf("Expected Hello Myself, got %s", message.Payload)
+				}
+
+			case SessionPolicyCoexist:
+				c2 := dialUser(t, ctx, wsEndpoint, user1)
+				defer c2.Close(websocket.StatusNormalClosure, "")
+
+				// both sessions get the frames of the device
+				sendMessage(t, ctx, c2, models.TransmissionData{To: user1.id, Payload: "Hello Myself"})
+				for _, c := range []*websocket.Conn{c1, c2} {
+					if message := readMessage(t, ctx, c); message.Payload != "Hello Myself" {
+						t.Errorf("Expected Hello Myself, got %s", message.Payload)
+					}
+				}
+			}
+
+			select {
+			case event := <-events:
+				if event.Type != tt.event || event.User != user1.id || event.Device != models.PrimaryDevice || event.Policy != tt.policy {
+					t.Errorf("Expected a %s event for %s, got %+v", tt.event, user1.id, event)
+				}
+			case <-ctx.Done():
+				t.Fatalf("Expected a %s event", tt.event)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"enigma-protocol-go/pkg/db"
+	"enigma-protocol-go/pkg/models"
+	"enigma-protocol-go/pkg/utils"
+)
+
+const (
+	// signatureHeader carries the base64 signature of the request body made
+	// with the private key of the user.
+	signatureHeader = "X-Signature"
+	// signatureMaxAge limits how long a signed request can be replayed.
+	signatureMaxAge = 5 * time.Minute
+	// maxBodySize limits the size of request bodies.
+	maxBodySize = 1 << 16
+	// minNonceSize and maxNonceSize limit the length of the nonce of signed
+	// requests, it must be random enough not to collide.
+	minNonceSize = 16
+	maxNonceSize = 128
+)
+
+func badRequest(code string, detail string) *models.APIError {
+	return &models.APIError{Code: http.StatusBadRequest,
+		Message: models.ErrorMessage{Error: "Bad Request", Code: code, Detail: detail},
+	}
+}
+
+// invalidField is a bad request caused by the request body member field.
+func invalidField(code string, field string, detail string) *models.APIError {
+	apiErr := badRequest(code, detail)
+	apiErr.Message.Field = field
+	return apiErr
+}
+
+func unauthorized(code string, detail string) *models.APIError {
+	return &models.APIError{Code: http.StatusUnauthorized,
+		Message: models.ErrorMessage{Error: "Unauthorized", Code: code, Detail: detail},
+	}
+}
+
+func notFound(code string) *models.APIError {
+	return &models.APIError{Code: http.StatusNotFound,
+		Message: models.ErrorMessage{Error: "Not Found", Code: code},
+	}
+}
+
+func forbidden(detail string) *models.APIError {
+	return &models.APIError{Code: http.StatusForbidden,
+		Message: models.ErrorMessage{Error: "Forbidden", Code: models.CodeForbidden, Detail: detail},
+	}
+}
+
+func conflict(code string, detail string) *models.APIError {
+	return &models.APIError{Code: http.StatusConflict,
+		Message: models.ErrorMessage{Error: "Conflict", Code: code, Detail: detail},
+	}
+}
+
+func internalError(err error) *models.APIError {
+	return &models.APIError{Code: http.StatusInternalServerError,
+		Message: models.ErrorMessage{Error: "Internal Server Error", Detail: err.Error()},
+	}
+}
+
+// readBody reads the JSON body of r into v and returns the raw body.
+func readBody(r *http.Request, v interface{}) ([]byte, *models.APIError) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize))
+	if err != nil {
+		return nil, badRequest(models.CodeInvalidRequest, err.Error())
+	}
+
+	err = json.Unmarshal(body, v)
+	if err != nil {
+		return nil, badRequest(models.CodeInvalidRequest, err.Error())
+	}
+	return body, nil
+}
+
+// userPublicKey returns the key of the primary device of user, which signs
+// requests made on behalf of the user.
+func userPublicKey(store db.Store, user string) (string, *models.APIError) {
+	publicKey, err := store.GetPublicKey(user)
+	if errors.Is(err, db.ErrNotFound) {
+		return "", notFound(models.CodeUserNotFound)
+	} else if err != nil {
+		return "", internalError(err)
+	}
+	return publicKey, nil
+}
+
+// verifySignedBody checks that body was signed by the private key matching
+// publicKey for the method and path of r, that the request is recent and
+// that its nonce was not used before.
+func verifySignedBody(r *http.Request, store db.Store, publicKey string, body []byte) *models.APIError {
+	signature, err := utils.DecodeBase64(r.Header.Get(signatureHeader))
+	if err != nil || len(signature) == 0 {
+		return unauthorized(models.CodeInvalidSignature, "missing "+signatureHeader+" header")
+	}
+
+	err = utils.VerifySignature(publicKey, body, signature)
+	if err != nil {
+		return unauthorized(models.CodeInvalidSignature, err.Error())
+	}
+
+	var signed models.SignedRequest
+	json.Unmarshal(body, &signed)
+
+	timestamp := time.Unix(signed.Timestamp, 0)
+	age := time.Since(timestamp)
+	if age > signatureMaxAge || age < -signatureMaxAge {
+		return unauthorized(models.CodeExpiredRequest, "timestamp is too far from the server time")
+	}
+
+	// the body is only valid for the request it was signed for
+	if signed.Method != r.Method || signed.Path != r.URL.Path {
+		return unauthorized(models.CodeRequestMismatch, "method and path must be "+r.Method+" "+r.URL.Path)
+	}
+	if len(signed.Nonce) < minNonceSize || len(signed.Nonce) > maxNonceSize {
+		return unauthorized(models.CodeInvalidRequest, fmt.Sprintf("nonce must be between %d and %d characters", minNonceSize, maxNonceSize))
+	}
+
+	// requests older than signatureMaxAge are rejected, so their nonces are
+	// not needed afterwards
+	fresh, err := store.UseNonce(signed.Nonce, timestamp.Add(signatureMaxAge))
+	if err != nil {
+		return internalError(err)
+	}
+	if !fresh {
+		return unauthorized(models.CodeReplayedRequest, "the request was sent already")
+	}
+	return nil
+}
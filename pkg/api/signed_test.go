@@ -0,0 +1,81 @@
+package api
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"enigma-protocol-go/pkg/models"
+)
+
+// resend sends the signed body of req again with method to url and returns
+// the response.
+func resend(router http.Handler, req *http.Request, body []byte, method string, url string) *httptest.ResponseRecorder {
+	replayed, _ := http.NewRequest(method, url, bytes.NewReader(body))
+	replayed.Header.Set(signatureHeader, req.Header.Get(signatureHeader))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, replayed)
+	return rr
+}
+
+func TestSignedRequestReplay(t *testing.T) {
+	router := setup()
+	defer cleanup()
+
+	user := createUser(t, router)
+	devicePublicKey, _, _ := ed25519.GenerateKey(nil)
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		code   string
+	}{
+		// a body signed for another endpoint with the same shape
+		{"other route", "POST", "/users/" + user.id + "/key", models.CodeRequestMismatch},
+		// the request itself is accepted once
+		{"same route", "POST", "/users/" + user.id + "/devices", ""},
+		{"replay", "POST", "/users/" + user.id + "/devices", models.CodeReplayedRequest},
+	}
+
+	req := signedRequest(t, "POST", "/users/"+user.id+"/devices", models.RegisterDeviceRequest{
+		SignedRequest: models.SignedRequest{Timestamp: time.Now().Unix()},
+		PublicKey:     base64.StdEncoding.EncodeToString(devicePublicKey),
+	}, user.privateKey)
+	body, _ := io.ReadAll(req.Body)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := resend(router, req, body, tt.method, tt.url)
+
+			if tt.code == "" {
+				if rr.Code != http.StatusOK {
+					t.Fatalf("Expected status %v, but got %v: %s", http.StatusOK, rr.Code, rr.Body)
+				}
+				return
+			}
+
+			var res models.ErrorMessage
+			json.NewDecoder(rr.Body).Decode(&res)
+			if rr.Code != http.StatusUnauthorized || res.Code != tt.code {
+				t.Errorf("Expected status %v with %s, but got %v with %s", http.StatusUnauthorized, tt.code, rr.Code, res.Code)
+			}
+		})
+	}
+
+	// requests without a random nonce are refused
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, signedRequest(t, "POST", "/users/"+user.id+"/devices", models.RegisterDeviceRequest{
+		SignedRequest: models.SignedRequest{Timestamp: time.Now().Unix(), Nonce: "1"},
+		PublicKey:     base64.StdEncoding.EncodeToString(devicePublicKey),
+	}, user.privateKey))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %v, but got %v", http.StatusUnauthorized, rr.Code)
+	}
+}
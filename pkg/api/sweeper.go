@@ -0,0 +1,72 @@
+package api
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// sweepInterval is how often expired messages and inactive users are
+// deleted.
+const sweepInterval = time.Minute
+
+// RunSweeper deletes the pending messages older than MessageTTL, the
+// revocations of expired tokens, the nonces of expired signed requests and
+// the users inactive for longer than UserRetention until ctx is done.
+func (s *Server) RunSweeper(ctx context.Context) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.opts.sweep(now)
+			s.opts.deleteInactiveUsers(now, s.websockets)
+		}
+	}
+}
+
+func (opts APIOpts) sweep(now time.Time) {
+	deleted, err := opts.Database.DeleteExpiredMessages(now.Add(-opts.messageTTL()))
+	if err != nil {
+		log.Printf("Failed to delete expired messages: %v\n", err)
+	} else if deleted > 0 {
+		log.Printf("Deleted %d expired messages\n", deleted)
+	}
+
+	_, err = opts.Database.DeleteExpiredRevocations(now)
+	if err != nil {
+		log.Printf("Failed to delete expired token revocations: %v\n", err)
+	}
+
+	_, err = opts.Database.DeleteExpiredNonces(now)
+	if err != nil {
+		log.Printf("Failed to delete expired request nonces: %v\n", err)
+	}
+}
+
+// deleteInactiveUsers deletes the users inactive for longer than
+// UserRetention and closes their sessions.
+func (opts APIOpts) deleteInactiveUsers(now time.Time, sessions disconnecter) {
+	if opts.UserRetention <= 0 {
+		return
+	}
+
+	users, err := opts.Database.GetInactiveUsers(now.Add(-opts.UserRetention))
+	if err != nil {
+		log.Printf("Failed to get inactive users: %v\n", err)
+		return
+	}
+
+	for _, user := range users {
+		err = opts.Database.DeleteUser(user.ID)
+		if err != nil {
+			log.Printf("Failed to delete inactive user %s: %v\n", user.ID, err)
+			continue
+		}
+		sessions.disconnect(user.ID, "user deleted")
+		log.Printf("Deleted user %s, inactive since %s\n", user.ID, user.LastActivity.Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"enigma-protocol-go/pkg/db"
+	"enigma-protocol-go/pkg/models"
+
+	"nhooyr.io/websocket"
+)
+
+func TestSweep(t *testing.T) {
+	opts, err := NewAPIOpts(&db.DatabaseOpts{Driver: "memory"}, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	opts.MessageTTL = time.Hour
+
+	to, _ := opts.Database.SaveUser("test-public-key", "")
+	opts.Database.SavePendingMessage(models.TransmissionData{From: "test-from", To: to, Payload: "payload"})
+
+	opts.sweep(time.Now())
+	if count, _, _ := opts.Database.PendingStats(to); count != 1 {
+		t.Errorf("Expected the message to be kept, got %d messages", count)
+	}
+
+	opts.sweep(time.Now().Add(2 * time.Hour))
+	if count, _, _ := opts.Database.PendingStats(to); count != 0 {
+		t.Errorf("Expected the message to expire, got %d messages", count)
+	}
+}
+
+func TestDeleteInactiveUsers(t *testing.T) {
+	opts, err := NewAPIOpts(&db.DatabaseOpts{Driver: "memory"}, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	server := opts.NewServer()
+	user := createUser(t, server)
+
+	// disabled by default
+	opts.deleteInactiveUsers(time.Now().Add(24*time.Hour), server.websockets)
+	if !opts.Database.IsUserExists(user.id) {
+		t.Errorf("Expected user %s to be kept", user.id)
+	}
+
+	opts.UserRetention = time.Hour
+	opts.deleteInactiveUsers(time.Now(), server.websockets)
+	if !opts.Database.IsUserExists(user.id) {
+		t.Errorf("Expected user %s to be kept", user.id)
+	}
+
+	s := httptest.NewServer(server)
+	defer s.Close()
+	wsEndpoint := "ws" + s.URL[4:] + "/ws/"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	c := dialUser(t, ctx, wsEndpoint, user)
+	defer c.Close(websocket.StatusNormalClosure, "")
+
+	opts.deleteInactiveUsers(time.Now().Add(2*time.Hour), server.websockets)
+	if opts.Database.IsUserExists(user.id) {
+		t.Errorf("Expected user %s to be deleted", user.id)
+	}
+
+	// the session of the user is closed and its tokens are not accepted
+	for {
+		if _, _, err := c.Read(ctx); err != nil {
+			if status := websocket.CloseStatus(err); status != websocket.StatusNormalClosure {
+				t.Errorf("Expected status %v, got %v", websocket.StatusNormalClosure, err)
+			}
+			break
+		}
+	}
+	if _, res, err := websocket.Dial(ctx, wsEndpoint+user.id, &websocket.DialOptions{
+		HTTPHeader: http.Header{"Authorization": []string{"Bearer " + user.token}},
+	}); err == nil || res == nil || res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status %v, got %v", http.StatusUnauthorized, err)
+	}
+}
@@ -0,0 +1,300 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"enigma-protocol-go/pkg/db"
+	"enigma-protocol-go/pkg/models"
+	"enigma-protocol-go/pkg/utils"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// tokenSubprotocol is offered by websocket clients which cannot set the
+// Authorization header, the access token is offered as the next subprotocol.
+const tokenSubprotocol = "access_token"
+
+// TokenAPI issues the session tokens of users and checks them in front of
+// the endpoints acting on behalf of a user.
+type TokenAPI struct {
+	db db.Store
+	// keys verify tokens, the first one signs them
+	keys       []utils.TokenKey
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+	userIDs    utils.IDFormat
+}
+
+func NewTokenAPI(opts APIOpts) *TokenAPI {
+	keys := opts.TokenKeys
+	if len(keys) == 0 {
+		secret, err := utils.RandomBytes(utils.MinTokenSecretSize)
+		if err != nil {
+			panic(err)
+		}
+		keys = []utils.TokenKey{{ID: "random", Secret: secret}}
+		log.Println("No token keys configured, session tokens are signed with a key that changes on restart")
+	}
+
+	return &TokenAPI{
+		db:         opts.Database,
+		keys:       keys,
+		accessTTL:  opts.accessTokenTTL(),
+		refreshTTL: opts.refreshTokenTTL(),
+		userIDs:    opts.UserIDs,
+	}
+}
+
+func (t *TokenAPI) Register(r *httprouter.Router) {
+	r.POST("/tokens", inJSON(t.login))
+	r.POST("/tokens/refresh", inJSON(t.refresh))
+	r.POST("/tokens/revoke", inJSON(t.revoke))
+}
+
+// requesterKey holds the user authenticated by the access token in the
+// context of a request.
+type requesterKey struct{}
+
+// authenticated only calls api when the request carries a valid access
+// token, requester returns the user it belongs to.
+func (t *TokenAPI) authenticated(api APIFunc) APIFunc {
+	return func(r *http.Request, ps httprouter.Params) (interface{}, *models.APIError) {
+		claims, apiErr := t.accessClaims(r)
+		if apiErr != nil {
+			return nil, apiErr
+		}
+		return api(r.WithContext(context.WithValue(r.Context(), requesterKey{}, claims.Subject)), ps)
+	}
+}
+
+// requester returns the user whose access token authenticated r.
+func requester(r *http.Request) string {
+	user, _ := r.Context().Value(requesterKey{}).(string)
+	return user
+}
+
+// websocket is authenticated for websocket handlers, the connection is
+// refused before the upgrade.
+func (t *TokenAPI) websocket(handle httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if apiErr := t.authenticate(r, t.userIDs.Normalize(ps.ByName("id"))); apiErr != nil {
+			writeJSON(w, apiErr.Code, apiErr.Message)
+			return
+		}
+		handle(w, r, ps)
+	}
+}
+
+// authenticate checks that r carries a valid access token of user.
+func (t *TokenAPI) authenticate(r *http.Request, user string) *models.APIError {
+	claims, apiErr := t.accessClaims(r)
+	if apiErr != nil {
+		return apiErr
+	}
+	if claims.Subject != user {
+		return forbidden("the access token belongs to another user")
+	}
+	return nil
+}
+
+// accessClaims returns the claims of the access token r carries.
+func (t *TokenAPI) accessClaims(r *http.Request) (utils.TokenClaims, *models.APIError) {
+	token := requestToken(r)
+	if token == "" {
+		return utils.TokenClaims{}, unauthorized(models.CodeInvalidToken, "missing access token")
+	}
+	return t.verify(token, utils.TokenTypeAccess)
+}
+
+// requestToken returns the bearer token of r or, for websocket clients, the
+// subprotocol offered after tokenSubprotocol.
+func requestToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+
+	var protocols []string
+	for _, value := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(value, ",") {
+			protocols = append(protocols, strings.TrimSpace(protocol))
+		}
+	}
+	for i := 0; i+1 < len(protocols); i++ {
+		if protocols[i] == tokenSubprotocol {
+			return protocols[i+1]
+		}
+	}
+	return ""
+}
+
+// verify checks the signature, expiry and type of token and that its
+// session was not revoked. Tokens of a deleted user are not accepted, not
+// even for a new user with the same id.
+func (t *TokenAPI) verify(token string, tokenType string) (utils.TokenClaims, *models.APIError) {
+	claims, err := utils.ParseToken(t.keys, token, time.Now())
+	if errors.Is(err, utils.ErrExpiredToken) {
+		return claims, unauthorized(models.CodeExpiredToken, err.Error())
+	} else if err != nil {
+		return claims, unauthorized(models.CodeInvalidToken, err.Error())
+	}
+
+	if tokenType != "" && claims.Type != tokenType {
+		return claims, unauthorized(models.CodeInvalidToken, "expected a token of type "+tokenType)
+	}
+
+	revoked, err := t.db.IsTokenRevoked(claims.Session)
+	if err != nil {
+		return claims, internalError(err)
+	}
+	if revoked {
+		return claims, unauthorized(models.CodeInvalidToken, "the session was revoked")
+	}
+
+	generation, err := t.db.GetTokenGeneration(claims.Subject)
+	if errors.Is(err, db.ErrNotFound) || (err == nil && generation != claims.Generation) {
+		return claims, unauthorized(models.CodeInvalidToken, "the user of the token was deleted")
+	} else if err != nil {
+		return claims, internalError(err)
+	}
+	return claims, nil
+}
+
+// issue starts a new session for user.
+func (t *TokenAPI) issue(user string) (models.Tokens, error) {
+	session, err := utils.RandomHex(16)
+	if err != nil {
+		return models.Tokens{}, err
+	}
+	return t.issueSession(user, session)
+}
+
+func (t *TokenAPI) issueSession(user string, session string) (models.Tokens, error) {
+	generation, err := t.db.GetTokenGeneration(user)
+	if err != nil {
+		return models.Tokens{}, err
+	}
+
+	now := time.Now()
+	accessToken, err := t.sign(user, generation, session, utils.TokenTypeAccess, now, t.accessTTL)
+	if err != nil {
+		return models.Tokens{}, err
+	}
+	refreshToken, err := t.sign(user, generation, session, utils.TokenTypeRefresh, now, t.refreshTTL)
+	if err != nil {
+		return models.Tokens{}, err
+	}
+
+	return models.Tokens{
+		TokenType:    "Bearer",
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(t.accessTTL.Seconds()),
+	}, nil
+}
+
+func (t *TokenAPI) sign(user string, generation string, session string, tokenType string, now time.Time, ttl time.Duration) (string, error) {
+	id, err := utils.RandomHex(16)
+	if err != nil {
+		return "", err
+	}
+
+	return utils.SignToken(t.keys[0], utils.TokenClaims{
+		Subject:    user,
+		Generation: generation,
+		Session:    session,
+		ID:         id,
+		Type:       tokenType,
+		IssuedAt:   now.Unix(),
+		ExpiresAt:  now.Add(ttl).Unix(),
+	})
+}
+
+// revokeSession revokes every token of session, none of them is valid
+// longer than a refresh token issued now.
+func (t *TokenAPI) revokeSession(session string) error {
+	_, err := t.db.RevokeToken(session, time.Now().Add(t.refreshTTL))
+	return err
+}
+
+// login starts a session for a user which has no tokens, the request must
+// be signed with the key of the user.
+func (t *TokenAPI) login(r *http.Request, _ httprouter.Params) (interface{}, *models.APIError) {
+	var req models.TokenRequest
+	body, apiErr := readBody(r, &req)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	user := t.userIDs.Normalize(req.Login)
+	publicKey, apiErr := userPublicKey(t.db, user)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	if apiErr := verifySignedBody(r, t.db, publicKey, body); apiErr != nil {
+		return nil, apiErr
+	}
+
+	tokens, err := t.issue(user)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	return &tokens, nil
+}
+
+// refresh exchanges a refresh token for new tokens of the same session.
+// Refresh tokens are used once, when one is used again it leaked and the
+// session is revoked.
+func (t *TokenAPI) refresh(r *http.Request, _ httprouter.Params) (interface{}, *models.APIError) {
+	var req models.RefreshTokenRequest
+	if _, apiErr := readBody(r, &req); apiErr != nil {
+		return nil, apiErr
+	}
+
+	claims, apiErr := t.verify(req.RefreshToken, utils.TokenTypeRefresh)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	unused, err := t.db.RevokeToken(claims.ID, time.Unix(claims.ExpiresAt, 0))
+	if err != nil {
+		return nil, internalError(err)
+	}
+	if !unused {
+		if err := t.revokeSession(claims.Session); err != nil {
+			return nil, internalError(err)
+		}
+		log.Printf("Refresh token of user %s used twice, revoked its session\n", claims.Subject)
+		return nil, unauthorized(models.CodeInvalidToken, "the refresh token was used already, the session is revoked")
+	}
+
+	tokens, err := t.issueSession(claims.Subject, claims.Session)
+	if err != nil {
+		return nil, internalError(err)
+	}
+	return &tokens, nil
+}
+
+// revoke ends the session of the token in the body, an access or refresh
+// token, so none of its tokens are accepted anymore.
+func (t *TokenAPI) revoke(r *http.Request, _ httprouter.Params) (interface{}, *models.APIError) {
+	var req models.RevokeTokenRequest
+	if _, apiErr := readBody(r, &req); apiErr != nil {
+		return nil, apiErr
+	}
+
+	claims, apiErr := t.verify(req.Token, "")
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	if err := t.revokeSession(claims.Session); err != nil {
+		return nil, internalError(err)
+	}
+	return map[string]string{"status": "revoked"}, nil
+}
@@ -0,0 +1,214 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"enigma-protocol-go/pkg/db"
+	"enigma-protocol-go/pkg/models"
+	"enigma-protocol-go/pkg/utils"
+
+	"nhooyr.io/websocket"
+)
+
+// postTokens posts body to the token endpoint path and decodes the tokens
+// into res when it succeeds.
+func postTokens(t *testing.T, router http.Handler, path string, body interface{}, res *models.Tokens) int {
+	data, _ := json.Marshal(body)
+	req, _ := http.NewRequest("POST", path, bytes.NewReader(data))
+	rr := httptest.NewRecorder()
+
+	router.ServeHTTP(rr, req)
+
+	if rr.Code == http.StatusOK && res != nil {
+		if err := json.NewDecoder(rr.Body).Decode(res); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	return rr.Code
+}
+
+func TestWebsocketToken(t *testing.T) {
+	router := setup()
+	defer cleanup()
+
+	user1 := createUser(t, router)
+	user2 := createUser(t, router)
+
+	s := httptest.NewServer(router)
+	wsEndpoint := "ws" + s.URL[4:] + "/ws/"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	tests := []struct {
+		name   string
+		header http.Header
+		status int
+	}{
+		{"missing", nil, http.StatusUnauthorized},
+		{"invalid", http.Header{"Authorization": []string{"Bearer invalid"}}, http.StatusUnauthorized},
+		{"other user", http.Header{"Authorization": []string{"Bearer " + user2.token}}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, res, err := websocket.Dial(ctx, wsEndpoint+user1.id, &websocket.DialOptions{HTTPHeader: tt.header})
+			if err == nil {
+				t.Fatalf("Expected the connection to be refused")
+			}
+			if res == nil || res.StatusCode != tt.status {
+				t.Errorf("Expected status %v, got %v", tt.status, res)
+			}
+		})
+	}
+
+	// browsers pass the token as subprotocol
+	c, _, err := websocket.Dial(ctx, wsEndpoint+user1.id, &websocket.DialOptions{
+		Subprotocols: []string{tokenSubprotocol, user1.token},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer c.Close(websocket.StatusNormalClosure, "")
+	if c.Subprotocol() != tokenSubprotocol {
+		t.Errorf("Expected subprotocol %s, got %q", tokenSubprotocol, c.Subprotocol())
+	}
+	readFrame(t, ctx, c, models.FrameChallenge)
+}
+
+func TestTokens(t *testing.T) {
+	router := setup()
+	defer cleanup()
+
+	user1 := createUser(t, router)
+
+	// a session for a user which has no tokens
+	var tokens models.Tokens
+	req := signedRequest(t, "POST", "/tokens", models.TokenRequest{
+		SignedRequest: models.SignedRequest{Timestamp: time.Now().Unix()},
+		Login:         user1.id,
+	}, user1.privateKey)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %v, but got %v: %s", http.StatusOK, rr.Code, rr.Body)
+	}
+	json.NewDecoder(rr.Body).Decode(&tokens)
+	if tokens.TokenType != "Bearer" || tokens.AccessToken == "" || tokens.RefreshToken == "" || tokens.ExpiresIn != int64(DefaultAccessTokenTTL.Seconds()) {
+		t.Fatalf("Expected tokens, got %+v", tokens)
+	}
+
+	// the other user cannot sign for user1
+	other := createUser(t, router)
+	req = signedRequest(t, "POST", "/tokens", models.TokenRequest{
+		SignedRequest: models.SignedRequest{Timestamp: time.Now().Unix()},
+		Login:         user1.id,
+	}, other.privateKey)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %v, but got %v", http.StatusUnauthorized, rr.Code)
+	}
+
+	// access tokens cannot be used to refresh
+	if status := postTokens(t, router, "/tokens/refresh", models.RefreshTokenRequest{RefreshToken: tokens.AccessToken}, nil); status != http.StatusUnauthorized {
+		t.Errorf("Expected status %v, but got %v", http.StatusUnauthorized, status)
+	}
+
+	var refreshed models.Tokens
+	if status := postTokens(t, router, "/tokens/refresh", models.RefreshTokenRequest{RefreshToken: tokens.RefreshToken}, &refreshed); status != http.StatusOK {
+		t.Fatalf("Expected status %v, but got %v", http.StatusOK, status)
+	}
+	if refreshed.RefreshToken == tokens.RefreshToken {
+		t.Errorf("Expected a new refresh token")
+	}
+	if status := connectAs(router, other.id, user1.id, refreshed.AccessToken); status != http.StatusOK {
+		t.Errorf("Expected the refreshed access token to be valid, got status %v", status)
+	}
+
+	// using a refresh token twice revokes the whole session
+	if status := postTokens(t, router, "/tokens/refresh", models.RefreshTokenRequest{RefreshToken: tokens.RefreshToken}, nil); status != http.StatusUnauthorized {
+		t.Errorf("Expected status %v, but got %v", http.StatusUnauthorized, status)
+	}
+	if status := connectAs(router, other.id, user1.id, refreshed.AccessToken); status != http.StatusUnauthorized {
+		t.Errorf("Expected status %v for a revoked session, but got %v", http.StatusUnauthorized, status)
+	}
+
+	// revoking a session leaves the other sessions alone
+	if status := postTokens(t, router, "/tokens/revoke", models.RevokeTokenRequest{Token: user1.token}, nil); status != http.StatusOK {
+		t.Fatalf("Expected status %v, but got %v", http.StatusOK, status)
+	}
+	if status := connectAs(router, other.id, user1.id, user1.token); status != http.StatusUnauthorized {
+		t.Errorf("Expected status %v for a revoked session, but got %v", http.StatusUnauthorized, status)
+	}
+	if status := connectAs(router, user1.id, other.id, other.token); status != http.StatusOK {
+		t.Errorf("Expected status %v, but got %v", http.StatusOK, status)
+	}
+}
+
+// connectAs fetches the keys of id for requester, which is authenticated by
+// token, and returns the status.
+func connectAs(router http.Handler, id string, requester string, token string) int {
+	req, _ := http.NewRequest("GET", "/connect/"+id+"?requester="+requester, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+
+	router.ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func TestTokensOfDeletedUser(t *testing.T) {
+	// few ids, so the id of a deleted user is given to a new user soon
+	opts, err := NewAPIOpts(&db.DatabaseOpts{Driver: "memory", UserIDs: utils.IDFormat{Length: 1}}, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	router := opts.NewRouter()
+
+	user1 := createUser(t, router)
+	other := createUser(t, router)
+	var tokens models.Tokens
+	req := signedRequest(t, "POST", "/tokens", models.TokenRequest{
+		SignedRequest: models.SignedRequest{Timestamp: time.Now().Unix()},
+		Login:         user1.id,
+	}, user1.privateKey)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %v, but got %v", http.StatusOK, rr.Code)
+	}
+	json.NewDecoder(rr.Body).Decode(&tokens)
+
+	if rr := deleteUser(t, router, user1, models.DeleteUserRequest{Delete: user1.id}); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %v, but got %v", http.StatusOK, rr.Code)
+	}
+	if status := postTokens(t, router, "/tokens/refresh", models.RefreshTokenRequest{RefreshToken: tokens.RefreshToken}, nil); status != http.StatusUnauthorized {
+		t.Errorf("Expected status %v, but got %v", http.StatusUnauthorized, status)
+	}
+
+	// the tokens are not accepted for the new user with the same id either
+	reused := createUser(t, router)
+	for attempt := 0; reused.id != user1.id; attempt++ {
+		if attempt == 500 {
+			t.Fatalf("Expected id %s to be given to a new user", user1.id)
+		}
+		deleteUser(t, router, reused, models.DeleteUserRequest{Delete: reused.id})
+		reused = createUser(t, router)
+	}
+
+	if status := postTokens(t, router, "/tokens/refresh", models.RefreshTokenRequest{RefreshToken: tokens.RefreshToken}, nil); status != http.StatusUnauthorized {
+		t.Errorf("Expected status %v, but got %v", http.StatusUnauthorized, status)
+	}
+	if status := connectAs(router, other.id, reused.id, tokens.AccessToken); status != http.StatusUnauthorized {
+		t.Errorf("Expected status %v, but got %v", http.StatusUnauthorized, status)
+	}
+	if status := connectAs(router, other.id, reused.id, reused.token); status != http.StatusOK {
+		t.Errorf("Expected status %v, but got %v", http.StatusOK, status)
+	}
+}
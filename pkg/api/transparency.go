@@ -0,0 +1,215 @@
+package api
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"enigma-protocol-go/pkg/db"
+	"enigma-protocol-go/pkg/merkle"
+	"enigma-protocol-go/pkg/models"
+	"enigma-protocol-go/pkg/utils"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// TransparencyAPI serves the key log, an append-only Merkle tree of every
+// key registration and rotation and every device added or removed. Clients
+// check that the key they got from /connect is in the log and that the log
+// never rewrites its history.
+type TransparencyAPI struct {
+	db      db.Store
+	key     ed25519.PrivateKey
+	userIDs utils.IDFormat
+
+	// mu guards the entries of the log read so far with the hashes of their
+	// leaves and the last root hash, the log is append-only so only the
+	// entries appended since are read and hashed
+	mu       sync.Mutex
+	entries  []models.KeyLogEntry
+	leaves   [][]byte
+	root     []byte
+	rootSize int
+}
+
+func NewTransparencyAPI(opts APIOpts) *TransparencyAPI {
+	key := opts.LogSigningKey
+	if key == nil {
+		var err error
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+		log.Println("No log signing key configured, tree heads are signed with a key that changes on restart")
+	}
+
+	return &TransparencyAPI{db: opts.Database, key: key, userIDs: opts.UserIDs}
+}
+
+func (t *TransparencyAPI) Register(r *httprouter.Router) {
+	r.GET("/log/key", inJSON(t.logKey))
+	r.GET("/log/head", inJSON(t.treeHead))
+	r.GET("/log/inclusion/:id", inJSON(t.inclusionProof))
+	r.GET("/log/consistency", inJSON(t.consistencyProof))
+}
+
+// treeHeadSignatureData returns the bytes signed for a tree head: the tree
+// size and the timestamp as big-endian uint64 followed by the root hash.
+func treeHeadSignatureData(head models.SignedTreeHead, rootHash []byte) []byte {
+	data := make([]byte, 16, 16+len(rootHash))
+	binary.BigEndian.PutUint64(data[:8], uint64(head.TreeSize))
+	binary.BigEndian.PutUint64(data[8:], uint64(head.Timestamp))
+	return append(data, rootHash...)
+}
+
+// leafHashes returns the entries of the key log and the hashes of their
+// leaves.
+func (t *TransparencyAPI) leafHashes() ([]models.KeyLogEntry, [][]byte, *models.APIError) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entries, err := t.db.GetKeyLog(len(t.entries))
+	if err != nil {
+		return nil, nil, internalError(err)
+	}
+
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return nil, nil, internalError(err)
+		}
+		t.entries = append(t.entries, entry)
+		t.leaves = append(t.leaves, merkle.LeafHash(data))
+	}
+
+	// later appends must not write into the slices handed out
+	n := len(t.entries)
+	return t.entries[:n:n], t.leaves[:n:n], nil
+}
+
+// rootHash returns the root hash of leaves, a prefix of the log.
+func (t *TransparencyAPI) rootHash(leaves [][]byte) []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.root == nil || t.rootSize != len(leaves) {
+		t.root = merkle.RootHash(leaves)
+		t.rootSize = len(leaves)
+	}
+	return t.root
+}
+
+// treeSize reads the tree size in the query parameter name, it defaults to
+// the size of the log.
+func treeSize(r *http.Request, name string, size int) (int, *models.APIError) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return size, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 || n > size {
+		return 0, badRequest(models.CodeInvalidTreeSize, name+" must be between 0 and "+strconv.Itoa(size))
+	}
+	return n, nil
+}
+
+func encodeHashes(hashes [][]byte) []string {
+	encoded := make([]string, len(hashes))
+	for i, hash := range hashes {
+		encoded[i] = base64.StdEncoding.EncodeToString(hash)
+	}
+	return encoded
+}
+
+func (t *TransparencyAPI) logKey(_ *http.Request, _ httprouter.Params) (interface{}, *models.APIError) {
+	publicKey := t.key.Public().(ed25519.PublicKey)
+	return &models.LogKey{PublicKey: base64.StdEncoding.EncodeToString(publicKey)}, nil
+}
+
+func (t *TransparencyAPI) treeHead(_ *http.Request, _ httprouter.Params) (interface{}, *models.APIError) {
+	_, leaves, apiErr := t.leafHashes()
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	root := t.rootHash(leaves)
+	head := models.SignedTreeHead{
+		TreeSize:  int64(len(leaves)),
+		Timestamp: time.Now().UnixMilli(),
+		RootHash:  base64.StdEncoding.EncodeToString(root),
+	}
+	head.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(t.key, treeHeadSignatureData(head, root)))
+	return &head, nil
+}
+
+// inclusionProof proves that the latest key of a user is in the log, or the
+// key in the publicKey query parameter when set. The device query parameter
+// asks for the key of a device instead. treeSize selects the tree the proof
+// is for, it defaults to the current one.
+func (t *TransparencyAPI) inclusionProof(r *http.Request, ps httprouter.Params) (interface{}, *models.APIError) {
+	id := t.userIDs.Normalize(ps.ByName("id"))
+	publicKey := r.URL.Query().Get("publicKey")
+	device := r.URL.Query().Get("device")
+
+	entries, leaves, apiErr := t.leafHashes()
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	size, apiErr := treeSize(r, "treeSize", len(leaves))
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	for i := size - 1; i >= 0; i-- {
+		entry := entries[i]
+		if entry.User != id || entry.Device != device || entry.Removed || (publicKey != "" && entry.PublicKey != publicKey) {
+			continue
+		}
+
+		return &models.InclusionProof{
+			LeafIndex: int64(i),
+			TreeSize:  int64(size),
+			Entry:     entries[i],
+			AuditPath: encodeHashes(merkle.InclusionProof(leaves[:size], i)),
+		}, nil
+	}
+
+	return nil, notFound(models.CodeLogEntryNotFound)
+}
+
+// consistencyProof proves that the tree with first entries is a prefix of
+// the tree with second entries, second defaults to the current size.
+func (t *TransparencyAPI) consistencyProof(r *http.Request, _ httprouter.Params) (interface{}, *models.APIError) {
+	_, leaves, apiErr := t.leafHashes()
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	second, apiErr := treeSize(r, "second", len(leaves))
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	if r.URL.Query().Get("first") == "" {
+		return nil, badRequest(models.CodeInvalidTreeSize, "first is required")
+	}
+	first, apiErr := treeSize(r, "first", second)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	return &models.ConsistencyProof{
+		First:  int64(first),
+		Second: int64(second),
+		Proof:  encodeHashes(merkle.ConsistencyProof(leaves[:second], first)),
+	}, nil
+}
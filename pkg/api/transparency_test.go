@@ -0,0 +1,134 @@
+package api
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"enigma-protocol-go/pkg/merkle"
+	"enigma-protocol-go/pkg/models"
+)
+
+func getJSON(t *testing.T, router http.Handler, url string, v interface{}) int {
+	req, _ := http.NewRequest("GET", url, nil)
+	rr := httptest.NewRecorder()
+
+	router.ServeHTTP(rr, req)
+	if rr.Code == http.StatusOK {
+		if err := json.NewDecoder(rr.Body).Decode(v); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	return rr.Code
+}
+
+func decodeHashes(t *testing.T, encoded []string) [][]byte {
+	var hashes [][]byte
+	for _, hash := range encoded {
+		data, err := base64.StdEncoding.DecodeString(hash)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		hashes = append(hashes, data)
+	}
+	return hashes
+}
+
+// treeHead fetches the signed tree head and checks its signature.
+func treeHead(t *testing.T, router http.Handler, logKey ed25519.PublicKey) (models.SignedTreeHead, []byte) {
+	var head models.SignedTreeHead
+	if status := getJSON(t, router, "/log/head", &head); status != http.StatusOK {
+		t.Fatalf("Expected status %v, but got %v", http.StatusOK, status)
+	}
+
+	root := decodeHashes(t, []string{head.RootHash})[0]
+	signature, _ := base64.StdEncoding.DecodeString(head.Signature)
+	if !ed25519.Verify(logKey, treeHeadSignatureData(head, root), signature) {
+		t.Errorf("Expected a valid tree head signature")
+	}
+	return head, root
+}
+
+func TestKeyLog(t *testing.T) {
+	logPublicKey, logPrivateKey, _ := ed25519.GenerateKey(nil)
+	router := setupWith(func(opts *APIOpts) {
+		opts.LogSigningKey = logPrivateKey
+	})
+	defer cleanup()
+
+	var logKey models.LogKey
+	getJSON(t, router, "/log/key", &logKey)
+	if logKey.PublicKey != base64.StdEncoding.EncodeToString(logPublicKey) {
+		t.Errorf("Expected log key %x, got %s", logPublicKey, logKey.PublicKey)
+	}
+
+	user1 := createUser(t, router)
+	user2 := createUser(t, router)
+	oldHead, oldRoot := treeHead(t, router, logPublicKey)
+	if oldHead.TreeSize != 2 {
+		t.Errorf("Expected tree size 2, got %d", oldHead.TreeSize)
+	}
+
+	newPublicKey, _, _ := ed25519.GenerateKey(nil)
+	if rr := rotateKey(t, router, user1, newPublicKey); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %v, but got %v", http.StatusOK, rr.Code)
+	}
+	head, root := treeHead(t, router, logPublicKey)
+	if head.TreeSize != 3 {
+		t.Errorf("Expected tree size 3, got %d", head.TreeSize)
+	}
+
+	// the current key is the rotated one
+	var proof models.InclusionProof
+	if status := getJSON(t, router, "/log/inclusion/"+user1.id, &proof); status != http.StatusOK {
+		t.Fatalf("Expected status %v, but got %v", http.StatusOK, status)
+	}
+	newDER, _ := x509.MarshalPKIXPublicKey(newPublicKey)
+	if proof.Entry.PublicKey != base64.StdEncoding.EncodeToString(newDER) || proof.LeafIndex != 2 {
+		t.Errorf("Expected the rotated key at index 2, got %v", proof)
+	}
+	leaf, _ := json.Marshal(proof.Entry)
+	if !merkle.VerifyInclusion(int(proof.LeafIndex), int(proof.TreeSize), merkle.LeafHash(leaf), decodeHashes(t, proof.AuditPath), root) {
+		t.Errorf("Expected the inclusion proof to verify")
+	}
+
+	// the first key is in the older tree
+	getJSON(t, router, "/log/inclusion/"+user1.id+"?treeSize=2", &proof)
+	leaf, _ = json.Marshal(proof.Entry)
+	if proof.LeafIndex != 0 || !merkle.VerifyInclusion(0, 2, merkle.LeafHash(leaf), decodeHashes(t, proof.AuditPath), oldRoot) {
+		t.Errorf("Expected the first key to be in the old tree, got %v", proof)
+	}
+
+	var consistency models.ConsistencyProof
+	if status := getJSON(t, router, "/log/consistency?first=2", &consistency); status != http.StatusOK {
+		t.Fatalf("Expected status %v, but got %v", http.StatusOK, status)
+	}
+	if !merkle.VerifyConsistency(2, 3, oldRoot, root, decodeHashes(t, consistency.Proof)) {
+		t.Errorf("Expected the consistency proof to verify, got %v", consistency)
+	}
+
+	// devices are logged too
+	device := registerDevice(t, router, user2)
+	head, root = treeHead(t, router, logPublicKey)
+	if head.TreeSize != 4 {
+		t.Errorf("Expected tree size 4, got %d", head.TreeSize)
+	}
+	if status := getJSON(t, router, "/log/inclusion/"+user2.id+"?device="+device.device, &proof); status != http.StatusOK {
+		t.Fatalf("Expected status %v, but got %v", http.StatusOK, status)
+	}
+	leaf, _ = json.Marshal(proof.Entry)
+	if proof.Entry.Device != device.device || !merkle.VerifyInclusion(int(proof.LeafIndex), 4, merkle.LeafHash(leaf), decodeHashes(t, proof.AuditPath), root) {
+		t.Errorf("Expected the device key to be in the log, got %v", proof)
+	}
+
+	if status := getJSON(t, router, "/log/inclusion/random-user", &proof); status != http.StatusNotFound {
+		t.Errorf("Expected status %v, but got %v", http.StatusNotFound, status)
+	}
+	if status := getJSON(t, router, "/log/consistency?first=5", &consistency); status != http.StatusBadRequest {
+		t.Errorf("Expected status %v, but got %v", http.StatusBadRequest, status)
+	}
+}
@@ -2,69 +2,374 @@ package api
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"log"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
 
+	"enigma-protocol-go/pkg/bus"
 	"enigma-protocol-go/pkg/db"
 	"enigma-protocol-go/pkg/models"
+	"enigma-protocol-go/pkg/utils"
 
 	"github.com/julienschmidt/httprouter"
 	"nhooyr.io/websocket"
 )
 
+const (
+	// challengeTimeout is how long a client has to answer the login challenge.
+	challengeTimeout = 30 * time.Second
+	// maxSubscriptions limits the presence subscriptions of a session.
+	maxSubscriptions = 1000
+)
+
 type WebsocketAPI struct {
-	db    *db.Database
-	chats map[string]Chat
-	mu    sync.Mutex
+	db      db.Store
+	userIDs utils.IDFormat
+	// mailboxMaxMessages and mailboxMaxBytes limit the pending messages of
+	// every recipient
+	mailboxMaxMessages int
+	mailboxMaxBytes    int64
+	// chats holds the sessions of every connected user, one per device
+	chats map[string][]*Chat
+	// subscribers holds the sessions subscribed to the presence of a user
+	subscribers map[string]map[*Chat]bool
+	mu          sync.Mutex
+	// tokens checks the access token before the upgrade
+	tokens *TokenAPI
+	// outboundQueueSize is the number of frames queued for a session and
+	// stallTimeout how long a single write can take
+	outboundQueueSize int
+	stallTimeout      time.Duration
+	// pingInterval, pingTimeout and idleTimeout detect dead peers, see
+	// keepalive
+	pingInterval time.Duration
+	pingTimeout  time.Duration
+	idleTimeout  time.Duration
+	// sessionPolicy is one of the SessionPolicy constants and sessionEvents
+	// is called with the events it emits, when set
+	sessionPolicy string
+	sessionEvents func(SessionEvent)
+	// bus reaches the sessions on the other nodes, joined holds the users
+	// registered with it and syncing the users whose presence is being
+	// synced, both guarded by busMu
+	bus     bus.Bus
+	busMu   sync.Mutex
+	joined  map[string]bool
+	syncing map[string]bool
+	// closing is set once shutdown started, guarded by mu, handlers counts
+	// the running handlers and ctx is cancelled when they have to stop
+	closing  bool
+	handlers sync.WaitGroup
+	ctx      context.Context
+	cancel   context.CancelFunc
 }
 
-func NewWebsocketAPI(opts APIOpts) *WebsocketAPI {
-	return &WebsocketAPI{
-		db:    opts.Database,
-		chats: make(map[string]Chat),
+func NewWebsocketAPI(opts APIOpts, tokens *TokenAPI) *WebsocketAPI {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &WebsocketAPI{
+		db:                 opts.Database,
+		userIDs:            opts.UserIDs,
+		tokens:             tokens,
+		mailboxMaxMessages: opts.mailboxMaxMessages(),
+		mailboxMaxBytes:    opts.mailboxMaxBytes(),
+		chats:              make(map[string][]*Chat),
+		subscribers:        make(map[string]map[*Chat]bool),
+		outboundQueueSize:  opts.outboundQueueSize(),
+		stallTimeout:       opts.stallTimeout(),
+		pingInterval:       opts.pingInterval(),
+		pingTimeout:        opts.pingTimeout(),
+		idleTimeout:        opts.idleTimeout(),
+		sessionPolicy:      opts.sessionPolicy(),
+		sessionEvents:      opts.SessionEvents,
+		bus:                opts.bus(),
+		joined:             make(map[string]bool),
+		syncing:            make(map[string]bool),
+		ctx:                ctx,
+		cancel:             cancel,
 	}
+	go w.listen()
+	return w
 }
 
 type Chat struct {
+	user       string
+	device     string
 	connection *websocket.Conn
+	// outbound queues the frames written by the writer of the chat, so
+	// senders never wait for a slow connection
+	outbound chan outboundFrame
+	// resync wakes up the writer when spilled is set
+	resync chan struct{}
+	// done is closed once the writer stopped
+	done chan struct{}
+	// mu guards closed, spilled, deferred, missed and written
+	mu     sync.Mutex
+	closed bool
+	// spilled is set when a stored message did not fit in outbound, it
+	// stays pending until the writer sends the pending messages again
+	spilled bool
+	// deferred is set until the pending messages of a new session are
+	// queued, missed when a stored message arrived meanwhile
+	deferred bool
+	missed   bool
+	// written are the IDs of the stored messages written during this
+	// session and not acknowledged yet, they are not sent again
+	written map[int64]bool
+	// subscriptions are the users whose presence the chat follows, guarded
+	// by WebsocketAPI.mu
+	subscriptions map[string]bool
 }
 
-func (chat *Chat) sendJSON(ctx context.Context, message interface{}) error {
-	if chat.connection == nil {
-		return nil
-	}
-
+// sendJSON queues message for the writer of chat, it fails with
+// errOutboundFull instead of waiting when the queue is full.
+func (chat *Chat) sendJSON(_ context.Context, message interface{}) error {
 	data, err := json.Marshal(message)
 	if err != nil {
 		return err
 	}
-	return chat.connection.Write(ctx, websocket.MessageText, []byte(data))
+	return chat.enqueue(outboundFrame{data: data})
+}
+
+func (chat *Chat) sendError(ctx context.Context, message models.ErrorMessage) error {
+	message.Type = models.FrameError
+	return chat.sendJSON(ctx, message)
 }
 
 func (chat *Chat) SendMessage(ctx context.Context, message models.TransmissionData) error {
+	// messages stored before receipts existed have no type
+	if message.Type == "" {
+		message.Type = models.FrameMessage
+	}
 	return chat.sendJSON(ctx, message)
 }
 
-func (chat *Chat) sendPendingMessages(messages []models.TransmissionData) error {
-	for _, message := range messages {
-		err := chat.SendMessage(context.Background(), message)
-		if err != nil {
-			return err
+// authenticate sends a random nonce to the client and waits for it to be
+// signed with the private key of the device the chat connects as.
+func (w *WebsocketAPI) authenticate(ctx context.Context, chat *Chat) *models.ErrorMessage {
+	invalidChallenge := &models.ErrorMessage{
+		Error: "Invalid challenge response",
+		Code:  models.CodeInvalidChallenge,
+	}
+
+	nonce, err := utils.RandomBytes(32)
+	if err != nil {
+		return &models.ErrorMessage{Error: "Internal Server Error", Detail: err.Error()}
+	}
+
+	err = chat.sendJSON(ctx, models.Challenge{
+		Type:  models.FrameChallenge,
+		Nonce: base64.RawURLEncoding.EncodeToString(nonce),
+	})
+	if err != nil {
+		return invalidChallenge
+	}
+
+	readCtx, cancel := context.WithTimeout(ctx, challengeTimeout)
+	defer cancel()
+
+	_, msg, err := chat.connection.Read(readCtx)
+	if err != nil {
+		return invalidChallenge
+	}
+
+	var response models.ChallengeResponse
+	err = json.Unmarshal(msg, &response)
+	if err != nil || response.Type != models.FrameChallengeResponse {
+		return invalidChallenge
+	}
+
+	signature, err := utils.DecodeBase64(response.Signature)
+	if err != nil {
+		return invalidChallenge
+	}
+
+	publicKey, err := w.db.GetDevicePublicKey(chat.user, chat.device)
+	if err != nil {
+		return &models.ErrorMessage{Error: "Device not found", Code: models.CodeDeviceNotFound}
+	}
+
+	err = utils.VerifySignature(publicKey, nonce, signature)
+	if err != nil {
+		return &models.ErrorMessage{
+			Error:  "Invalid signature",
+			Code:   models.CodeInvalidSignature,
+			Detail: err.Error(),
 		}
 	}
 	return nil
 }
 
+// addChat registers the session of chat. When the device is connected
+// already the session policy decides whether chat is refused, replaces the
+// other sessions of the device or is kept next to them. The subscribers of
+// the user are told when its first device connects to any node. Chats are
+// refused once shutdown started.
+func (w *WebsocketAPI) addChat(chat *Chat) *models.ErrorMessage {
+	w.mu.Lock()
+	if w.closing {
+		w.mu.Unlock()
+		return &models.ErrorMessage{Error: "Server is shutting down", Code: models.CodeShuttingDown}
+	}
+
+	var chats, replaced []*Chat
+	coexisting := false
+	for _, other := range w.chats[chat.user] {
+		if other.device != chat.device {
+			chats = append(chats, other)
+			continue
+		}
+
+		switch w.sessionPolicy {
+		case SessionPolicyReplace:
+			replaced = append(replaced, other)
+		case SessionPolicyCoexist:
+			chats = append(chats, other)
+			coexisting = true
+		default:
+			w.mu.Unlock()
+			w.emit(SessionRejected, chat)
+			return &models.ErrorMessage{
+				Error: "Device connected from another location",
+				Code:  models.CodeDeviceConnected,
+			}
+		}
+	}
+	w.chats[chat.user] = append(chats, chat)
+	w.mu.Unlock()
+
+	// the replaced sessions end like any other disconnect, they are no
+	// longer registered so removing them leaves chat alone
+	for _, other := range replaced {
+		go other.connection.Close(StatusSessionReplaced, "replaced by a new connection")
+		w.emit(SessionReplaced, chat)
+	}
+	if coexisting {
+		w.emit(SessionCoexisting, chat)
+	}
+
+	w.syncPresence(chat.user)
+	return nil
+}
+
+// removeChat unregisters the session of chat together with its
+// subscriptions. The subscribers of the user are told when its last device
+// disconnects from every node.
+func (w *WebsocketAPI) removeChat(chat *Chat) {
+	w.mu.Lock()
+	var chats []*Chat
+	for _, other := range w.chats[chat.user] {
+		if other != chat {
+			chats = append(chats, other)
+		}
+	}
+
+	if len(chats) == 0 {
+		delete(w.chats, chat.user)
+	} else {
+		w.chats[chat.user] = chats
+	}
+
+	for user := range chat.subscriptions {
+		w.unsubscribe(chat, user)
+	}
+	w.mu.Unlock()
+
+	w.syncPresence(chat.user)
+}
+
+// subscribersOf returns the sessions subscribed to user, w.mu must be held.
+func (w *WebsocketAPI) subscribersOf(user string) []*Chat {
+	var subscribers []*Chat
+	for subscriber := range w.subscribers[user] {
+		subscribers = append(subscribers, subscriber)
+	}
+	return subscribers
+}
+
+// unsubscribe removes the subscription of chat to user, w.mu must be held.
+func (w *WebsocketAPI) unsubscribe(chat *Chat, user string) {
+	delete(chat.subscriptions, user)
+	delete(w.subscribers[user], chat)
+	if len(w.subscribers[user]) == 0 {
+		delete(w.subscribers, user)
+	}
+}
+
+// notify sends frame to every connected device of user, on any node.
+func (w *WebsocketAPI) notify(ctx context.Context, user string, frame interface{}) {
+	w.notifyLocal(user, frame)
+	w.publishFrame(ctx, user, frame)
+}
+
+// notifyLocal sends frame to the devices of user connected to this node.
+func (w *WebsocketAPI) notifyLocal(user string, frame interface{}) {
+	for _, session := range w.sessions(user) {
+		session.sendJSON(context.Background(), frame)
+	}
+}
+
+// checkPreKeys asks the user to upload more one-time prekeys when it is
+// running out of them, users without prekeys are not asked.
+func (w *WebsocketAPI) checkPreKeys(ctx context.Context, chat *Chat) {
+	if _, err := w.db.GetSignedPreKey(chat.user); err != nil {
+		return
+	}
+
+	count, err := w.db.CountOneTimePreKeys(chat.user)
+	if err == nil && count < lowPreKeyThreshold {
+		chat.sendJSON(ctx, models.PreKeyCount{Type: models.FramePreKeysLow, Count: count})
+	}
+}
+
+func notifyPresence(subscribers []*Chat, user string, presence string) {
+	for _, subscriber := range subscribers {
+		subscriber.sendJSON(context.Background(), models.Presence{Type: presence, User: user})
+	}
+}
+
+// sessions returns the connected devices of user.
+func (w *WebsocketAPI) sessions(user string) []*Chat {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return append([]*Chat(nil), w.chats[user]...)
+}
+
+// disconnect closes every session of user on any node, they end like any
+// other disconnect. It does not wait for the clients to confirm the close.
+func (w *WebsocketAPI) disconnect(user string, reason string) {
+	w.disconnectLocal(user, reason)
+	w.publish(context.Background(), bus.Event{Type: bus.EventDisconnect, User: user, Reason: reason})
+}
+
+// disconnectLocal closes the sessions of user on this node.
+func (w *WebsocketAPI) disconnectLocal(user string, reason string) {
+	for _, session := range w.sessions(user) {
+		if session.connection != nil {
+			go session.connection.Close(websocket.StatusNormalClosure, reason)
+		}
+	}
+}
+
 func (w *WebsocketAPI) Register(r *httprouter.Router) {
-	r.GET("/ws/:id", w.handleWebsocket)
+	r.GET("/ws/:id", w.track(w.tokens.websocket(w.handleWebsocket)))
 }
 
 func (w *WebsocketAPI) handleWebsocket(wr http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	id := ps.ByName("id")
+	id := w.userIDs.Normalize(ps.ByName("id"))
+	device := r.URL.Query().Get("device")
+	if device == "" {
+		device = models.PrimaryDevice
+	}
 
+	// clients passing the token as subprotocol expect it to be accepted
 	conn, err := websocket.Accept(wr, r, &websocket.AcceptOptions{
 		OriginPatterns: []string{"*"},
+		Subprotocols:   []string{tokenSubprotocol},
 	})
 
 	if err != nil {
@@ -73,69 +378,478 @@ func (w *WebsocketAPI) handleWebsocket(wr http.ResponseWriter, r *http.Request,
 	}
 	defer conn.Close(websocket.StatusInvalidFramePayloadData, "Internal Error")
 
-	ctx := context.Background()
-	chat := Chat{connection: conn}
+	ctx := w.ctx
+	chat := newChat(id, device, conn, w.outboundQueueSize)
+	go w.writeLoop(chat)
+	// the frames queued last, like errors, are written before closing
+	defer chat.flush(w.stallTimeout)
 	if !w.db.IsUserExists(id) {
-		chat.sendJSON(ctx, models.ErrorMessage{
+		chat.sendError(ctx, models.ErrorMessage{
 			Error: "User not found",
+			Code:  models.CodeUserNotFound,
 		})
 		return
 	}
 
-	// if user already connected, close the connection
-	w.mu.Lock()
-	if _, ok := w.chats[id]; ok {
-		chat.sendJSON(ctx, models.ErrorMessage{
-			Error: "User connected from another location",
-		})
+	// the session is only registered once the client proves it owns the key
+	if authErr := w.authenticate(ctx, chat); authErr != nil {
+		chat.sendError(ctx, *authErr)
 		return
-	} else {
-		w.chats[id] = chat
 	}
-	w.mu.Unlock()
 
-	defer func() {
-		w.mu.Lock()
-		delete(w.chats, id)
-		w.mu.Unlock()
-	}()
+	chat.deferStored()
+	if addErr := w.addChat(chat); addErr != nil {
+		chat.sendError(ctx, *addErr)
+		return
+	}
+	defer w.removeChat(chat)
 
-	pendingMessages, _ := w.db.GetPendingMessages(id)
-	err = chat.sendPendingMessages(pendingMessages)
+	chat.sendJSON(ctx, models.Authenticated{Type: models.FrameAuthenticated, User: id, Device: device})
+	w.db.UpdateActivity(id)
 
-	if err == nil {
-		w.db.DeletePendingMessages(id)
-	}
+	// messages stay pending until acknowledged, so everything that was not
+	// acknowledged during a previous session is delivered again, before the
+	// messages which arrived since the session was registered
+	pendingMessages, _ := w.db.GetPendingMessages(id, device)
+	chat.sendPending(pendingMessages)
+	w.checkPreKeys(ctx, chat)
+
+	// reading stops when the keepalive finds the peer dead
+	readCtx, reap := context.WithCancel(ctx)
+	defer reap()
+	seen := w.keepalive(readCtx, reap, chat)
 
 	for {
-		_, msg, err := conn.Read(ctx)
+		_, msg, err := conn.Read(readCtx)
 		if err != nil {
 			break
 		}
+		seen()
+		w.db.UpdateActivity(id)
 
-		var message models.TransmissionData
-		err = json.Unmarshal(msg, &message)
+		var frame models.Frame
+		err = json.Unmarshal(msg, &frame)
 		if err != nil {
-			chat.sendJSON(ctx, models.ErrorMessage{
+			chat.sendError(ctx, models.ErrorMessage{
 				Error: "Invalid message format",
+				Code:  models.CodeInvalidMessage,
 			})
 			continue
 		}
 
-		w.mu.Lock()
-		receiverConn, connected := w.chats[message.To]
-		w.mu.Unlock()
+		switch frame.Type {
+		case models.FrameAck:
+			w.handleAck(ctx, chat, msg)
+		case "", models.FrameMessage:
+			w.handleMessage(ctx, chat, msg)
+		case models.FrameRead:
+			w.handleRead(ctx, chat, msg)
+		case models.FrameSubscribe, models.FrameUnsubscribe:
+			w.handleSubscribe(ctx, chat, msg)
+		case models.FrameTyping:
+			w.handleTyping(ctx, chat, msg)
+		default:
+			chat.sendError(ctx, models.ErrorMessage{
+				Error:  "Invalid message format",
+				Code:   models.CodeInvalidMessage,
+				Detail: "unknown frame type " + frame.Type,
+			})
+		}
+	}
+}
+
+func (w *WebsocketAPI) handleAck(ctx context.Context, chat *Chat, msg []byte) {
+	var ack models.Ack
+	err := json.Unmarshal(msg, &ack)
+	if err != nil || ack.ID == 0 {
+		chat.sendError(ctx, models.ErrorMessage{
+			Error: "Invalid message format",
+			Code:  models.CodeInvalidMessage,
+		})
+		return
+	}
+
+	w.db.DeletePendingMessage(chat.user, chat.device, ack.ID)
+	chat.acknowledged(ack.ID)
+}
+
+func (w *WebsocketAPI) handleMessage(ctx context.Context, chat *Chat, msg []byte) {
+	var message models.TransmissionData
+	err := json.Unmarshal(msg, &message)
+	if err != nil {
+		chat.sendError(ctx, models.ErrorMessage{
+			Error: "Invalid message format",
+			Code:  models.CodeInvalidMessage,
+		})
+		return
+	}
+
+	if !w.checkSender(ctx, chat, message.From) {
+		return
+	}
+	message.From = chat.user
+	message.To = w.userIDs.Normalize(message.To)
+
+	if w.db.IsUserExists(message.To) {
+		if mailboxErr := w.checkMailbox(message.To, message.Payload); mailboxErr != nil {
+			chat.sendError(ctx, *mailboxErr)
+			return
+		}
+
+		message.Type = models.FrameMessage
+		w.send(ctx, chat, message)
+		return
+	}
+
+	group, err := w.db.GetGroup(message.To)
+	if err != nil {
+		chat.sendError(ctx, models.ErrorMessage{
+			Error: "User not found",
+			Code:  models.CodeUserNotFound,
+		})
+		return
+	}
+	w.handleGroupMessage(ctx, chat, group, msg)
+}
+
+// checkSender makes sure a frame claims to come from the authenticated user
+// of chat, frames without a sender are sent as that user. Anything else is
+// an attempt to impersonate someone, it is rejected and logged.
+func (w *WebsocketAPI) checkSender(ctx context.Context, chat *Chat, from string) bool {
+	if from == "" || w.userIDs.Normalize(from) == chat.user {
+		return true
+	}
+
+	log.Printf("Abuse: user %s on device %s tried to send as %s\n", chat.user, chat.device, from)
+	chat.sendError(ctx, models.ErrorMessage{
+		Error:  "Sender mismatch",
+		Code:   models.CodeSenderMismatch,
+		Detail: "from must be " + chat.user,
+	})
+	return false
+}
+
+// handleGroupMessage fans out a message sent to group, every member gets the
+// payload encrypted for it.
+func (w *WebsocketAPI) handleGroupMessage(ctx context.Context, chat *Chat, group models.Group, msg []byte) {
+	var message models.GroupMessage
+	err := json.Unmarshal(msg, &message)
+	if err != nil {
+		chat.sendError(ctx, models.ErrorMessage{
+			Error: "Invalid message format",
+			Code:  models.CodeInvalidMessage,
+		})
+		return
+	}
+
+	isMember := false
+	var missing []string
+	for _, member := range group.Members {
+		if member == chat.user {
+			isMember = true
+		} else if _, ok := message.Payloads[member]; !ok {
+			missing = append(missing, member)
+		}
+	}
+
+	if !isMember {
+		chat.sendError(ctx, models.ErrorMessage{
+			Error: "Not a member of the group",
+			Code:  models.CodeNotGroupMember,
+		})
+		return
+	}
+
+	// nothing is sent unless every member can read the message
+	if len(missing) > 0 {
+		chat.sendError(ctx, models.ErrorMessage{
+			Error:  "Missing payload",
+			Code:   models.CodeMissingPayload,
+			Detail: "no payload for " + strings.Join(missing, ", "),
+		})
+		return
+	}
 
-		if connected {
-			receiverConn.SendMessage(ctx, message)
-		} else {
-			if w.db.IsUserExists(message.To) {
-				w.db.SavePendingMessage(message)
-			} else {
-				chat.sendJSON(ctx, models.ErrorMessage{
-					Error: "User not found",
-				})
+	for _, member := range group.Members {
+		if member == chat.user {
+			continue
+		}
+		if mailboxErr := w.checkMailbox(member, message.Payloads[member]); mailboxErr != nil {
+			chat.sendError(ctx, *mailboxErr)
+			return
+		}
+	}
+
+	for _, member := range group.Members {
+		if member == chat.user {
+			continue
+		}
+		w.send(ctx, chat, models.TransmissionData{
+			Type:    models.FrameMessage,
+			From:    chat.user,
+			To:      member,
+			Group:   group.ID,
+			Payload: message.Payloads[member],
+		})
+	}
+}
+
+// checkMailbox makes sure the pending messages of user stay within the
+// limits once payload is added.
+func (w *WebsocketAPI) checkMailbox(user string, payload string) *models.ErrorMessage {
+	count, size, err := w.db.PendingStats(user)
+	if err != nil {
+		return &models.ErrorMessage{
+			Error:  "Internal Server Error",
+			Code:   models.CodeInternalError,
+			Detail: err.Error(),
+		}
+	}
+
+	if count >= w.mailboxMaxMessages || size+int64(len(payload)) > w.mailboxMaxBytes {
+		return &models.ErrorMessage{
+			Error:  "Recipient mailbox full",
+			Code:   models.CodeMailboxFull,
+			Detail: "mailbox of " + user + " is full",
+		}
+	}
+	return nil
+}
+
+// send routes a message from chat and confirms it with a sent receipt
+// carrying the id of the message.
+func (w *WebsocketAPI) send(ctx context.Context, chat *Chat, message models.TransmissionData) {
+	var err error
+	message.ID, err = w.db.SavePendingMessage(message)
+	if err != nil {
+		chat.sendError(ctx, models.ErrorMessage{
+			Error:  "Internal Server Error",
+			Code:   models.CodeInternalError,
+			Detail: err.Error(),
+		})
+		return
+	}
+
+	chat.SendMessage(ctx, models.TransmissionData{
+		Type:  models.FrameSent,
+		From:  message.From,
+		To:    message.To,
+		Group: message.Group,
+		Ref:   message.ID,
+	})
+
+	// the sender knows the id before any delivered receipt arrives
+	w.deliver(ctx, message)
+}
+
+// handleRead routes a read receipt back to the sender of the message.
+func (w *WebsocketAPI) handleRead(ctx context.Context, chat *Chat, msg []byte) {
+	var receipt models.TransmissionData
+	err := json.Unmarshal(msg, &receipt)
+	if err != nil || receipt.Ref == 0 {
+		chat.sendError(ctx, models.ErrorMessage{
+			Error: "Invalid message format",
+			Code:  models.CodeInvalidMessage,
+		})
+		return
+	}
+	if !w.checkSender(ctx, chat, receipt.From) {
+		return
+	}
+	receipt.To = w.userIDs.Normalize(receipt.To)
+
+	if !w.db.IsUserExists(receipt.To) {
+		chat.sendError(ctx, models.ErrorMessage{
+			Error: "User not found",
+			Code:  models.CodeUserNotFound,
+		})
+		return
+	}
+
+	if mailboxErr := w.checkMailbox(receipt.To, ""); mailboxErr != nil {
+		chat.sendError(ctx, *mailboxErr)
+		return
+	}
+
+	_, err = w.route(ctx, models.TransmissionData{
+		Type:  models.FrameRead,
+		From:  chat.user,
+		To:    receipt.To,
+		Group: receipt.Group,
+		Ref:   receipt.Ref,
+	})
+	if err != nil {
+		chat.sendError(ctx, models.ErrorMessage{
+			Error:  "Internal Server Error",
+			Code:   models.CodeInternalError,
+			Detail: err.Error(),
+		})
+	}
+}
+
+// handleSubscribe changes the presence subscriptions of chat, the current
+// presence of every newly subscribed user is sent right away.
+func (w *WebsocketAPI) handleSubscribe(ctx context.Context, chat *Chat, msg []byte) {
+	var subscribe models.Subscribe
+	err := json.Unmarshal(msg, &subscribe)
+	if err != nil {
+		chat.sendError(ctx, models.ErrorMessage{
+			Error: "Invalid message format",
+			Code:  models.CodeInvalidMessage,
+		})
+		return
+	}
+
+	var presences []models.Presence
+	w.mu.Lock()
+	for _, user := range subscribe.Users {
+		user = w.userIDs.Normalize(user)
+		if subscribe.Type == models.FrameUnsubscribe {
+			w.unsubscribe(chat, user)
+			continue
+		}
+		if chat.subscriptions[user] || len(chat.subscriptions) >= maxSubscriptions {
+			continue
+		}
+
+		if chat.subscriptions == nil {
+			chat.subscriptions = make(map[string]bool)
+		}
+		chat.subscriptions[user] = true
+		if w.subscribers[user] == nil {
+			w.subscribers[user] = make(map[*Chat]bool)
+		}
+		w.subscribers[user][chat] = true
+
+		presence := models.Presence{Type: models.FrameOffline, User: user}
+		if len(w.chats[user]) > 0 {
+			presence.Type = models.FrameOnline
+		}
+		presences = append(presences, presence)
+	}
+	w.mu.Unlock()
+
+	for _, presence := range presences {
+		// the user can be connected to another node
+		if presence.Type == models.FrameOffline {
+			if online, _ := w.bus.Online(ctx, presence.User); online {
+				presence.Type = models.FrameOnline
 			}
 		}
+		chat.sendJSON(ctx, presence)
+	}
+}
+
+// handleTyping relays a typing indicator to the connected devices of the
+// receiver, or of every other member when sent to a group. Typing
+// indicators are never stored.
+func (w *WebsocketAPI) handleTyping(ctx context.Context, chat *Chat, msg []byte) {
+	var typing models.TransmissionData
+	err := json.Unmarshal(msg, &typing)
+	if err != nil || typing.To == "" {
+		chat.sendError(ctx, models.ErrorMessage{
+			Error: "Invalid message format",
+			Code:  models.CodeInvalidMessage,
+		})
+		return
+	}
+	if !w.checkSender(ctx, chat, typing.From) {
+		return
+	}
+
+	typing.To = w.userIDs.Normalize(typing.To)
+	receivers := []string{typing.To}
+	if !w.db.IsUserExists(typing.To) {
+		group, err := w.db.GetGroup(typing.To)
+		if err != nil || !isMember(group, chat.user) {
+			return
+		}
+		typing.Group = group.ID
+		receivers = group.Members
+	}
+
+	for _, receiver := range receivers {
+		if receiver == chat.user && typing.Group != "" {
+			continue
+		}
+		w.notify(ctx, receiver, models.TransmissionData{
+			Type:  models.FrameTyping,
+			From:  chat.user,
+			To:    receiver,
+			Group: typing.Group,
+		})
+	}
+}
+
+func isMember(group models.Group, user string) bool {
+	for _, member := range group.Members {
+		if member == user {
+			return true
+		}
+	}
+	return false
+}
+
+// delivered sends a delivered receipt for message to its sender once it was
+// written to device, receipts themselves are not confirmed. The sender gets
+// one receipt per device, not one for every time the message is sent again.
+func (w *WebsocketAPI) delivered(ctx context.Context, device string, message models.TransmissionData) {
+	if message.Type != "" && message.Type != models.FrameMessage {
+		return
+	}
+	if !w.db.IsUserExists(message.From) {
+		return
+	}
+
+	first, err := w.db.MarkDelivered(message.To, device, message.ID)
+	if err != nil {
+		log.Printf("Failed to mark message %d as delivered to device %s: %v\n", message.ID, device, err)
+		return
+	}
+	if !first {
+		return
+	}
+
+	_, err = w.route(ctx, models.TransmissionData{
+		Type:  models.FrameDelivered,
+		From:  message.To,
+		To:    message.From,
+		Group: message.Group,
+		Ref:   message.ID,
+	})
+	if err != nil {
+		log.Printf("Failed to send delivered receipt for message %d: %v\n", message.ID, err)
+	}
+}
+
+// route stores message and delivers it to the connected devices of the
+// receiver, it returns the id assigned to the message.
+func (w *WebsocketAPI) route(ctx context.Context, message models.TransmissionData) (int64, error) {
+	var err error
+
+	// every message is stored before it is delivered, the receiver either
+	// gets it live or loads it with its pending messages when connecting
+	message.ID, err = w.db.SavePendingMessage(message)
+	if err != nil {
+		return 0, err
+	}
+
+	w.deliver(ctx, message)
+	return message.ID, nil
+}
+
+// deliver queues a stored message for the connected devices of the
+// receiver on any node, devices which cannot keep up get it with their
+// pending messages.
+func (w *WebsocketAPI) deliver(ctx context.Context, message models.TransmissionData) {
+	w.deliverLocal(message)
+	w.publish(ctx, bus.Event{Type: bus.EventMessage, User: message.To, Message: &message})
+}
+
+// deliverLocal queues a stored message for the devices of the receiver
+// connected to this node.
+func (w *WebsocketAPI) deliverLocal(message models.TransmissionData) {
+	for _, receiver := range w.sessions(message.To) {
+		receiver.sendStored(message)
 	}
 }
@@ -2,21 +2,36 @@ package api
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"testing"
 	"time"
 
+	"enigma-protocol-go/pkg/db"
 	"enigma-protocol-go/pkg/models"
 
 	"nhooyr.io/websocket"
 )
 
-func createUser(t *testing.T, router http.Handler, publicKey string) string {
+type testUser struct {
+	id         string
+	device     string
+	privateKey ed25519.PrivateKey
+	// token is an access token of the user
+	token string
+}
+
+func login(t *testing.T, router http.Handler, publicKey string) models.LoginResponse {
 	req, _ := http.NewRequest("GET", "/login/"+publicKey, nil)
 	rr := httptest.NewRecorder()
 
@@ -30,45 +45,132 @@ func createUser(t *testing.T, router http.Handler, publicKey string) string {
 	if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
-	return res.User
+	return res
 }
 
-func TestConnectInvalidUser(t *testing.T) {
-	router := setup()
-	defer cleanup()
-
-	s := httptest.NewServer(router)
-	wsEndpoint := "ws" + s.URL[4:] + "/ws/"
+func createUser(t *testing.T, router http.Handler) testUser {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-	defer cancel()
+	res := login(t, router, base64.RawURLEncoding.EncodeToString(publicKey))
+	return testUser{id: res.User, device: models.PrimaryDevice, privateKey: privateKey, token: res.AccessToken}
+}
 
-	c, _, err := websocket.Dial(ctx, wsEndpoint+"random-user", nil)
+// registerDevice adds a new device to user, signed by its primary device.
+func registerDevice(t *testing.T, router http.Handler, user testUser) testUser {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
 	if err != nil {
-		log.Fatalf("failed to dial: %v", err)
+		t.Fatalf("Expected no error, got %v", err)
 	}
 
+	req := signedRequest(t, "POST", "/users/"+user.id+"/devices", models.RegisterDeviceRequest{
+		SignedRequest: models.SignedRequest{Timestamp: time.Now().Unix()},
+		PublicKey:     base64.StdEncoding.EncodeToString(publicKey),
+	}, user.privateKey)
+	rr := httptest.NewRecorder()
+
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Expected status %v, but got %v", http.StatusOK, status)
+	}
+
+	var res models.DeviceResponse
+	if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return testUser{id: user.id, device: res.Device, privateKey: privateKey, token: user.token}
+}
+
+// answerChallenge reads the login challenge from c and signs it with sign.
+func answerChallenge(t *testing.T, ctx context.Context, c *websocket.Conn, sign func([]byte) []byte) {
 	_, msg, err := c.Read(ctx)
 	if err != nil {
-		t.Errorf("Expected no error, got %v", err)
+		t.Fatalf("Expected no error, got %v", err)
 	}
 
-	var error models.ErrorMessage
-	err = json.Unmarshal(msg, &error)
+	var challenge models.Challenge
+	err = json.Unmarshal(msg, &challenge)
+	if err != nil || challenge.Type != models.FrameChallenge {
+		t.Fatalf("Expected challenge, got %s", msg)
+	}
+
+	nonce, err := base64.RawURLEncoding.DecodeString(challenge.Nonce)
 	if err != nil {
-		t.Errorf("Expected no error, got %v", err)
+		t.Fatalf("Expected no error, got %v", err)
 	}
 
-	if error.Error != "User not found" {
-		t.Errorf("Expected User not found, got %v", error.Error)
+	data, _ := json.Marshal(models.ChallengeResponse{
+		Type:      models.FrameChallengeResponse,
+		Signature: base64.RawURLEncoding.EncodeToString(sign(nonce)),
+	})
+	err = c.Write(ctx, websocket.MessageText, data)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
 	}
 }
 
-func TestSendToInvalidUser(t *testing.T) {
+// dial opens a websocket to url with the access token as bearer token.
+func dial(t *testing.T, ctx context.Context, url string, token string) *websocket.Conn {
+	c, _, err := websocket.Dial(ctx, url, &websocket.DialOptions{
+		HTTPHeader: http.Header{"Authorization": []string{"Bearer " + token}},
+	})
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	return c
+}
+
+func dialUser(t *testing.T, ctx context.Context, wsEndpoint string, user testUser) *websocket.Conn {
+	c := dial(t, ctx, wsEndpoint+user.id+"?device="+user.device, user.token)
+
+	answerChallenge(t, ctx, c, func(nonce []byte) []byte {
+		return ed25519.Sign(user.privateKey, nonce)
+	})
+	readAuthenticated(t, ctx, c)
+	return c
+}
+
+// closeDevice closes c and waits until the server removed the session of the
+// device of user, so the device can connect again right away.
+func closeDevice(t *testing.T, ctx context.Context, router http.Handler, c *websocket.Conn, user testUser) {
+	c.Close(websocket.StatusNormalClosure, "")
+
+	websockets := router.(*Server).websockets
+	for connected := true; connected; {
+		connected = false
+		for _, chat := range websockets.sessions(user.id) {
+			connected = connected || chat.device == user.device
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("Expected the session of device %s to end", user.device)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func readAuthenticated(t *testing.T, ctx context.Context, c *websocket.Conn) {
+	_, msg, err := c.Read(ctx)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var authenticated models.Authenticated
+	err = json.Unmarshal(msg, &authenticated)
+	if err != nil || authenticated.Type != models.FrameAuthenticated {
+		t.Fatalf("Expected authenticated, got %s", msg)
+	}
+}
+
+func TestConnectInvalidUser(t *testing.T) {
 	router := setup()
 	defer cleanup()
 
-	user1 := createUser(t, router, "key1")
+	// the access token is no longer accepted once the user is deleted
+	user1 := createUser(t, router)
+	deleteUser(t, router, user1, models.DeleteUserRequest{Delete: user1.id})
 
 	s := httptest.NewServer(router)
 	wsEndpoint := "ws" + s.URL[4:] + "/ws/"
@@ -76,25 +178,42 @@ func TestSendToInvalidUser(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
 
-	c, _, err := websocket.Dial(ctx, wsEndpoint+user1, nil)
-	if err != nil {
-		log.Fatalf("failed to dial: %v", err)
+	_, res, err := websocket.Dial(ctx, wsEndpoint+user1.id, &websocket.DialOptions{
+		HTTPHeader: http.Header{"Authorization": []string{"Bearer " + user1.token}},
+	})
+	if err == nil {
+		t.Fatalf("Expected the connection to be refused")
+	}
+	if res == nil || res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status %v, got %v", http.StatusUnauthorized, res)
 	}
+}
+
+func TestSendToInvalidUser(t *testing.T) {
+	router := setup()
+	defer cleanup()
+
+	user1 := createUser(t, router)
+
+	s := httptest.NewServer(router)
+	wsEndpoint := "ws" + s.URL[4:] + "/ws/"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	c := dialUser(t, ctx, wsEndpoint, user1)
 
 	data, _ := json.Marshal(models.TransmissionData{
-		From:    user1,
+		From:    user1.id,
 		To:      "random-user-new",
 		Payload: "Hello User",
 	})
-	err = c.Write(ctx, websocket.MessageText, data)
+	err := c.Write(ctx, websocket.MessageText, data)
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
 
-	_, msg, err := c.Read(ctx)
-	if err != nil {
-		t.Errorf("Expected no error, got %v", err)
-	}
+	msg := readFrame(t, ctx, c, models.FrameError)
 
 	var error models.ErrorMessage
 	err = json.Unmarshal(msg, &error)
@@ -111,8 +230,8 @@ func TestSyncCommunication(t *testing.T) {
 	router := setup()
 	defer cleanup()
 
-	user1 := createUser(t, router, "key1")
-	user2 := createUser(t, router, "key2")
+	user1 := createUser(t, router)
+	user2 := createUser(t, router)
 
 	s := httptest.NewServer(router)
 	wsEndpoint := "ws" + s.URL[4:] + "/ws/"
@@ -121,34 +240,26 @@ func TestSyncCommunication(t *testing.T) {
 	defer cancel()
 
 	// Connect user1
-	c1, _, err := websocket.Dial(ctx, wsEndpoint+user1, nil)
-	if err != nil {
-		log.Fatalf("failed to dial: %v", err)
-	}
+	c1 := dialUser(t, ctx, wsEndpoint, user1)
 
 	// Connect user2
-	c2, _, err := websocket.Dial(ctx, wsEndpoint+user2, nil)
-	if err != nil {
-		log.Fatalf("failed to dial: %v", err)
-	}
+	c2 := dialUser(t, ctx, wsEndpoint, user2)
 
 	// Send message from user1 to user2
 	data := models.TransmissionData{
-		From:    user1,
-		To:      user2,
+		Type:    models.FrameMessage,
+		From:    user1.id,
+		To:      user2.id,
 		Payload: "Hello User",
 	}
 	jsonData, _ := json.Marshal(data)
-	err = c1.Write(ctx, websocket.MessageText, jsonData)
+	err := c1.Write(ctx, websocket.MessageText, jsonData)
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
 
 	// Read message from user1 using user2 connection
-	_, msg, err := c2.Read(ctx)
-	if err != nil {
-		t.Errorf("Expected no error, got %v", err)
-	}
+	msg := readFrame(t, ctx, c2, models.FrameMessage)
 
 	var response1 models.TransmissionData
 	err = json.Unmarshal(msg, &response1)
@@ -157,14 +268,20 @@ func TestSyncCommunication(t *testing.T) {
 	}
 
 	// Check if the message is received correctly
+	if response1.ID == 0 {
+		t.Errorf("Expected message id to be assigned")
+	}
+	data.ID = response1.ID
+
 	if !reflect.DeepEqual(response1, data) {
 		t.Errorf("Expected %v, got %v", data, response1)
 	}
 
 	// Send message from user2 to user1
 	data = models.TransmissionData{
-		From:    user2,
-		To:      user1,
+		Type:    models.FrameMessage,
+		From:    user2.id,
+		To:      user1.id,
 		Payload: "Hello Another User",
 	}
 	jsonData, _ = json.Marshal(data)
@@ -174,10 +291,7 @@ func TestSyncCommunication(t *testing.T) {
 	}
 
 	// Read message from user2 using user1 connection
-	_, msg, err = c1.Read(ctx)
-	if err != nil {
-		t.Errorf("Expected no error, got %v", err)
-	}
+	msg = readFrame(t, ctx, c1, models.FrameMessage)
 
 	var response2 models.TransmissionData
 	err = json.Unmarshal(msg, &response2)
@@ -186,6 +300,11 @@ func TestSyncCommunication(t *testing.T) {
 	}
 
 	// Check if the message is received correctly
+	if response2.ID == 0 {
+		t.Errorf("Expected message id to be assigned")
+	}
+	data.ID = response2.ID
+
 	if !reflect.DeepEqual(response2, data) {
 		t.Errorf("Expected %v, got %v", data, response2)
 	}
@@ -195,8 +314,8 @@ func TestAsyncCommunication(t *testing.T) {
 	router := setup()
 	defer cleanup()
 
-	user1 := createUser(t, router, "key1")
-	user2 := createUser(t, router, "key2")
+	user1 := createUser(t, router)
+	user2 := createUser(t, router)
 
 	s := httptest.NewServer(router)
 	wsEndpoint := "ws" + s.URL[4:] + "/ws/"
@@ -204,31 +323,23 @@ func TestAsyncCommunication(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
 
-	c1, _, err := websocket.Dial(ctx, wsEndpoint+user1, nil)
-	if err != nil {
-		log.Fatalf("failed to dial: %v", err)
-	}
+	c1 := dialUser(t, ctx, wsEndpoint, user1)
 
-	c2, _, err := websocket.Dial(ctx, wsEndpoint+user2, nil)
-	if err != nil {
-		log.Fatalf("failed to dial: %v", err)
-	}
+	c2 := dialUser(t, ctx, wsEndpoint, user2)
 
 	data := models.TransmissionData{
-		From:    user1,
-		To:      user2,
+		Type:    models.FrameMessage,
+		From:    user1.id,
+		To:      user2.id,
 		Payload: "Hello User",
 	}
 	jsonData, _ := json.Marshal(data)
-	err = c1.Write(ctx, websocket.MessageText, jsonData)
+	err := c1.Write(ctx, websocket.MessageText, jsonData)
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
 
-	_, msg, err := c2.Read(ctx)
-	if err != nil {
-		t.Errorf("Expected no error, got %v", err)
-	}
+	msg := readFrame(t, ctx, c2, models.FrameMessage)
 
 	var response1 models.TransmissionData
 	err = json.Unmarshal(msg, &response1)
@@ -236,13 +347,19 @@ func TestAsyncCommunication(t *testing.T) {
 		t.Errorf("Expected no error, got %v", err)
 	}
 
+	if response1.ID == 0 {
+		t.Errorf("Expected message id to be assigned")
+	}
+	data.ID = response1.ID
+
 	if !reflect.DeepEqual(response1, data) {
 		t.Errorf("Expected %v, got %v", data, response1)
 	}
 
 	data = models.TransmissionData{
-		From:    user2,
-		To:      user1,
+		Type:    models.FrameMessage,
+		From:    user2.id,
+		To:      user1.id,
 		Payload: "Hello Another User",
 	}
 	jsonData, _ = json.Marshal(data)
@@ -251,10 +368,7 @@ func TestAsyncCommunication(t *testing.T) {
 		t.Errorf("Expected no error, got %v", err)
 	}
 
-	_, msg, err = c1.Read(ctx)
-	if err != nil {
-		t.Errorf("Expected no error, got %v", err)
-	}
+	msg = readFrame(t, ctx, c1, models.FrameMessage)
 
 	var response2 models.TransmissionData
 	err = json.Unmarshal(msg, &response2)
@@ -262,6 +376,11 @@ func TestAsyncCommunication(t *testing.T) {
 		t.Errorf("Expected no error, got %v", err)
 	}
 
+	if response2.ID == 0 {
+		t.Errorf("Expected message id to be assigned")
+	}
+	data.ID = response2.ID
+
 	if !reflect.DeepEqual(response2, data) {
 		t.Errorf("Expected %v, got %v", data, response2)
 	}
@@ -271,8 +390,8 @@ func TestPendingMessages(t *testing.T) {
 	router := setup()
 	defer cleanup()
 
-	user1 := createUser(t, router, "key1")
-	user2 := createUser(t, router, "key2")
+	user1 := createUser(t, router)
+	user2 := createUser(t, router)
 
 	s := httptest.NewServer(router)
 	wsEndpoint := "ws" + s.URL[4:] + "/ws/"
@@ -280,32 +399,24 @@ func TestPendingMessages(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
 
-	c1, _, err := websocket.Dial(ctx, wsEndpoint+user1, nil)
-	if err != nil {
-		log.Fatalf("failed to dial: %v", err)
-	}
+	c1 := dialUser(t, ctx, wsEndpoint, user1)
 
 	data := models.TransmissionData{
-		From:    user1,
-		To:      user2,
+		Type:    models.FrameMessage,
+		From:    user1.id,
+		To:      user2.id,
 		Payload: "Hello User",
 	}
 	jsonData, _ := json.Marshal(data)
-	err = c1.Write(ctx, websocket.MessageText, jsonData)
+	err := c1.Write(ctx, websocket.MessageText, jsonData)
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
 
 	// time.Sleep(100 * time.Millisecond)
-	c2, _, err := websocket.Dial(ctx, wsEndpoint+user2, nil)
-	if err != nil {
-		log.Fatalf("failed to dial: %v", err)
-	}
+	c2 := dialUser(t, ctx, wsEndpoint, user2)
 
-	_, msg, err := c2.Read(ctx)
-	if err != nil {
-		t.Errorf("Expected no error, got %v", err)
-	}
+	msg := readFrame(t, ctx, c2, models.FrameMessage)
 
 	var response1 models.TransmissionData
 	err = json.Unmarshal(msg, &response1)
@@ -313,13 +424,20 @@ func TestPendingMessages(t *testing.T) {
 		t.Errorf("Expected no error, got %v", err)
 	}
 
+	if response1.ID == 0 {
+		t.Errorf("Expected message id to be assigned")
+	}
+	data.ID = response1.ID
+
 	if !reflect.DeepEqual(response1, data) {
 		t.Errorf("Expected %v, got %v", data, response1)
 	}
+	ackMessage(t, ctx, c2, response1.ID)
 
 	data = models.TransmissionData{
-		From:    user2,
-		To:      user1,
+		Type:    models.FrameMessage,
+		From:    user2.id,
+		To:      user1.id,
 		Payload: "Hello Another User",
 	}
 	jsonData, _ = json.Marshal(data)
@@ -328,12 +446,9 @@ func TestPendingMessages(t *testing.T) {
 		t.Errorf("Expected no error, got %v", err)
 	}
 
-	c2.Close(websocket.StatusNormalClosure, "")
+	closeDevice(t, ctx, router, c2, user2)
 
-	_, msg, err = c1.Read(ctx)
-	if err != nil {
-		t.Errorf("Expected no error, got %v", err)
-	}
+	msg = readFrame(t, ctx, c1, models.FrameMessage)
 
 	var response2 models.TransmissionData
 	err = json.Unmarshal(msg, &response2)
@@ -341,14 +456,20 @@ func TestPendingMessages(t *testing.T) {
 		t.Errorf("Expected no error, got %v", err)
 	}
 
+	if response2.ID == 0 {
+		t.Errorf("Expected message id to be assigned")
+	}
+	data.ID = response2.ID
+
 	if !reflect.DeepEqual(response2, data) {
 		t.Errorf("Expected %v, got %v", data, response2)
 	}
 
 	data = models.TransmissionData{
-		From:    user1,
-		To:      user2,
-		Payload: fmt.Sprintf("Hello User %s", user2),
+		Type:    models.FrameMessage,
+		From:    user1.id,
+		To:      user2.id,
+		Payload: fmt.Sprintf("Hello User %s", user2.id),
 	}
 	jsonData, _ = json.Marshal(data)
 	err = c1.Write(ctx, websocket.MessageText, jsonData)
@@ -358,21 +479,20 @@ func TestPendingMessages(t *testing.T) {
 
 	c1.Close(websocket.StatusNormalClosure, "")
 
-	c2, _, err = websocket.Dial(ctx, wsEndpoint+user2, nil)
-	if err != nil {
-		log.Fatalf("failed to dial: %v", err)
-	}
+	c2 = dialUser(t, ctx, wsEndpoint, user2)
 
-	_, msg, err = c2.Read(ctx)
-	if err != nil {
-		t.Errorf("Expected no error, got %v", err)
-	}
+	msg = readFrame(t, ctx, c2, models.FrameMessage)
 
 	err = json.Unmarshal(msg, &response1)
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
 
+	if response1.ID == 0 {
+		t.Errorf("Expected message id to be assigned")
+	}
+	data.ID = response1.ID
+
 	if !reflect.DeepEqual(response1, data) {
 		t.Errorf("Expected %v, got %v", data, response1)
 	}
@@ -382,7 +502,7 @@ func TestSendInvalidData(t *testing.T) {
 	router := setup()
 	defer cleanup()
 
-	user1 := createUser(t, router, "key1")
+	user1 := createUser(t, router)
 
 	s := httptest.NewServer(router)
 	wsEndpoint := "ws" + s.URL[4:] + "/ws/"
@@ -390,28 +510,780 @@ func TestSendInvalidData(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
 
-	c1, _, err := websocket.Dial(ctx, wsEndpoint+user1, nil)
+	c1 := dialUser(t, ctx, wsEndpoint, user1)
+
+	err := c1.Write(ctx, websocket.MessageText, []byte("invalid"))
 	if err != nil {
-		log.Fatalf("failed to dial: %v", err)
+		t.Errorf("Expected no error, got %v", err)
 	}
 
-	err = c1.Write(ctx, websocket.MessageText, []byte("invalid"))
+	msg := readFrame(t, ctx, c1, models.FrameError)
+
+	var error models.ErrorMessage
+	err = json.Unmarshal(msg, &error)
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
 
-	_, msg, err := c1.Read(ctx)
+	if error.Error != "Invalid message format" {
+		t.Errorf("Expected Invalid data, got %v", error.Error)
+	}
+}
+
+func ackMessage(t *testing.T, ctx context.Context, c *websocket.Conn, id int64) {
+	data, _ := json.Marshal(models.Ack{Type: models.FrameAck, ID: id})
+	err := c.Write(ctx, websocket.MessageText, data)
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
+}
+
+// readFrame reads the next frame of frameType from c, receipts for messages
+// sent by the test are skipped.
+func readFrame(t *testing.T, ctx context.Context, c *websocket.Conn, frameType string) []byte {
+	for {
+		_, msg, err := c.Read(ctx)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		var frame models.Frame
+		json.Unmarshal(msg, &frame)
+		switch frame.Type {
+		case frameType:
+			return msg
+		case models.FrameSent, models.FrameDelivered, models.FrameRead:
+			continue
+		}
+		t.Fatalf("Expected %s, got %s", frameType, msg)
+	}
+}
+
+func readError(t *testing.T, ctx context.Context, c *websocket.Conn) models.ErrorMessage {
+	msg := readFrame(t, ctx, c, models.FrameError)
 
 	var error models.ErrorMessage
-	err = json.Unmarshal(msg, &error)
+	err := json.Unmarshal(msg, &error)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return error
+}
+
+func TestChallengeInvalidSignature(t *testing.T) {
+	router := setup()
+	defer cleanup()
+
+	user1 := createUser(t, router)
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+
+	s := httptest.NewServer(router)
+	wsEndpoint := "ws" + s.URL[4:] + "/ws/"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	c := dial(t, ctx, wsEndpoint+user1.id, user1.token)
+
+	answerChallenge(t, ctx, c, func(nonce []byte) []byte {
+		return ed25519.Sign(otherKey, nonce)
+	})
+
+	error := readError(t, ctx, c)
+	if error.Code != models.CodeInvalidSignature {
+		t.Errorf("Expected %v, got %v", models.CodeInvalidSignature, error.Code)
+	}
+
+	_, _, err := c.Read(ctx)
+	if err == nil {
+		t.Errorf("Expected connection to be closed")
+	}
+}
+
+func TestChallengeInvalidResponse(t *testing.T) {
+	router := setup()
+	defer cleanup()
+
+	user1 := createUser(t, router)
+
+	s := httptest.NewServer(router)
+	wsEndpoint := "ws" + s.URL[4:] + "/ws/"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	c := dial(t, ctx, wsEndpoint+user1.id, user1.token)
+
+	// skip the challenge and try to send a message straight away
+	_, _, err := c.Read(ctx)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	data, _ := json.Marshal(models.TransmissionData{
+		From:    user1.id,
+		To:      user1.id,
+		Payload: "Hello User",
+	})
+	err = c.Write(ctx, websocket.MessageText, data)
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
 
-	if error.Error != "Invalid message format" {
-		t.Errorf("Expected Invalid data, got %v", error.Error)
+	error := readError(t, ctx, c)
+	if error.Code != models.CodeInvalidChallenge {
+		t.Errorf("Expected %v, got %v", models.CodeInvalidChallenge, error.Code)
+	}
+}
+
+func TestChallengeECDSA(t *testing.T) {
+	router := setup()
+	defer cleanup()
+
+	s := httptest.NewServer(router)
+	wsEndpoint := "ws" + s.URL[4:] + "/ws/"
+
+	tests := []struct {
+		name string
+		sign func(privateKey *ecdsa.PrivateKey, digest []byte) []byte
+	}{
+		{"asn1", func(privateKey *ecdsa.PrivateKey, digest []byte) []byte {
+			signature, _ := ecdsa.SignASN1(rand.Reader, privateKey, digest)
+			return signature
+		}},
+		{"raw", func(privateKey *ecdsa.PrivateKey, digest []byte) []byte {
+			r, s, _ := ecdsa.Sign(rand.Reader, privateKey, digest)
+			signature := make([]byte, 64)
+			r.FillBytes(signature[:32])
+			s.FillBytes(signature[32:])
+			return signature
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+
+			der, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			res := login(t, router, base64.RawURLEncoding.EncodeToString(der))
+			id := res.User
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+
+			c := dial(t, ctx, wsEndpoint+id, res.AccessToken)
+
+			answerChallenge(t, ctx, c, func(nonce []byte) []byte {
+				digest := sha256.Sum256(nonce)
+				return tt.sign(privateKey, digest[:])
+			})
+			readAuthenticated(t, ctx, c)
+
+			// a message to ourselves proves the session was registered
+			data := models.TransmissionData{
+				Type:    models.FrameMessage,
+				From:    id,
+				To:      id,
+				Payload: "Hello Myself",
+			}
+			jsonData, _ := json.Marshal(data)
+			err = c.Write(ctx, websocket.MessageText, jsonData)
+			if err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+
+			msg := readFrame(t, ctx, c, models.FrameMessage)
+
+			var response models.TransmissionData
+			err = json.Unmarshal(msg, &response)
+			if err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+
+			if response.ID == 0 {
+				t.Errorf("Expected message id to be assigned")
+			}
+			data.ID = response.ID
+
+			if !reflect.DeepEqual(response, data) {
+				t.Errorf("Expected %v, got %v", data, response)
+			}
+
+			c.Close(websocket.StatusNormalClosure, "")
+		})
+	}
+}
+
+func TestRedeliverUnacknowledged(t *testing.T) {
+	router := setup()
+	defer cleanup()
+
+	user1 := createUser(t, router)
+	user2 := createUser(t, router)
+
+	s := httptest.NewServer(router)
+	wsEndpoint := "ws" + s.URL[4:] + "/ws/"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	c1 := dialUser(t, ctx, wsEndpoint, user1)
+	c2 := dialUser(t, ctx, wsEndpoint, user2)
+
+	send := func(payload string) {
+		data, _ := json.Marshal(models.TransmissionData{
+			From:    user1.id,
+			To:      user2.id,
+			Payload: payload,
+		})
+		err := c1.Write(ctx, websocket.MessageText, data)
+		if err != nil {
+			t.Errorf("Expected no error, got %v", err)
+		}
+	}
+
+	read := func(c *websocket.Conn) models.TransmissionData {
+		return readMessage(t, ctx, c)
+	}
+
+	send("first")
+	first := read(c2)
+
+	// received but never acknowledged, so it is delivered again
+	closeDevice(t, ctx, router, c2, user2)
+	c2 = dialUser(t, ctx, wsEndpoint, user2)
+
+	redelivered := read(c2)
+	if !reflect.DeepEqual(redelivered, first) {
+		t.Errorf("Expected %v, got %v", first, redelivered)
+	}
+	ackMessage(t, ctx, c2, redelivered.ID)
+
+	closeDevice(t, ctx, router, c2, user2)
+	send("second")
+	c2 = dialUser(t, ctx, wsEndpoint, user2)
+
+	second := read(c2)
+	if second.Payload != "second" {
+		t.Errorf("Expected second, got %v", second.Payload)
+	}
+	if second.ID == first.ID {
+		t.Errorf("Expected a new message id, got %v", second.ID)
+	}
+}
+
+func readMessage(t *testing.T, ctx context.Context, c *websocket.Conn) models.TransmissionData {
+	msg := readFrame(t, ctx, c, models.FrameMessage)
+
+	var message models.TransmissionData
+	err := json.Unmarshal(msg, &message)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return message
+}
+
+func sendMessage(t *testing.T, ctx context.Context, c *websocket.Conn, message models.TransmissionData) {
+	data, _ := json.Marshal(message)
+	err := c.Write(ctx, websocket.MessageText, data)
+	if err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+func TestMultiDevice(t *testing.T) {
+	router := setup()
+	defer cleanup()
+
+	user1 := createUser(t, router)
+	user2 := createUser(t, router)
+	laptop := registerDevice(t, router, user2)
+	phone := registerDevice(t, router, user2)
+
+	s := httptest.NewServer(router)
+	wsEndpoint := "ws" + s.URL[4:] + "/ws/"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	c1 := dialUser(t, ctx, wsEndpoint, user1)
+	c2 := dialUser(t, ctx, wsEndpoint, user2)
+	c3 := dialUser(t, ctx, wsEndpoint, laptop)
+
+	// live messages reach every connected device
+	sendMessage(t, ctx, c1, models.TransmissionData{From: user1.id, To: user2.id, Payload: "Hello Devices"})
+
+	primaryMessage := readMessage(t, ctx, c2)
+	laptopMessage := readMessage(t, ctx, c3)
+	if !reflect.DeepEqual(primaryMessage, laptopMessage) || primaryMessage.Payload != "Hello Devices" {
+		t.Errorf("Expected the same message on every device, got %v and %v", primaryMessage, laptopMessage)
+	}
+	ackMessage(t, ctx, c2, primaryMessage.ID)
+	ackMessage(t, ctx, c3, laptopMessage.ID)
+
+	// the phone was offline, so the message is still pending for it
+	c4 := dialUser(t, ctx, wsEndpoint, phone)
+	phoneMessage := readMessage(t, ctx, c4)
+	if !reflect.DeepEqual(phoneMessage, primaryMessage) {
+		t.Errorf("Expected %v, got %v", primaryMessage, phoneMessage)
+	}
+	ackMessage(t, ctx, c4, phoneMessage.ID)
+
+	// acknowledged by the laptop, so it is not delivered again
+	closeDevice(t, ctx, router, c3, laptop)
+	sendMessage(t, ctx, c1, models.TransmissionData{From: user1.id, To: user2.id, Payload: "Hello Again"})
+	readMessage(t, ctx, c2)
+
+	c3 = dialUser(t, ctx, wsEndpoint, laptop)
+	if message := readMessage(t, ctx, c3); message.Payload != "Hello Again" {
+		t.Errorf("Expected Hello Again, got %v", message.Payload)
+	}
+}
+
+func TestDeviceConnectedTwice(t *testing.T) {
+	router := setup()
+	defer cleanup()
+
+	user1 := createUser(t, router)
+
+	s := httptest.NewServer(router)
+	wsEndpoint := "ws" + s.URL[4:] + "/ws/"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	dialUser(t, ctx, wsEndpoint, user1)
+
+	c := dial(t, ctx, wsEndpoint+user1.id, user1.token)
+	answerChallenge(t, ctx, c, func(nonce []byte) []byte {
+		return ed25519.Sign(user1.privateKey, nonce)
+	})
+
+	error := readError(t, ctx, c)
+	if error.Code != models.CodeDeviceConnected {
+		t.Errorf("Expected %v, got %v", models.CodeDeviceConnected, error.Code)
+	}
+
+	// the first session is still usable after the rejection
+	user2 := createUser(t, router)
+	c2 := dialUser(t, ctx, wsEndpoint, user2)
+	c2.Close(websocket.StatusNormalClosure, "")
+}
+
+func TestUnknownDevice(t *testing.T) {
+	router := setup()
+	defer cleanup()
+
+	user1 := createUser(t, router)
+
+	s := httptest.NewServer(router)
+	wsEndpoint := "ws" + s.URL[4:] + "/ws/"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	c := dial(t, ctx, wsEndpoint+user1.id+"?device=random-device", user1.token)
+	answerChallenge(t, ctx, c, func(nonce []byte) []byte {
+		return ed25519.Sign(user1.privateKey, nonce)
+	})
+
+	error := readError(t, ctx, c)
+	if error.Code != models.CodeDeviceNotFound {
+		t.Errorf("Expected %v, got %v", models.CodeDeviceNotFound, error.Code)
+	}
+}
+
+func sendGroupMessage(t *testing.T, ctx context.Context, c *websocket.Conn, message models.GroupMessage) {
+	data, _ := json.Marshal(message)
+	err := c.Write(ctx, websocket.MessageText, data)
+	if err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+func TestGroupMessage(t *testing.T) {
+	router := setup()
+	defer cleanup()
+
+	user1 := createUser(t, router)
+	user2 := createUser(t, router)
+	user3 := createUser(t, router)
+	outsider := createUser(t, router)
+	group := createGroup(t, router, user1, user2, user3)
+
+	s := httptest.NewServer(router)
+	wsEndpoint := "ws" + s.URL[4:] + "/ws/"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	c1 := dialUser(t, ctx, wsEndpoint, user1)
+	c2 := dialUser(t, ctx, wsEndpoint, user2)
+
+	// every member needs its own payload
+	sendGroupMessage(t, ctx, c1, models.GroupMessage{
+		From:     user1.id,
+		To:       group.ID,
+		Payloads: map[string]string{user2.id: "for user2"},
+	})
+	if error := readError(t, ctx, c1); error.Code != models.CodeMissingPayload {
+		t.Errorf("Expected %v, got %v", models.CodeMissingPayload, error.Code)
+	}
+
+	sendGroupMessage(t, ctx, c1, models.GroupMessage{
+		From:     user1.id,
+		To:       group.ID,
+		Payloads: map[string]string{user2.id: "for user2", user3.id: "for user3"},
+	})
+
+	message := readMessage(t, ctx, c2)
+	expected := models.TransmissionData{Type: models.FrameMessage, ID: message.ID, From: user1.id, To: user2.id, Group: group.ID, Payload: "for user2"}
+	if message != expected {
+		t.Errorf("Expected %v, got %v", expected, message)
+	}
+
+	// user3 was offline, the message waits for it
+	c3 := dialUser(t, ctx, wsEndpoint, user3)
+	message = readMessage(t, ctx, c3)
+	expected = models.TransmissionData{Type: models.FrameMessage, ID: message.ID, From: user1.id, To: user3.id, Group: group.ID, Payload: "for user3"}
+	if message != expected {
+		t.Errorf("Expected %v, got %v", expected, message)
+	}
+
+	c4 := dialUser(t, ctx, wsEndpoint, outsider)
+	sendGroupMessage(t, ctx, c4, models.GroupMessage{
+		From:     outsider.id,
+		To:       group.ID,
+		Payloads: map[string]string{user1.id: "1", user2.id: "2", user3.id: "3"},
+	})
+	if error := readError(t, ctx, c4); error.Code != models.CodeNotGroupMember {
+		t.Errorf("Expected %v, got %v", models.CodeNotGroupMember, error.Code)
+	}
+}
+
+func TestMailboxFull(t *testing.T) {
+	router := setupWith(func(opts *APIOpts) {
+		opts.MailboxMaxMessages = 2
+		opts.MailboxMaxBytes = 10
+	})
+	defer cleanup()
+
+	user1 := createUser(t, router)
+	user2 := createUser(t, router)
+
+	s := httptest.NewServer(router)
+	wsEndpoint := "ws" + s.URL[4:] + "/ws/"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	c1 := dialUser(t, ctx, wsEndpoint, user1)
+
+	// too large for the mailbox
+	sendMessage(t, ctx, c1, models.TransmissionData{From: user1.id, To: user2.id, Payload: "Hello World!"})
+	if error := readError(t, ctx, c1); error.Code != models.CodeMailboxFull {
+		t.Errorf("Expected %v, got %v", models.CodeMailboxFull, error.Code)
+	}
+
+	sendMessage(t, ctx, c1, models.TransmissionData{From: user1.id, To: user2.id, Payload: "first"})
+	sendMessage(t, ctx, c1, models.TransmissionData{From: user1.id, To: user2.id, Payload: "2nd"})
+	sendMessage(t, ctx, c1, models.TransmissionData{From: user1.id, To: user2.id, Payload: "3rd"})
+	if error := readError(t, ctx, c1); error.Code != models.CodeMailboxFull {
+		t.Errorf("Expected %v, got %v", models.CodeMailboxFull, error.Code)
+	}
+
+	// acknowledged messages free the mailbox again
+	c2 := dialUser(t, ctx, wsEndpoint, user2)
+	ackMessage(t, ctx, c2, readMessage(t, ctx, c2).ID)
+	readMessage(t, ctx, c2)
+
+	// frames are handled in order, so the ack is done once the error arrives
+	c2.Write(ctx, websocket.MessageText, []byte("invalid"))
+	readError(t, ctx, c2)
+
+	sendMessage(t, ctx, c1, models.TransmissionData{From: user1.id, To: user2.id, Payload: "4th"})
+	if message := readMessage(t, ctx, c2); message.Payload != "4th" {
+		t.Errorf("Expected 4th, got %v", message.Payload)
+	}
+}
+
+func readReceipt(t *testing.T, ctx context.Context, c *websocket.Conn, receiptType string) models.TransmissionData {
+	msg := readFrame(t, ctx, c, receiptType)
+
+	var receipt models.TransmissionData
+	err := json.Unmarshal(msg, &receipt)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return receipt
+}
+
+func TestReceipts(t *testing.T) {
+	router := setup()
+	defer cleanup()
+
+	user1 := createUser(t, router)
+	user2 := createUser(t, router)
+
+	s := httptest.NewServer(router)
+	wsEndpoint := "ws" + s.URL[4:] + "/ws/"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	c1 := dialUser(t, ctx, wsEndpoint, user1)
+	c2 := dialUser(t, ctx, wsEndpoint, user2)
+
+	sendMessage(t, ctx, c1, models.TransmissionData{Type: models.FrameMessage, From: user1.id, To: user2.id, Payload: "live"})
+	sent := readReceipt(t, ctx, c1, models.FrameSent)
+	message := readMessage(t, ctx, c2)
+	if sent.Ref != message.ID || sent.To != user2.id {
+		t.Errorf("Expected sent receipt for message %d, got %v", message.ID, sent)
+	}
+
+	delivered := readReceipt(t, ctx, c1, models.FrameDelivered)
+	if delivered.Ref != message.ID || delivered.From != user2.id || delivered.To != user1.id {
+		t.Errorf("Expected delivered receipt for message %d, got %v", message.ID, delivered)
+	}
+	ackMessage(t, ctx, c1, delivered.ID)
+	ackMessage(t, ctx, c2, message.ID)
+
+	// queued messages are confirmed once they are flushed
+	closeDevice(t, ctx, router, c2, user2)
+	sendMessage(t, ctx, c1, models.TransmissionData{Type: models.FrameMessage, From: user1.id, To: user2.id, Payload: "queued"})
+	sent = readReceipt(t, ctx, c1, models.FrameSent)
+
+	c2 = dialUser(t, ctx, wsEndpoint, user2)
+	message = readMessage(t, ctx, c2)
+	if message.Payload != "queued" {
+		t.Errorf("Expected queued, got %v", message.Payload)
+	}
+	delivered = readReceipt(t, ctx, c1, models.FrameDelivered)
+	if delivered.Ref != sent.Ref || delivered.Ref != message.ID {
+		t.Errorf("Expected delivered receipt for message %d, got %v", message.ID, delivered)
+	}
+	ackMessage(t, ctx, c1, delivered.ID)
+
+	// read receipts wait for the sender to come back
+	closeDevice(t, ctx, router, c1, user1)
+	sendMessage(t, ctx, c2, models.TransmissionData{Type: models.FrameRead, To: user1.id, Ref: message.ID})
+
+	c1 = dialUser(t, ctx, wsEndpoint, user1)
+	read := readReceipt(t, ctx, c1, models.FrameRead)
+	if read.Ref != message.ID || read.From != user2.id {
+		t.Errorf("Expected read receipt for message %d, got %v", message.ID, read)
+	}
+
+	sendMessage(t, ctx, c2, models.TransmissionData{Type: models.FrameRead, To: user1.id})
+	if error := readError(t, ctx, c2); error.Code != models.CodeInvalidMessage || error.Type != models.FrameError {
+		t.Errorf("Expected %v error, got %v", models.CodeInvalidMessage, error)
+	}
+}
+
+func TestDeliveredOnce(t *testing.T) {
+	var store db.Store
+	router := setupWith(func(opts *APIOpts) {
+		store = opts.Database
+	})
+	defer cleanup()
+
+	user1 := createUser(t, router)
+	user2 := createUser(t, router)
+	laptop := registerDevice(t, router, user2)
+
+	s := httptest.NewServer(router)
+	wsEndpoint := "ws" + s.URL[4:] + "/ws/"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	c1 := dialUser(t, ctx, wsEndpoint, user1)
+	defer c1.Close(websocket.StatusNormalClosure, "")
+	sendMessage(t, ctx, c1, models.TransmissionData{From: user1.id, To: user2.id, Payload: "once"})
+	sent := readReceipt(t, ctx, c1, models.FrameSent)
+
+	// the message is delivered again on every connection until it is
+	// acknowledged, the sender is told once per device
+	for _, device := range []testUser{user2, user2, user2, laptop} {
+		c := dialUser(t, ctx, wsEndpoint, device)
+		if message := readMessage(t, ctx, c); message.ID != sent.Ref {
+			t.Errorf("Expected message %d, got %+v", sent.Ref, message)
+		}
+		closeDevice(t, ctx, router, c, device)
+	}
+	readReceipt(t, ctx, c1, models.FrameDelivered)
+	readReceipt(t, ctx, c1, models.FrameDelivered)
+
+	var receipts int
+	pending, _ := store.GetPendingMessages(user1.id, user1.device)
+	for _, message := range pending {
+		if message.Type == models.FrameDelivered && message.Ref == sent.Ref {
+			receipts++
+		}
+	}
+	if receipts != 2 {
+		t.Errorf("Expected 2 delivered receipts, got %d", receipts)
+	}
+}
+
+func subscribe(t *testing.T, ctx context.Context, c *websocket.Conn, frameType string, users ...string) {
+	data, _ := json.Marshal(models.Subscribe{Type: frameType, Users: users})
+	err := c.Write(ctx, websocket.MessageText, data)
+	if err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+func readPresence(t *testing.T, ctx context.Context, c *websocket.Conn) models.Presence {
+	_, msg, err := c.Read(ctx)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	var presence models.Presence
+	err = json.Unmarshal(msg, &presence)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return presence
+}
+
+func TestPresence(t *testing.T) {
+	router := setup()
+	defer cleanup()
+
+	user1 := createUser(t, router)
+	user2 := createUser(t, router)
+	user3 := createUser(t, router)
+	laptop := registerDevice(t, router, user2)
+
+	s := httptest.NewServer(router)
+	wsEndpoint := "ws" + s.URL[4:] + "/ws/"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	c1 := dialUser(t, ctx, wsEndpoint, user1)
+
+	subscribe(t, ctx, c1, models.FrameSubscribe, user2.id)
+	if presence := readPresence(t, ctx, c1); presence != (models.Presence{Type: models.FrameOffline, User: user2.id}) {
+		t.Errorf("Expected %s offline, got %v", user2.id, presence)
+	}
+
+	c2 := dialUser(t, ctx, wsEndpoint, user2)
+	if presence := readPresence(t, ctx, c1); presence != (models.Presence{Type: models.FrameOnline, User: user2.id}) {
+		t.Errorf("Expected %s online, got %v", user2.id, presence)
+	}
+
+	// the user stays online while one of its devices is connected
+	c3 := dialUser(t, ctx, wsEndpoint, laptop)
+	c2.Close(websocket.StatusNormalClosure, "")
+	c3.Close(websocket.StatusNormalClosure, "")
+	if presence := readPresence(t, ctx, c1); presence != (models.Presence{Type: models.FrameOffline, User: user2.id}) {
+		t.Errorf("Expected %s offline, got %v", user2.id, presence)
+	}
+
+	// no more events once unsubscribed, user3 is only there to sync
+	subscribe(t, ctx, c1, models.FrameUnsubscribe, user2.id)
+	subscribe(t, ctx, c1, models.FrameSubscribe, user3.id)
+	if presence := readPresence(t, ctx, c1); presence != (models.Presence{Type: models.FrameOffline, User: user3.id}) {
+		t.Errorf("Expected %s offline, got %v", user3.id, presence)
+	}
+
+	dialUser(t, ctx, wsEndpoint, user2)
+	dialUser(t, ctx, wsEndpoint, user3)
+	if presence := readPresence(t, ctx, c1); presence != (models.Presence{Type: models.FrameOnline, User: user3.id}) {
+		t.Errorf("Expected %s online, got %v", user3.id, presence)
+	}
+}
+
+func TestTyping(t *testing.T) {
+	router := setup()
+	defer cleanup()
+
+	user1 := createUser(t, router)
+	user2 := createUser(t, router)
+	user3 := createUser(t, router)
+	group := createGroup(t, router, user1, user2, user3)
+
+	s := httptest.NewServer(router)
+	wsEndpoint := "ws" + s.URL[4:] + "/ws/"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	c1 := dialUser(t, ctx, wsEndpoint, user1)
+	c2 := dialUser(t, ctx, wsEndpoint, user2)
+
+	sendMessage(t, ctx, c1, models.TransmissionData{Type: models.FrameTyping, To: user2.id})
+	typing := readReceipt(t, ctx, c2, models.FrameTyping)
+	if typing.From != user1.id || typing.To != user2.id {
+		t.Errorf("Expected typing from %s, got %v", user1.id, typing)
+	}
+
+	sendMessage(t, ctx, c1, models.TransmissionData{Type: models.FrameTyping, To: group.ID})
+	typing = readReceipt(t, ctx, c2, models.FrameTyping)
+	if typing.From != user1.id || typing.Group != group.ID {
+		t.Errorf("Expected typing from %s in %s, got %v", user1.id, group.ID, typing)
+	}
+
+	// typing indicators are not stored for offline users
+	sendMessage(t, ctx, c1, models.TransmissionData{Type: models.FrameTyping, To: user3.id})
+	sendMessage(t, ctx, c1, models.TransmissionData{Type: models.FrameMessage, From: user1.id, To: user3.id, Payload: "Hello"})
+	readReceipt(t, ctx, c1, models.FrameSent)
+
+	c3 := dialUser(t, ctx, wsEndpoint, user3)
+	if message := readMessage(t, ctx, c3); message.Payload != "Hello" {
+		t.Errorf("Expected Hello, got %v", message)
+	}
+}
+
+func TestSpoofedSender(t *testing.T) {
+	router := setup()
+	defer cleanup()
+
+	user1 := createUser(t, router)
+	user2 := createUser(t, router)
+	victim := createUser(t, router)
+	group := createGroup(t, router, user1, user2, victim)
+
+	s := httptest.NewServer(router)
+	wsEndpoint := "ws" + s.URL[4:] + "/ws/"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	c1 := dialUser(t, ctx, wsEndpoint, user1)
+	c2 := dialUser(t, ctx, wsEndpoint, user2)
+
+	spoofed := []interface{}{
+		models.TransmissionData{Type: models.FrameMessage, From: victim.id, To: user2.id, Payload: "spoofed"},
+		models.GroupMessage{Type: models.FrameMessage, From: victim.id, To: group.ID, Payloads: map[string]string{user2.id: "spoofed", victim.id: "spoofed"}},
+		models.TransmissionData{Type: models.FrameRead, From: victim.id, To: user2.id, Ref: 1},
+		models.TransmissionData{Type: models.FrameTyping, From: victim.id, To: user2.id},
+	}
+	for _, frame := range spoofed {
+		data, _ := json.Marshal(frame)
+		err := c1.Write(ctx, websocket.MessageText, data)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		if error := readError(t, ctx, c1); error.Code != models.CodeSenderMismatch {
+			t.Errorf("Expected %v, got %v", models.CodeSenderMismatch, error.Code)
+		}
+	}
+
+	// without a sender the message is sent as the connected user
+	sendMessage(t, ctx, c1, models.TransmissionData{Type: models.FrameMessage, To: user2.id, Payload: "genuine"})
+	message := readMessage(t, ctx, c2)
+	if message.From != user1.id || message.Payload != "genuine" {
+		t.Errorf("Expected genuine message from %s, got %v", user1.id, message)
 	}
 }
@@ -0,0 +1,61 @@
+// Package bus connects the servers sharing a database, so users connected to
+// one of them can be reached from the others.
+package bus
+
+import (
+	"context"
+	"encoding/json"
+
+	"enigma-protocol-go/pkg/models"
+)
+
+// Types of the events sent between the nodes.
+const (
+	// EventMessage carries a stored message for the sessions of User.
+	EventMessage = "message"
+	// EventFrame carries a frame for the sessions of User which is not
+	// stored, like a typing indicator.
+	EventFrame = "frame"
+	// EventPresence tells the subscribers of User that it came online or
+	// went offline.
+	EventPresence = "presence"
+	// EventDisconnect closes the sessions of User.
+	EventDisconnect = "disconnect"
+)
+
+// Event is sent from one node to the others.
+type Event struct {
+	Type string `json:"type"`
+	// Node is the node which sent the event, it is set by the bus.
+	Node    string                   `json:"node"`
+	User    string                   `json:"user"`
+	Message *models.TransmissionData `json:"message,omitempty"`
+	Frame   json.RawMessage          `json:"frame,omitempty"`
+	// Presence is FrameOnline or FrameOffline.
+	Presence string `json:"presence,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// Bus keeps track of the node every user is connected to and passes events
+// between the nodes. It is implemented by Hub for the nodes of a single
+// process and by RedisBus.
+type Bus interface {
+	// Node is the name of this node.
+	Node() string
+	// Connect registers user as connected to this node. It reports whether
+	// the user was not connected to another node.
+	Connect(ctx context.Context, user string) (bool, error)
+	// Disconnect unregisters user from this node once its last session on
+	// it ended. It reports whether the user is not connected to another
+	// node.
+	Disconnect(ctx context.Context, user string) (bool, error)
+	// Online reports whether user is connected to any node.
+	Online(ctx context.Context, user string) (bool, error)
+	// Publish sends event to the other nodes event.User is connected to.
+	Publish(ctx context.Context, event Event) error
+	// Broadcast sends event to every other node.
+	Broadcast(ctx context.Context, event Event) error
+	// Listen calls handle with the events sent to this node until ctx is
+	// done. Events sent before Listen started are lost.
+	Listen(ctx context.Context, handle func(Event)) error
+}
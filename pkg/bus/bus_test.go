@@ -0,0 +1,237 @@
+package bus
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"enigma-protocol-go/pkg/models"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// busFactories creates two nodes of an empty bus for every implementation.
+// A Redis server is only tested when TEST_REDIS_URL points to one that can be
+// wiped.
+var busFactories = map[string]func(t *testing.T) (Bus, Bus){
+	"hub": func(t *testing.T) (Bus, Bus) {
+		hub := NewHub()
+		return hub.Node("a"), hub.Node("b")
+	},
+	"miniredis": func(t *testing.T) (Bus, Bus) {
+		client := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+		t.Cleanup(func() { client.Close() })
+		return NewRedisBus(client, "a"), NewRedisBus(client, "b")
+	},
+	"redis": func(t *testing.T) (Bus, Bus) {
+		url := os.Getenv("TEST_REDIS_URL")
+		if url == "" {
+			t.Skip("TEST_REDIS_URL is not set")
+		}
+
+		opts, err := redis.ParseURL(url)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		client := redis.NewClient(opts)
+		t.Cleanup(func() { client.Close() })
+		if err := client.FlushDB(context.Background()).Err(); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return NewRedisBus(client, "a"), NewRedisBus(client, "b")
+	},
+}
+
+var busTests = []struct {
+	name string
+	test func(t *testing.T, a Bus, b Bus)
+}{
+	{"Presence", testBusPresence},
+	{"Publish", testBusPublish},
+	{"Broadcast", testBusBroadcast},
+}
+
+func TestBuses(t *testing.T) {
+	for name, factory := range busFactories {
+		factory := factory
+		t.Run(name, func(t *testing.T) {
+			for _, tt := range busTests {
+				t.Run(tt.name, func(t *testing.T) {
+					a, b := factory(t)
+					tt.test(t, a, b)
+				})
+			}
+		})
+	}
+}
+
+// listen starts listening on node and returns the events it gets. It waits
+// until events sent by other arrive, the probes are not returned.
+func listen(t *testing.T, ctx context.Context, node Bus, other Bus) <-chan Event {
+	events := make(chan Event, 100)
+	go node.Listen(ctx, func(event Event) { events <- event })
+
+	for {
+		if err := other.Broadcast(ctx, Event{Type: "probe"}); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		select {
+		case event := <-events:
+			if event.Type != "probe" {
+				t.Fatalf("Expected a probe, got %+v", event)
+			}
+			// the later probes may still be on their way
+			time.Sleep(10 * time.Millisecond)
+			for len(events) > 0 {
+				<-events
+			}
+			return events
+		case <-time.After(10 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatalf("Expected node %s to listen", node.Node())
+		}
+	}
+}
+
+func testBusPresence(t *testing.T, a Bus, b Bus) {
+	ctx := context.Background()
+
+	if online, err := a.Online(ctx, "user"); err != nil || online {
+		t.Errorf("Expected user to be offline, got %v, %v", online, err)
+	}
+
+	first, err := a.Connect(ctx, "user")
+	if err != nil || !first {
+		t.Errorf("Expected the first node of user, got %v, %v", first, err)
+	}
+
+	// nodes count once they listen
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	listen(t, ctx, a, b)
+
+	if online, err := b.Online(ctx, "user"); err != nil || !online {
+		t.Errorf("Expected user to be online, got %v, %v", online, err)
+	}
+	if first, err := b.Connect(ctx, "user"); err != nil || first {
+		t.Errorf("Expected user to be connected already, got %v, %v", first, err)
+	}
+
+	if last, err := b.Disconnect(ctx, "user"); err != nil || last {
+		t.Errorf("Expected user to stay connected, got %v, %v", last, err)
+	}
+	if last, err := a.Disconnect(ctx, "user"); err != nil || !last {
+		t.Errorf("Expected the last node of user, got %v, %v", last, err)
+	}
+	if online, err := b.Online(ctx, "user"); err != nil || online {
+		t.Errorf("Expected user to be offline, got %v, %v", online, err)
+	}
+}
+
+func testBusPublish(t *testing.T, a Bus, b Bus) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	events := listen(t, ctx, b, a)
+
+	// users which are not connected to b are not sent to it
+	if err := a.Publish(ctx, Event{Type: EventMessage, User: "other"}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	b.Connect(ctx, "user")
+	message := models.TransmissionData{ID: 1, Type: models.FrameMessage, From: "other", To: "user", Payload: "Hello"}
+	if err := a.Publish(ctx, Event{Type: EventMessage, User: "user", Message: &message}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	select {
+	case event := <-events:
+		if event.Type != EventMessage || event.Node != a.Node() || event.User != "user" || event.Message == nil || *event.Message != message {
+			t.Errorf("Expected the message from %s, got %+v", a.Node(), event)
+		}
+	case <-ctx.Done():
+		t.Fatalf("Expected an event")
+	}
+
+	// a node does not publish to itself
+	if err := b.Publish(ctx, Event{Type: EventMessage, User: "user"}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	select {
+	case event := <-events:
+		t.Errorf("Expected no event, got %+v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func testBusBroadcast(t *testing.T, a Bus, b Bus) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	eventsA := listen(t, ctx, a, b)
+	eventsB := listen(t, ctx, b, a)
+
+	if err := a.Broadcast(ctx, Event{Type: EventPresence, User: "user", Presence: models.FrameOnline}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	select {
+	case event := <-eventsB:
+		if event.Type != EventPresence || event.Node != a.Node() || event.Presence != models.FrameOnline {
+			t.Errorf("Expected the presence from %s, got %+v", a.Node(), event)
+		}
+	case <-ctx.Done():
+		t.Fatalf("Expected an event")
+	}
+
+	select {
+	case event := <-eventsA:
+		t.Errorf("Expected the sender to get no event, got %+v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRedisBusRestore(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	a, b := NewRedisBus(client, "a"), NewRedisBus(client, "b")
+
+	ctx := context.Background()
+	if err := a.alive(ctx); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := a.Connect(ctx, "user"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// a could not reach Redis for longer than aliveTTL, b dropped its users
+	server.FastForward(aliveTTL + time.Second)
+	if online, err := b.Online(ctx, "user"); err != nil || online {
+		t.Errorf("Expected user to be offline, got %v, %v", online, err)
+	}
+
+	// the users are back once a is alive again
+	if err := a.alive(ctx); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if online, err := b.Online(ctx, "user"); err != nil || !online {
+		t.Errorf("Expected user to be online, got %v, %v", online, err)
+	}
+
+	// users which disconnected are not
+	if _, err := a.Disconnect(ctx, "user"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	server.FastForward(aliveTTL + time.Second)
+	if err := a.alive(ctx); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if online, err := b.Online(ctx, "user"); err != nil || online {
+		t.Errorf("Expected user to be offline, got %v, %v", online, err)
+	}
+}
@@ -0,0 +1,125 @@
+package bus
+
+import (
+	"context"
+	"sync"
+)
+
+// LocalNode is the node of the default bus, which has no other nodes.
+const LocalNode = "local"
+
+// Hub connects the nodes of a single process, it is the default bus of a
+// server and lets tests run several nodes without Redis.
+type Hub struct {
+	mu sync.Mutex
+	// listeners holds the event handler of every listening node
+	listeners map[string]func(Event)
+	// users holds the nodes every user is connected to
+	users map[string]map[string]bool
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		listeners: make(map[string]func(Event)),
+		users:     make(map[string]map[string]bool),
+	}
+}
+
+// NewLocalBus returns a bus for a server running alone.
+func NewLocalBus() Bus {
+	return NewHub().Node(LocalNode)
+}
+
+// Node returns the bus of the node called name.
+func (h *Hub) Node(name string) Bus {
+	return &hubNode{hub: h, name: name}
+}
+
+type hubNode struct {
+	hub  *Hub
+	name string
+}
+
+func (n *hubNode) Node() string {
+	return n.name
+}
+
+func (n *hubNode) Connect(_ context.Context, user string) (bool, error) {
+	n.hub.mu.Lock()
+	defer n.hub.mu.Unlock()
+
+	if n.hub.users[user] == nil {
+		n.hub.users[user] = make(map[string]bool)
+	}
+	n.hub.users[user][n.name] = true
+	return len(n.hub.users[user]) == 1, nil
+}
+
+func (n *hubNode) Disconnect(_ context.Context, user string) (bool, error) {
+	n.hub.mu.Lock()
+	defer n.hub.mu.Unlock()
+
+	delete(n.hub.users[user], n.name)
+	if len(n.hub.users[user]) == 0 {
+		delete(n.hub.users, user)
+		return true, nil
+	}
+	return false, nil
+}
+
+func (n *hubNode) Online(_ context.Context, user string) (bool, error) {
+	n.hub.mu.Lock()
+	defer n.hub.mu.Unlock()
+
+	return len(n.hub.users[user]) > 0, nil
+}
+
+// Publish calls the handlers of the other nodes right away, they must not
+// block.
+func (n *hubNode) Publish(_ context.Context, event Event) error {
+	n.hub.mu.Lock()
+	var handlers []func(Event)
+	for node := range n.hub.users[event.User] {
+		if handle, ok := n.hub.listeners[node]; ok && node != n.name {
+			handlers = append(handlers, handle)
+		}
+	}
+	n.hub.mu.Unlock()
+
+	n.send(handlers, event)
+	return nil
+}
+
+func (n *hubNode) Broadcast(_ context.Context, event Event) error {
+	n.hub.mu.Lock()
+	var handlers []func(Event)
+	for node, handle := range n.hub.listeners {
+		if node != n.name {
+			handlers = append(handlers, handle)
+		}
+	}
+	n.hub.mu.Unlock()
+
+	n.send(handlers, event)
+	return nil
+}
+
+func (n *hubNode) send(handlers []func(Event), event Event) {
+	event.Node = n.name
+	for _, handle := range handlers {
+		handle(event)
+	}
+}
+
+func (n *hubNode) Listen(ctx context.Context, handle func(Event)) error {
+	n.hub.mu.Lock()
+	n.hub.listeners[n.name] = handle
+	n.hub.mu.Unlock()
+
+	<-ctx.Done()
+
+	n.hub.mu.Lock()
+	delete(n.hub.listeners, n.name)
+	n.hub.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,247 @@
+package bus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// keyPrefix is prepended to the keys and channels of the bus.
+	keyPrefix = "enigma:"
+	// aliveInterval is how often a listening node tells it is alive and
+	// aliveTTL how long it counts as alive afterwards. Users of a node which
+	// stopped without disconnecting them are dropped after aliveTTL.
+	aliveInterval = 10 * time.Second
+	aliveTTL      = 3 * aliveInterval
+)
+
+// RedisBus passes the events over Redis pub/sub, every node listens on its
+// own channel and on the broadcast channel. The nodes of every user are kept
+// in a set.
+type RedisBus struct {
+	client redis.UniversalClient
+	node   string
+	// users are the users connected to this node, guarded by mu. They are
+	// registered again when the other nodes dropped them while this node
+	// could not reach Redis.
+	mu    sync.Mutex
+	users map[string]bool
+	// lost is set when keeping the node alive failed, guarded by mu
+	lost bool
+}
+
+// NewRedisBus returns the bus of the node called node, the name must be
+// unique among the nodes sharing the Redis server.
+func NewRedisBus(client redis.UniversalClient, node string) *RedisBus {
+	return &RedisBus{client: client, node: node, users: make(map[string]bool)}
+}
+
+func usersKey(user string) string {
+	return keyPrefix + "users:" + user
+}
+
+func aliveKey(node string) string {
+	return keyPrefix + "alive:" + node
+}
+
+func nodeChannel(node string) string {
+	return keyPrefix + "events:" + node
+}
+
+const broadcastChannel = keyPrefix + "events"
+
+func (b *RedisBus) Node() string {
+	return b.node
+}
+
+// Connect does not register user when it fails.
+func (b *RedisBus) Connect(ctx context.Context, user string) (bool, error) {
+	if err := b.client.SAdd(ctx, usersKey(user), b.node).Err(); err != nil {
+		return false, err
+	}
+
+	others, err := b.otherNodes(ctx, user)
+	if err != nil {
+		b.client.SRem(ctx, usersKey(user), b.node)
+		return false, err
+	}
+
+	b.mu.Lock()
+	b.users[user] = true
+	b.mu.Unlock()
+	return len(others) == 0, nil
+}
+
+func (b *RedisBus) Disconnect(ctx context.Context, user string) (bool, error) {
+	b.mu.Lock()
+	delete(b.users, user)
+	b.mu.Unlock()
+
+	if err := b.client.SRem(ctx, usersKey(user), b.node).Err(); err != nil {
+		return false, err
+	}
+
+	others, err := b.otherNodes(ctx, user)
+	return len(others) == 0, err
+}
+
+func (b *RedisBus) Online(ctx context.Context, user string) (bool, error) {
+	isMember, err := b.client.SIsMember(ctx, usersKey(user), b.node).Result()
+	if err != nil || isMember {
+		return isMember, err
+	}
+
+	others, err := b.otherNodes(ctx, user)
+	return len(others) > 0, err
+}
+
+// otherNodes returns the nodes other than this one user is connected to, the
+// nodes which are no longer alive are removed.
+func (b *RedisBus) otherNodes(ctx context.Context, user string) ([]string, error) {
+	nodes, err := b.client.SMembers(ctx, usersKey(user)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var others []string
+	for _, node := range nodes {
+		if node == b.node {
+			continue
+		}
+
+		alive, err := b.client.Exists(ctx, aliveKey(node)).Result()
+		if err != nil {
+			return nil, err
+		}
+		if alive == 0 {
+			b.client.SRem(ctx, usersKey(user), node)
+			continue
+		}
+		others = append(others, node)
+	}
+	return others, nil
+}
+
+func (b *RedisBus) Publish(ctx context.Context, event Event) error {
+	nodes, err := b.otherNodes(ctx, event.User)
+	if err != nil || len(nodes) == 0 {
+		return err
+	}
+
+	data, err := b.encode(event)
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		if err := b.client.Publish(ctx, nodeChannel(node), data).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *RedisBus) Broadcast(ctx context.Context, event Event) error {
+	data, err := b.encode(event)
+	if err != nil {
+		return err
+	}
+	return b.client.Publish(ctx, broadcastChannel, data).Err()
+}
+
+func (b *RedisBus) encode(event Event) ([]byte, error) {
+	event.Node = b.node
+	return json.Marshal(event)
+}
+
+var errSubscriptionClosed = errors.New("the subscription was closed")
+
+// Listen also keeps this node alive while it listens.
+func (b *RedisBus) Listen(ctx context.Context, handle func(Event)) error {
+	pubsub := b.client.Subscribe(ctx, nodeChannel(b.node), broadcastChannel)
+	defer pubsub.Close()
+
+	// wait for the subscription, so no event sent afterwards is lost
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return err
+	}
+	if err := b.alive(ctx); err != nil {
+		return err
+	}
+	// the other nodes stop sending to this one right away
+	defer b.client.Del(context.Background(), aliveKey(b.node))
+
+	ticker := time.NewTicker(aliveInterval)
+	defer ticker.Stop()
+
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := b.alive(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("Failed to keep node %s alive: %v\n", b.node, err)
+			}
+		case message, ok := <-messages:
+			if !ok {
+				return errSubscriptionClosed
+			}
+
+			var event Event
+			if err := json.Unmarshal([]byte(message.Payload), &event); err != nil {
+				log.Printf("Invalid bus event on %s: %v\n", message.Channel, err)
+				continue
+			}
+			// broadcasts reach the sender too
+			if event.Node != b.node {
+				handle(event)
+			}
+		}
+	}
+}
+
+// alive keeps this node alive. When its key expired, or keeping it alive
+// failed before, the other nodes may have dropped the users of this node,
+// they are registered again.
+func (b *RedisBus) alive(ctx context.Context) error {
+	err := b.client.SetArgs(ctx, aliveKey(b.node), time.Now().Unix(), redis.SetArgs{TTL: aliveTTL, Get: true}).Err()
+	expired := err == redis.Nil
+	if err != nil && !expired {
+		b.setLost(true)
+		return err
+	}
+
+	b.mu.Lock()
+	restore := expired || b.lost
+	var users []string
+	if restore {
+		for user := range b.users {
+			users = append(users, user)
+		}
+	}
+	b.mu.Unlock()
+	if !restore || len(users) == 0 {
+		b.setLost(false)
+		return nil
+	}
+
+	pipe := b.client.Pipeline()
+	for _, user := range users {
+		pipe.SAdd(ctx, usersKey(user), b.node)
+	}
+	_, err = pipe.Exec(ctx)
+	b.setLost(err != nil)
+	return err
+}
+
+func (b *RedisBus) setLost(lost bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lost = lost
+}
@@ -0,0 +1,64 @@
+// Package crypto derives the safety numbers users compare out of band to
+// verify each other's keys.
+package crypto
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const (
+	// fingerprintVersion is hashed first so the scheme can change later.
+	fingerprintVersion = 0
+	// fingerprintIterations makes finding a key with a matching fingerprint
+	// expensive, it is the count used by Signal.
+	fingerprintIterations = 5200
+	// fingerprintChunks of five digits make the fingerprint of one user.
+	fingerprintChunks = 6
+)
+
+// Fingerprint returns the 30 digit fingerprint of the key of the user id,
+// derived like the numeric fingerprints of Signal: the version, the key and
+// the id are hashed with SHA-512, then the hash and the key are hashed again
+// for every iteration. Every 5 bytes of the result give 5 digits.
+func Fingerprint(id string, publicKey []byte) string {
+	h := sha512.New()
+	h.Write([]byte{0, fingerprintVersion})
+	h.Write(publicKey)
+	h.Write([]byte(id))
+	hash := h.Sum(nil)
+
+	for i := 0; i < fingerprintIterations; i++ {
+		h.Reset()
+		h.Write(hash)
+		h.Write(publicKey)
+		hash = h.Sum(hash[:0])
+	}
+
+	var b strings.Builder
+	for i := 0; i < fingerprintChunks; i++ {
+		chunk := make([]byte, 8)
+		copy(chunk[3:], hash[i*5:i*5+5])
+		fmt.Fprintf(&b, "%05d", binary.BigEndian.Uint64(chunk)%100000)
+	}
+	return b.String()
+}
+
+// SafetyNumber returns the 60 digit safety number of two users, it is the
+// same whichever order they are passed in. The digits are grouped by five,
+// separated by spaces.
+func SafetyNumber(idA string, keyA []byte, idB string, keyB []byte) string {
+	a, b := Fingerprint(idA, keyA), Fingerprint(idB, keyB)
+	if b < a {
+		a, b = b, a
+	}
+
+	digits := a + b
+	groups := make([]string, 0, len(digits)/5)
+	for i := 0; i < len(digits); i += 5 {
+		groups = append(groups, digits[i:i+5])
+	}
+	return strings.Join(groups, " ")
+}
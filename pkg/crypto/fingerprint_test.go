@@ -0,0 +1,37 @@
+package crypto
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestFingerprint(t *testing.T) {
+	fingerprint := Fingerprint("alice", []byte("alice-key"))
+	if !regexp.MustCompile(`^[0-9]{30}$`).MatchString(fingerprint) {
+		t.Errorf("Expected 30 digits, got %s", fingerprint)
+	}
+
+	if again := Fingerprint("alice", []byte("alice-key")); again != fingerprint {
+		t.Errorf("Expected the same fingerprint, got %s and %s", fingerprint, again)
+	}
+	if other := Fingerprint("alice", []byte("other-key")); other == fingerprint {
+		t.Errorf("Expected another fingerprint for another key, got %s", other)
+	}
+	if other := Fingerprint("bob", []byte("alice-key")); other == fingerprint {
+		t.Errorf("Expected another fingerprint for another user, got %s", other)
+	}
+}
+
+func TestSafetyNumber(t *testing.T) {
+	number := SafetyNumber("alice", []byte("alice-key"), "bob", []byte("bob-key"))
+	if !regexp.MustCompile(`^[0-9]{5}( [0-9]{5}){11}$`).MatchString(number) {
+		t.Errorf("Expected 12 groups of 5 digits, got %s", number)
+	}
+
+	if reversed := SafetyNumber("bob", []byte("bob-key"), "alice", []byte("alice-key")); reversed != number {
+		t.Errorf("Expected the same safety number in both orders, got %s and %s", number, reversed)
+	}
+	if other := SafetyNumber("alice", []byte("alice-key"), "bob", []byte("new-key")); other == number {
+		t.Errorf("Expected another safety number after a key change, got %s", other)
+	}
+}
@@ -0,0 +1,104 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// dialect holds what differs between the supported SQL databases, the
+// schema itself lives in migrations/<driver>.
+type dialect struct {
+	// migrationsTable records the applied migrations
+	migrationsTable string
+	// numbered uses $1, $2, ... placeholders instead of ?
+	numbered bool
+	// skipLocked is appended to a SELECT to skip rows locked by concurrent
+	// transactions, sqlite3 has a single writer so it needs nothing
+	skipLocked string
+	// lockTable is a statement taking an exclusive lock on the table %s until
+	// the transaction ends, sqlite3 transactions already lock the database
+	lockTable string
+	// dsnOptions are added to the query of the data source name
+	dsnOptions string
+	// migrationLock and migrationUnlock take and release a lock held by a
+	// connection while it migrates, sqlite3 migrations rely on the write
+	// lock taken when their transaction begins
+	migrationLock   string
+	migrationUnlock string
+}
+
+var dialects = map[string]dialect{
+	"sqlite3": {
+		migrationsTable: "CREATE TABLE IF NOT EXISTS SchemaMigrations (version INTEGER PRIMARY KEY, name TEXT, applied_at DATE)",
+		// transactions take the write lock when they begin, a transaction
+		// which reads before it writes otherwise fails with "database is
+		// locked" when another connection wrote in between
+		dsnOptions: "_txlock=immediate",
+	},
+	"postgres": {
+		migrationsTable: "CREATE TABLE IF NOT EXISTS SchemaMigrations (version INTEGER PRIMARY KEY, name TEXT, applied_at TIMESTAMPTZ)",
+		numbered:        true,
+		skipLocked:      " FOR UPDATE SKIP LOCKED",
+		lockTable:       "LOCK TABLE %s IN EXCLUSIVE MODE",
+		migrationLock:   "SELECT pg_advisory_lock(?)",
+		migrationUnlock: "SELECT pg_advisory_unlock(?)",
+	},
+}
+
+func getDialect(driver string) (dialect, error) {
+	d, ok := dialects[driver]
+	if !ok {
+		return dialect{}, fmt.Errorf("unsupported database driver %q", driver)
+	}
+	return d, nil
+}
+
+// dsn adds the options of the dialect to the data source name uri.
+func (d dialect) dsn(uri string) string {
+	if d.dsnOptions == "" {
+		return uri
+	}
+	if strings.Contains(uri, "?") {
+		return uri + "&" + d.dsnOptions
+	}
+	return uri + "?" + d.dsnOptions
+}
+
+// rebind rewrites the ? placeholders of query for the dialect.
+func (d dialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// isUniqueViolation reports whether err was caused by a duplicate primary or
+// unique key.
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey || sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505"
+	}
+	return false
+}
@@ -0,0 +1,22 @@
+package db
+
+import "testing"
+
+func TestRebind(t *testing.T) {
+	query := "UPDATE Users SET last_activity = ? WHERE id = ?"
+
+	sqlite, _ := getDialect("sqlite3")
+	if got := sqlite.rebind(query); got != query {
+		t.Errorf("Expected %s, got %s", query, got)
+	}
+
+	postgres, _ := getDialect("postgres")
+	expected := "UPDATE Users SET last_activity = $1 WHERE id = $2"
+	if got := postgres.rebind(query); got != expected {
+		t.Errorf("Expected %s, got %s", expected, got)
+	}
+
+	if _, err := getDialect("mysql"); err == nil {
+		t.Errorf("Expected an error for an unsupported driver")
+	}
+}
@@ -2,39 +2,64 @@ package db
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	"time"
 
 	"enigma-protocol-go/pkg/models"
 	"enigma-protocol-go/pkg/utils"
-
-	_ "github.com/mattn/go-sqlite3"
 )
 
+// Database is the Store for SQL databases, sqlite3 and postgres are
+// supported.
 type Database struct {
-	driver string
-	uri    string
-	conn   *sql.DB
+	driver  string
+	uri     string
+	conn    *sql.DB
+	dialect dialect
+	// newUserID generates the ids of new users
+	newUserID func() (string, error)
 }
 
 type DatabaseOpts struct {
 	Driver string
 	Uri    string
+	// DryRun opens the database without applying pending migrations, use
+	// PendingMigrations to see what would be applied.
+	DryRun bool
+	// UserIDs is the format of the ids of new users.
+	UserIDs utils.IDFormat
 }
 
 func NewDatabase(dbopts DatabaseOpts) (*Database, error) {
-	conn, err := sql.Open(dbopts.Driver, dbopts.Uri)
+	dialect, err := getDialect(dbopts.Driver)
+	if err != nil {
+		return nil, err
+	}
+	if err := dbopts.UserIDs.Validate(); err != nil {
+		return nil, err
+	}
+
+	conn, err := sql.Open(dbopts.Driver, dialect.dsn(dbopts.Uri))
 	if err != nil {
 		return nil, err
 	}
 
 	db := &Database{
-		driver: dbopts.Driver,
-		uri:    dbopts.Uri,
-		conn:   conn,
+		driver:    dbopts.Driver,
+		uri:       dbopts.Uri,
+		conn:      conn,
+		dialect:   dialect,
+		newUserID: dbopts.UserIDs.NewID,
 	}
 
-	err = db.CreateTable()
+	if dbopts.DryRun {
+		_, err = db.PendingMigrations()
+	} else {
+		err = db.Migrate()
+	}
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
@@ -48,60 +73,623 @@ func NewDefaultDatabase() (*Database, error) {
 	})
 }
 
-func (d *Database) CreateTable() error {
-	_, err := d.conn.Exec("CREATE TABLE IF NOT EXISTS Users (id TEXT PRIMARY KEY, publicKey TEXT, last_activity DATE)")
+func (d *Database) exec(query string, args ...interface{}) (sql.Result, error) {
+	return d.conn.Exec(d.dialect.rebind(query), args...)
+}
+
+func (d *Database) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return d.conn.Query(d.dialect.rebind(query), args...)
+}
+
+func (d *Database) queryRow(query string, args ...interface{}) *sql.Row {
+	return d.conn.QueryRow(d.dialect.rebind(query), args...)
+}
+
+// nullString stores empty strings as NULL.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// nullInt64 stores zero as NULL.
+func nullInt64(n int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: n, Valid: n != 0}
+}
+
+// transaction runs fn in a transaction which is committed if fn succeeds.
+func (d *Database) transaction(fn func(tx *sql.Tx) error) error {
+	tx, err := d.conn.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	_, err = d.conn.Exec("CREATE TABLE IF NOT EXISTS PendingMessages (id INTEGER PRIMARY KEY AUTOINCREMENT, fromUser TEXT, toUser TEXT, payload TEXT)")
-	return err
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *Database) Close() error {
+	return d.conn.Close()
 }
 
 func (d *Database) GetPublicKey(id string) (string, error) {
 	var key string
-	err := d.conn.QueryRow("SELECT publicKey FROM Users WHERE id = ?", id).Scan(&key)
+	err := d.queryRow("SELECT publicKey FROM Users WHERE id = ?", id).Scan(&key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
 	return key, err
 }
 
-func (d *Database) SaveUser(publicKey string) (string, error) {
-	id, err := utils.RandomHex(5)
+func (d *Database) SaveUser(publicKey string, keyType string) (string, error) {
+	now := time.Now().UTC()
+	generation, err := utils.RandomHex(16)
 	if err != nil {
 		return "", err
 	}
 
-	stmt, err := d.conn.Prepare("INSERT INTO Users (id, publicKey, last_activity) VALUES (?, ?, ?)")
-	if err != nil {
-		return "", err
+	for attempt := 0; attempt < maxIDAttempts; attempt++ {
+		id, err := d.newUserID()
+		if err != nil {
+			return "", err
+		}
+
+		err = d.transaction(func(tx *sql.Tx) error {
+			_, err := tx.Exec(
+				d.dialect.rebind("INSERT INTO Users (id, publicKey, keyType, tokenGeneration, last_activity) VALUES (?, ?, ?, ?, ?)"),
+				id, publicKey, nullString(keyType), generation, now,
+			)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec(
+				d.dialect.rebind("INSERT INTO Devices (userId, id, publicKey, created_at) VALUES (?, ?, ?, ?)"),
+				id, models.PrimaryDevice, publicKey, now,
+			)
+			if err != nil {
+				return err
+			}
+
+			return d.appendKeyLog(tx, models.KeyLogEntry{User: id, PublicKey: publicKey, Timestamp: now.Unix()})
+		})
+		if err == nil {
+			return id, nil
+		} else if !isUniqueViolation(err) {
+			return "", err
+		}
 	}
+	return "", ErrNoFreeID
+}
 
-	_, err = stmt.Exec(id, publicKey, time.Now())
-	return id, err
+func (d *Database) GetKeyType(id string) (string, error) {
+	var keyType sql.NullString
+	err := d.queryRow("SELECT keyType FROM Users WHERE id = ?", id).Scan(&keyType)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	return keyType.String, err
+}
+
+func (d *Database) GetTokenGeneration(id string) (string, error) {
+	var generation sql.NullString
+	err := d.queryRow("SELECT tokenGeneration FROM Users WHERE id = ?", id).Scan(&generation)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	return generation.String, err
 }
 
 func (d *Database) IsUserExists(id string) bool {
 	var count int
-	d.conn.QueryRow("SELECT COUNT(*) FROM Users WHERE id = ?", id).Scan(&count)
+	d.queryRow("SELECT COUNT(*) FROM Users WHERE id = ?", id).Scan(&count)
 	return count > 0
 }
 
 func (d *Database) UpdateActivity(id string) error {
-	_, err := d.conn.Exec("UPDATE Users SET last_activity = ? WHERE id = ?", time.Now(), id)
+	_, err := d.exec("UPDATE Users SET last_activity = ? WHERE id = ?", time.Now().UTC(), id)
 	return err
 }
 
-func (d *Database) SavePendingMessage(message models.TransmissionData) error {
-	stmt, err := d.conn.Prepare("INSERT INTO PendingMessages (fromUser, toUser, payload) VALUES (?, ?, ?)")
+func (d *Database) UpdatePublicKey(userID string, publicKey string, keyType string) error {
+	return d.transaction(func(tx *sql.Tx) error {
+		var oldKey string
+		err := tx.QueryRow(d.dialect.rebind("SELECT publicKey FROM Users WHERE id = ?"), userID).Scan(&oldKey)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		} else if err != nil {
+			return err
+		}
+
+		statements := []struct {
+			query string
+			args  []interface{}
+		}{
+			{"INSERT INTO KeyHistory (userId, publicKey, replaced_at) VALUES (?, ?, ?)", []interface{}{userID, oldKey, time.Now().UTC()}},
+			{"UPDATE Users SET publicKey = ?, keyType = ? WHERE id = ?", []interface{}{publicKey, nullString(keyType), userID}},
+			{"UPDATE Devices SET publicKey = ? WHERE userId = ? AND id = ?", []interface{}{publicKey, userID, models.PrimaryDevice}},
+			{"DELETE FROM SignedPreKeys WHERE userId = ?", []interface{}{userID}},
+		}
+
+		for _, statement := range statements {
+			_, err = tx.Exec(d.dialect.rebind(statement.query), statement.args...)
+			if err != nil {
+				return err
+			}
+		}
+		return d.appendKeyLog(tx, models.KeyLogEntry{User: userID, PublicKey: publicKey, Timestamp: time.Now().Unix()})
+	})
+}
+
+// appendKeyLog adds entry to the end of the key log. The log is locked
+// until tx ends so concurrent appends get consecutive positions.
+func (d *Database) appendKeyLog(tx *sql.Tx, entry models.KeyLogEntry) error {
+	if d.dialect.lockTable != "" {
+		_, err := tx.Exec(fmt.Sprintf(d.dialect.lockTable, "KeyLog"))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := tx.Exec(
+		d.dialect.rebind(`INSERT INTO KeyLog (seq, userId, device, publicKey, removed, logged_at)
+		SELECT COALESCE(MAX(seq) + 1, 0), CAST(? AS TEXT), CAST(? AS TEXT), CAST(? AS TEXT), CAST(? AS BOOLEAN), CAST(? AS BIGINT) FROM KeyLog`),
+		entry.User, nullString(entry.Device), entry.PublicKey, entry.Removed, entry.Timestamp,
+	)
+	return err
+}
+
+func (d *Database) GetKeyLog(from int) ([]models.KeyLogEntry, error) {
+	rows, err := d.query("SELECT userId, device, publicKey, removed, logged_at FROM KeyLog WHERE seq >= ? ORDER BY seq", from)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []models.KeyLogEntry
+	for rows.Next() {
+		var entry models.KeyLogEntry
+		var device sql.NullString
+		err = rows.Scan(&entry.User, &device, &entry.PublicKey, &entry.Removed, &entry.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		entry.Device = device.String
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+func (d *Database) GetKeyHistory(userID string) ([]models.PreviousKey, error) {
+	rows, err := d.query("SELECT publicKey, replaced_at FROM KeyHistory WHERE userId = ? ORDER BY replaced_at DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []models.PreviousKey
+	for rows.Next() {
+		var key models.PreviousKey
+		err = rows.Scan(&key.PublicKey, &key.ReplacedAt)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (d *Database) AddKeyFetcher(userID string, fetcherID string) error {
+	_, err := d.exec(
+		"INSERT INTO KeyFetchers (userId, fetcherId, fetched_at) VALUES (?, ?, ?) ON CONFLICT (userId, fetcherId) DO UPDATE SET fetched_at = excluded.fetched_at",
+		userID, fetcherID, time.Now().UTC(),
+	)
+	return err
+}
+
+func (d *Database) GetKeyFetchers(userID string) ([]string, error) {
+	rows, err := d.query("SELECT fetcherId FROM KeyFetchers WHERE userId = ? ORDER BY fetcherId", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var fetchers []string
+	for rows.Next() {
+		var fetcher string
+		err = rows.Scan(&fetcher)
+		if err != nil {
+			return nil, err
+		}
+		fetchers = append(fetchers, fetcher)
+	}
+
+	return fetchers, rows.Err()
+}
+
+func (d *Database) GetInactiveUsers(before time.Time) ([]models.InactiveUser, error) {
+	rows, err := d.query("SELECT id, last_activity FROM Users WHERE last_activity < ? ORDER BY last_activity, id", before.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []models.InactiveUser
+	for rows.Next() {
+		var user models.InactiveUser
+		err = rows.Scan(&user.ID, &user.LastActivity)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+func (d *Database) DeleteUser(id string) error {
+	return d.transaction(func(tx *sql.Tx) error {
+		if err := d.logRemovedDevices(tx, id); err != nil {
+			return err
+		}
+
+		statements := []struct {
+			query string
+			args  []interface{}
+		}{
+			{"DELETE FROM PendingDeliveries WHERE messageId IN (SELECT id FROM PendingMessages WHERE toUser = ?)", []interface{}{id}},
+			{"DELETE FROM PendingMessages WHERE toUser = ?", []interface{}{id}},
+			{"DELETE FROM GroupMembers WHERE userId = ? OR groupId IN (SELECT id FROM Groups WHERE owner = ?)", []interface{}{id, id}},
+			{"DELETE FROM Groups WHERE owner = ?", []interface{}{id}},
+			{"DELETE FROM SignedPreKeys WHERE userId = ?", []interface{}{id}},
+			{"DELETE FROM OneTimePreKeys WHERE userId = ?", []interface{}{id}},
+			{"DELETE FROM PreKeyMarks WHERE userId = ?", []interface{}{id}},
+			{"DELETE FROM KeyHistory WHERE userId = ?", []interface{}{id}},
+			{"DELETE FROM KeyFetchers WHERE userId = ? OR fetcherId = ?", []interface{}{id, id}},
+			{"DELETE FROM Handles WHERE userId = ?", []interface{}{id}},
+			{"DELETE FROM Devices WHERE userId = ?", []interface{}{id}},
+			{"DELETE FROM Users WHERE id = ?", []interface{}{id}},
+		}
+
+		for _, statement := range statements {
+			_, err := tx.Exec(d.dialect.rebind(statement.query), statement.args...)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// logRemovedDevices appends the removal of every device of the user to the
+// key log.
+func (d *Database) logRemovedDevices(tx *sql.Tx, userID string) error {
+	rows, err := tx.Query(d.dialect.rebind("SELECT id, publicKey FROM Devices WHERE userId = ? ORDER BY created_at, id"), userID)
 	if err != nil {
 		return err
 	}
 
-	_, err = stmt.Exec(message.From, message.To, message.Payload)
+	var devices []models.Device
+	for rows.Next() {
+		var device models.Device
+		if err := rows.Scan(&device.ID, &device.PublicKey); err != nil {
+			rows.Close()
+			return err
+		}
+		devices = append(devices, device)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	for _, device := range devices {
+		err := d.appendKeyLog(tx, models.KeyLogEntry{User: userID, Device: device.ID, PublicKey: device.PublicKey, Removed: true, Timestamp: now})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Database) SetHandle(userID string, handle string, skeleton string) error {
+	err := d.transaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec(d.dialect.rebind("DELETE FROM Handles WHERE userId = ?"), userID)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			d.dialect.rebind("INSERT INTO Handles (userId, handle, skeleton, claimed_at) VALUES (?, ?, ?, ?)"),
+			userID, handle, skeleton, time.Now().UTC(),
+		)
+		return err
+	})
+	if isUniqueViolation(err) {
+		return ErrHandleTaken
+	}
+	return err
+}
+
+func (d *Database) DeleteHandle(userID string) error {
+	_, err := d.exec("DELETE FROM Handles WHERE userId = ?", userID)
+	return err
+}
+
+func (d *Database) GetHandle(userID string) (string, error) {
+	var handle string
+	err := d.queryRow("SELECT handle FROM Handles WHERE userId = ?", userID).Scan(&handle)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	return handle, err
+}
+
+func (d *Database) GetHandleUser(handle string) (string, error) {
+	var userID string
+	err := d.queryRow("SELECT userId FROM Handles WHERE handle = ?", handle).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	return userID, err
+}
+
+func (d *Database) AddDevice(userID string, publicKey string) (string, error) {
+	if !d.IsUserExists(userID) {
+		return "", ErrNotFound
+	}
+
+	id, err := utils.RandomHex(4)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	err = d.transaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			d.dialect.rebind("INSERT INTO Devices (userId, id, publicKey, created_at) VALUES (?, ?, ?, ?)"),
+			userID, id, publicKey, now,
+		)
+		if err != nil {
+			return err
+		}
+		return d.appendKeyLog(tx, models.KeyLogEntry{User: userID, Device: id, PublicKey: publicKey, Timestamp: now.Unix()})
+	})
+	return id, err
+}
+
+func (d *Database) GetDevices(userID string) ([]models.Device, error) {
+	rows, err := d.query("SELECT id, publicKey FROM Devices WHERE userId = ? ORDER BY created_at, id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []models.Device
+	for rows.Next() {
+		var device models.Device
+		err = rows.Scan(&device.ID, &device.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+
+	return devices, rows.Err()
+}
+
+func (d *Database) GetDevicePublicKey(userID string, deviceID string) (string, error) {
+	var key string
+	err := d.queryRow("SELECT publicKey FROM Devices WHERE userId = ? AND id = ?", userID, deviceID).Scan(&key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotFound
+	}
+	return key, err
+}
+
+// newGroupID returns a random group id, the prefix keeps them apart from
+// user ids.
+func newGroupID() (string, error) {
+	id, err := utils.RandomHex(5)
+	return "g-" + id, err
+}
+
+func (d *Database) CreateGroup(owner string, members []string) (string, error) {
+	id, err := newGroupID()
+	if err != nil {
+		return "", err
+	}
+
+	err = d.transaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec(d.dialect.rebind("INSERT INTO Groups (id, owner, created_at) VALUES (?, ?, ?)"), id, owner, time.Now())
+		if err != nil {
+			return err
+		}
+
+		seen := make(map[string]bool)
+		for _, member := range append([]string{owner}, members...) {
+			if seen[member] {
+				continue
+			}
+			seen[member] = true
+
+			_, err = tx.Exec(d.dialect.rebind("INSERT INTO GroupMembers (groupId, userId) VALUES (?, ?)"), id, member)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return id, err
+}
+
+func (d *Database) GetGroup(id string) (models.Group, error) {
+	group := models.Group{ID: id}
+	err := d.queryRow("SELECT owner FROM Groups WHERE id = ?", id).Scan(&group.Owner)
+	if errors.Is(err, sql.ErrNoRows) {
+		return group, ErrNotFound
+	} else if err != nil {
+		return group, err
+	}
+
+	rows, err := d.query("SELECT userId FROM GroupMembers WHERE groupId = ? ORDER BY userId", id)
+	if err != nil {
+		return group, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var member string
+		err = rows.Scan(&member)
+		if err != nil {
+			return group, err
+		}
+		group.Members = append(group.Members, member)
+	}
+
+	return group, rows.Err()
+}
+
+func (d *Database) AddGroupMember(groupID string, userID string) error {
+	_, err := d.exec(
+		"INSERT INTO GroupMembers (groupId, userId) SELECT id, CAST(? AS TEXT) FROM Groups WHERE id = ? AND NOT EXISTS (SELECT 1 FROM GroupMembers WHERE groupId = ? AND userId = ?)",
+		userID, groupID, groupID, userID,
+	)
 	return err
 }
 
-func (d *Database) GetPendingMessages(toUser string) ([]models.TransmissionData, error) {
-	rows, err := d.conn.Query("SELECT fromUser, payload FROM PendingMessages WHERE toUser = ?", toUser)
+func (d *Database) RemoveGroupMember(groupID string, userID string) error {
+	_, err := d.exec("DELETE FROM GroupMembers WHERE groupId = ? AND userId = ?", groupID, userID)
+	return err
+}
+
+func (d *Database) SetSignedPreKey(userID string, key models.SignedPreKey) error {
+	_, err := d.exec(
+		`INSERT INTO SignedPreKeys (userId, keyId, publicKey, signature, created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (userId) DO UPDATE SET keyId = excluded.keyId, publicKey = excluded.publicKey,
+		signature = excluded.signature, created_at = excluded.created_at`,
+		userID, key.KeyID, key.PublicKey, key.Signature, time.Now().UTC(),
+	)
+	return err
+}
+
+func (d *Database) GetSignedPreKey(userID string) (models.SignedPreKey, error) {
+	var key models.SignedPreKey
+	err := d.queryRow("SELECT keyId, publicKey, signature FROM SignedPreKeys WHERE userId = ?", userID).
+		Scan(&key.KeyID, &key.PublicKey, &key.Signature)
+	if errors.Is(err, sql.ErrNoRows) {
+		return key, ErrNotFound
+	}
+	return key, err
+}
+
+// AddOneTimePreKeys counts and stores the keys in one transaction, the
+// marks are locked so concurrent uploads cannot exceed max together.
+func (d *Database) AddOneTimePreKeys(userID string, keys []models.PreKey, max int) (int, error) {
+	var count int
+	err := d.transaction(func(tx *sql.Tx) error {
+		if d.dialect.lockTable != "" {
+			_, err := tx.Exec(fmt.Sprintf(d.dialect.lockTable, "PreKeyMarks"))
+			if err != nil {
+				return err
+			}
+		}
+
+		var mark int64
+		err := tx.QueryRow(d.dialect.rebind("SELECT maxKeyId FROM PreKeyMarks WHERE userId = ?"), userID).Scan(&mark)
+		marked := err == nil
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		err = tx.QueryRow(d.dialect.rebind("SELECT COUNT(*) FROM OneTimePreKeys WHERE userId = ?"), userID).Scan(&count)
+		if err != nil {
+			return err
+		}
+
+		fresh, mark := newPreKeys(keys, mark, marked)
+		if len(fresh) == 0 {
+			return nil
+		}
+		if count+len(fresh) > max {
+			return ErrTooManyPreKeys
+		}
+
+		for _, key := range fresh {
+			_, err := tx.Exec(
+				d.dialect.rebind("INSERT INTO OneTimePreKeys (userId, keyId, publicKey) VALUES (?, ?, ?)"),
+				userID, key.KeyID, key.PublicKey,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		count += len(fresh)
+
+		_, err = tx.Exec(
+			d.dialect.rebind("INSERT INTO PreKeyMarks (userId, maxKeyId) VALUES (?, ?) ON CONFLICT (userId) DO UPDATE SET maxKeyId = excluded.maxKeyId"),
+			userID, mark,
+		)
+		return err
+	})
+	return count, err
+}
+
+// ConsumeOneTimePreKey deletes the key in the same statement it is selected
+// in, so concurrent requests never get the same key.
+func (d *Database) ConsumeOneTimePreKey(userID string) (models.PreKey, error) {
+	var key models.PreKey
+	err := d.queryRow(
+		"DELETE FROM OneTimePreKeys WHERE id = (SELECT id FROM OneTimePreKeys WHERE userId = ? ORDER BY id LIMIT 1"+d.dialect.skipLocked+") RETURNING keyId, publicKey",
+		userID,
+	).Scan(&key.KeyID, &key.PublicKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return key, ErrNotFound
+	}
+	return key, err
+}
+
+func (d *Database) CountOneTimePreKeys(userID string) (int, error) {
+	var count int
+	err := d.queryRow("SELECT COUNT(*) FROM OneTimePreKeys WHERE userId = ?", userID).Scan(&count)
+	return count, err
+}
+
+// SavePendingMessage stores the message until every device of the receiver
+// acknowledges it and returns the ID assigned to it.
+func (d *Database) SavePendingMessage(message models.TransmissionData) (int64, error) {
+	var id int64
+	err := d.transaction(func(tx *sql.Tx) error {
+		err := tx.QueryRow(
+			d.dialect.rebind("INSERT INTO PendingMessages (type, fromUser, toUser, groupId, ref, payload, created_at, size) VALUES (?, ?, ?, ?, ?, ?, ?, ?) RETURNING id"),
+			nullString(message.Type), message.From, message.To, nullString(message.Group), nullInt64(message.Ref), message.Payload,
+			time.Now().UTC(), len(message.Payload),
+		).Scan(&id)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			d.dialect.rebind("INSERT INTO PendingDeliveries (messageId, device) SELECT CAST(? AS BIGINT), id FROM Devices WHERE userId = ?"),
+			id, message.To,
+		)
+		return err
+	})
+	return id, err
+}
+
+func (d *Database) GetPendingMessages(toUser string, device string) ([]models.TransmissionData, error) {
+	rows, err := d.query(
+		`SELECT m.id, m.type, m.fromUser, m.groupId, m.ref, m.payload FROM PendingMessages m
+		JOIN PendingDeliveries p ON p.messageId = m.id
+		WHERE m.toUser = ? AND p.device = ? ORDER BY m.id`,
+		toUser, device,
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -109,23 +697,142 @@ func (d *Database) GetPendingMessages(toUser string) ([]models.TransmissionData,
 
 	var messages []models.TransmissionData
 	for rows.Next() {
+		var id int64
 		var fromUser, payload string
-		err = rows.Scan(&fromUser, &payload)
+		var messageType, group sql.NullString
+		var ref sql.NullInt64
+		err = rows.Scan(&id, &messageType, &fromUser, &group, &ref, &payload)
 		if err != nil {
 			return nil, err
 		}
 
 		messages = append(messages, models.TransmissionData{
+			Type:    messageType.String,
+			ID:      id,
 			From:    fromUser,
 			To:      toUser,
+			Group:   group.String,
+			Ref:     ref.Int64,
 			Payload: payload,
 		})
 	}
 
-	return messages, nil
+	return messages, rows.Err()
+}
+
+// DeletePendingMessage marks the message as acknowledged by device, the
+// message itself is removed once no device is waiting for it. The receiver
+// is checked so users can only acknowledge their own messages.
+func (d *Database) DeletePendingMessage(toUser string, device string, id int64) error {
+	return d.transaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			d.dialect.rebind("DELETE FROM PendingDeliveries WHERE messageId IN (SELECT id FROM PendingMessages WHERE id = ? AND toUser = ?) AND device = ?"),
+			id, toUser, device,
+		)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			d.dialect.rebind("DELETE FROM PendingMessages WHERE id = ? AND toUser = ? AND NOT EXISTS (SELECT 1 FROM PendingDeliveries WHERE messageId = ?)"),
+			id, toUser, id,
+		)
+		return err
+	})
+}
+
+func (d *Database) MarkDelivered(toUser string, device string, id int64) (bool, error) {
+	result, err := d.exec(
+		"UPDATE PendingDeliveries SET receipted = TRUE WHERE messageId IN (SELECT id FROM PendingMessages WHERE id = ? AND toUser = ?) AND device = ? AND NOT receipted",
+		id, toUser, device,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	rows, err := result.RowsAffected()
+	return rows == 1, err
 }
 
 func (d *Database) DeletePendingMessages(toUser string) error {
-	_, err := d.conn.Exec("DELETE FROM PendingMessages WHERE toUser = ?", toUser)
-	return err
+	return d.transaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			d.dialect.rebind("DELETE FROM PendingDeliveries WHERE messageId IN (SELECT id FROM PendingMessages WHERE toUser = ?)"),
+			toUser,
+		)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(d.dialect.rebind("DELETE FROM PendingMessages WHERE toUser = ?"), toUser)
+		return err
+	})
+}
+
+func (d *Database) PendingStats(toUser string) (int, int64, error) {
+	var count int
+	var size int64
+	err := d.queryRow("SELECT COUNT(*), COALESCE(SUM(size), 0) FROM PendingMessages WHERE toUser = ?", toUser).Scan(&count, &size)
+	return count, size, err
+}
+
+func (d *Database) DeleteExpiredMessages(before time.Time) (int64, error) {
+	var deleted int64
+	err := d.transaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			d.dialect.rebind("DELETE FROM PendingDeliveries WHERE messageId IN (SELECT id FROM PendingMessages WHERE created_at < ?)"),
+			before.UTC(),
+		)
+		if err != nil {
+			return err
+		}
+
+		res, err := tx.Exec(d.dialect.rebind("DELETE FROM PendingMessages WHERE created_at < ?"), before.UTC())
+		if err != nil {
+			return err
+		}
+		deleted, err = res.RowsAffected()
+		return err
+	})
+	return deleted, err
+}
+
+func (d *Database) RevokeToken(id string, expiresAt time.Time) (bool, error) {
+	res, err := d.exec("INSERT INTO RevokedTokens (id, expires_at) VALUES (?, ?) ON CONFLICT (id) DO NOTHING", id, expiresAt.Unix())
+	if err != nil {
+		return false, err
+	}
+	inserted, err := res.RowsAffected()
+	return inserted > 0, err
+}
+
+func (d *Database) IsTokenRevoked(id string) (bool, error) {
+	var count int
+	err := d.queryRow("SELECT COUNT(*) FROM RevokedTokens WHERE id = ?", id).Scan(&count)
+	return count > 0, err
+}
+
+func (d *Database) DeleteExpiredRevocations(before time.Time) (int64, error) {
+	res, err := d.exec("DELETE FROM RevokedTokens WHERE expires_at < ?", before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (d *Database) UseNonce(nonce string, expiresAt time.Time) (bool, error) {
+	res, err := d.exec("INSERT INTO UsedNonces (nonce, expires_at) VALUES (?, ?) ON CONFLICT (nonce) DO NOTHING", nonce, expiresAt.Unix())
+	if err != nil {
+		return false, err
+	}
+	inserted, err := res.RowsAffected()
+	return inserted > 0, err
+}
+
+func (d *Database) DeleteExpiredNonces(before time.Time) (int64, error) {
+	res, err := d.exec("DELETE FROM UsedNonces WHERE expires_at < ?", before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
 }
@@ -64,7 +64,7 @@ func TestSaveUser(t *testing.T) {
 	defer os.Remove("test.db")
 
 	publicKey := "test-public-key"
-	id, err := db.SaveUser(publicKey)
+	id, err := db.SaveUser(publicKey, "")
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -89,22 +89,30 @@ func TestSavePendingMessage(t *testing.T) {
 	defer db.conn.Close()
 	defer os.Remove("test.db")
 
+	to, err := db.SaveUser("test-public-key", "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
 	message := models.TransmissionData{
 		From:    "test-from",
-		To:      "test-to",
+		To:      to,
 		Payload: "test-payload",
 	}
-	err = db.SavePendingMessage(message)
+	message.ID, err = db.SavePendingMessage(message)
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
+	if message.ID == 0 {
+		t.Fatalf("Expected message id to be assigned")
+	}
 
-	messages, err := db.GetPendingMessages(message.To)
+	messages, err := db.GetPendingMessages(message.To, models.PrimaryDevice)
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
 	if len(messages) != 1 || messages[0] != message {
-		t.Fatalf("Expected message %s, got %v", message, messages[0])
+		t.Fatalf("Expected message %v, got %v", message, messages)
 	}
 }
 
@@ -119,12 +127,17 @@ func TestDeletePendingMessages(t *testing.T) {
 	defer db.conn.Close()
 	defer os.Remove("test.db")
 
+	to, err := db.SaveUser("test-public-key", "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
 	message := models.TransmissionData{
 		From:    "test-from",
-		To:      "test-to",
+		To:      to,
 		Payload: "test-payload",
 	}
-	err = db.SavePendingMessage(message)
+	_, err = db.SavePendingMessage(message)
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -134,7 +147,7 @@ func TestDeletePendingMessages(t *testing.T) {
 		t.Fatalf("Expected no error, got %v", err)
 	}
 
-	messages, err := db.GetPendingMessages(message.To)
+	messages, err := db.GetPendingMessages(message.To, models.PrimaryDevice)
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
@@ -142,3 +155,44 @@ func TestDeletePendingMessages(t *testing.T) {
 		t.Fatalf("Expected no messages, got %v", messages)
 	}
 }
+
+func TestDeletePendingMessage(t *testing.T) {
+	db, err := NewDatabase(DatabaseOpts{
+		Driver: "sqlite3",
+		Uri:    "test.db",
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer db.conn.Close()
+	defer os.Remove("test.db")
+
+	to, err := db.SaveUser("test-public-key", "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	first := models.TransmissionData{From: "test-from", To: to, Payload: "first"}
+	second := models.TransmissionData{From: "test-from", To: to, Payload: "second"}
+	first.ID, _ = db.SavePendingMessage(first)
+	second.ID, _ = db.SavePendingMessage(second)
+
+	// only the receiver can acknowledge a message
+	err = db.DeletePendingMessage("test-from", models.PrimaryDevice, first.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	err = db.DeletePendingMessage(first.To, models.PrimaryDevice, first.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	messages, err := db.GetPendingMessages(first.To, models.PrimaryDevice)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(messages) != 1 || messages[0] != second {
+		t.Fatalf("Expected message %v, got %v", second, messages)
+	}
+}
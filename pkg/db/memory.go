@@ -0,0 +1,682 @@
+package db
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"enigma-protocol-go/pkg/models"
+	"enigma-protocol-go/pkg/utils"
+)
+
+type memoryUser struct {
+	publicKey      string
+	keyType        string
+	lastActivity   time.Time
+	devices        []models.Device
+	signedPreKey   *models.SignedPreKey
+	oneTimePreKeys []models.PreKey
+	// preKeyMark is the highest one-time prekey id uploaded, if preKeyMarked
+	preKeyMark   int64
+	preKeyMarked bool
+	// keyHistory holds the previous keys, oldest first
+	keyHistory []models.PreviousKey
+	fetchers   map[string]bool
+	// handle is empty when the user has none
+	handle         string
+	handleSkeleton string
+	// tokenGeneration is bound into the tokens of the user
+	tokenGeneration string
+}
+
+type memoryGroup struct {
+	owner   string
+	members map[string]bool
+}
+
+type memoryMessage struct {
+	message   models.TransmissionData
+	createdAt time.Time
+	// devices which have not acknowledged the message yet
+	devices map[string]bool
+	// devices the sender got a delivered receipt for
+	receipted map[string]bool
+}
+
+// MemoryStore keeps everything in memory, it is meant for tests and
+// ephemeral deployments.
+type MemoryStore struct {
+	mu       sync.Mutex
+	users    map[string]*memoryUser
+	groups   map[string]*memoryGroup
+	messages []*memoryMessage
+	keyLog   []models.KeyLogEntry
+	// revoked maps the revoked token ids to when they expire
+	revoked map[string]time.Time
+	// nonces maps the used nonces of signed requests to when they expire
+	nonces map[string]time.Time
+	nextID int64
+	// newUserID generates the ids of new users
+	newUserID func() (string, error)
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:     make(map[string]*memoryUser),
+		groups:    make(map[string]*memoryGroup),
+		revoked:   make(map[string]time.Time),
+		nonces:    make(map[string]time.Time),
+		newUserID: utils.IDFormat{}.NewID,
+	}
+}
+
+func (m *MemoryStore) SaveUser(publicKey string, keyType string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	generation, err := utils.RandomHex(16)
+	if err != nil {
+		return "", err
+	}
+
+	for attempt := 0; attempt < maxIDAttempts; attempt++ {
+		id, err := m.newUserID()
+		if err != nil {
+			return "", err
+		}
+		if _, ok := m.users[id]; ok {
+			continue
+		}
+
+		m.users[id] = &memoryUser{
+			publicKey:       publicKey,
+			keyType:         keyType,
+			tokenGeneration: generation,
+			lastActivity:    time.Now(),
+			devices:         []models.Device{{ID: models.PrimaryDevice, PublicKey: publicKey}},
+		}
+		m.keyLog = append(m.keyLog, models.KeyLogEntry{User: id, PublicKey: publicKey, Timestamp: time.Now().Unix()})
+		return id, nil
+	}
+	return "", ErrNoFreeID
+}
+
+func (m *MemoryStore) GetPublicKey(id string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[id]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return user.publicKey, nil
+}
+
+func (m *MemoryStore) GetKeyType(id string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[id]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return user.keyType, nil
+}
+
+func (m *MemoryStore) GetTokenGeneration(id string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[id]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return user.tokenGeneration, nil
+}
+
+func (m *MemoryStore) IsUserExists(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.users[id]
+	return ok
+}
+
+func (m *MemoryStore) UpdateActivity(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if user, ok := m.users[id]; ok {
+		user.lastActivity = time.Now()
+	}
+	return nil
+}
+
+func (m *MemoryStore) UpdatePublicKey(userID string, publicKey string, keyType string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+
+	user.keyHistory = append(user.keyHistory, models.PreviousKey{PublicKey: user.publicKey, ReplacedAt: time.Now()})
+	user.publicKey = publicKey
+	user.keyType = keyType
+	for i := range user.devices {
+		if user.devices[i].ID == models.PrimaryDevice {
+			user.devices[i].PublicKey = publicKey
+		}
+	}
+	user.signedPreKey = nil
+	m.keyLog = append(m.keyLog, models.KeyLogEntry{User: userID, PublicKey: publicKey, Timestamp: time.Now().Unix()})
+	return nil
+}
+
+func (m *MemoryStore) GetKeyLog(from int) ([]models.KeyLogEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if from >= len(m.keyLog) {
+		return nil, nil
+	}
+	return append([]models.KeyLogEntry(nil), m.keyLog[from:]...), nil
+}
+
+func (m *MemoryStore) GetKeyHistory(userID string) ([]models.PreviousKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return nil, nil
+	}
+
+	var keys []models.PreviousKey
+	for i := len(user.keyHistory) - 1; i >= 0; i-- {
+		keys = append(keys, user.keyHistory[i])
+	}
+	return keys, nil
+}
+
+func (m *MemoryStore) AddKeyFetcher(userID string, fetcherID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if user, ok := m.users[userID]; ok {
+		if user.fetchers == nil {
+			user.fetchers = make(map[string]bool)
+		}
+		user.fetchers[fetcherID] = true
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetKeyFetchers(userID string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return nil, nil
+	}
+
+	var fetchers []string
+	for fetcher := range user.fetchers {
+		fetchers = append(fetchers, fetcher)
+	}
+	sort.Strings(fetchers)
+	return fetchers, nil
+}
+
+func (m *MemoryStore) GetInactiveUsers(before time.Time) ([]models.InactiveUser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var users []models.InactiveUser
+	for id, user := range m.users {
+		if user.lastActivity.Before(before) {
+			users = append(users, models.InactiveUser{ID: id, LastActivity: user.lastActivity})
+		}
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].LastActivity.Equal(users[j].LastActivity) {
+			return users[i].ID < users[j].ID
+		}
+		return users[i].LastActivity.Before(users[j].LastActivity)
+	})
+	return users, nil
+}
+
+func (m *MemoryStore) DeleteUser(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.deletePendingMessages(func(pending *memoryMessage) bool {
+		return pending.message.To == id
+	})
+
+	for groupID, group := range m.groups {
+		if group.owner == id {
+			delete(m.groups, groupID)
+		} else {
+			delete(group.members, id)
+		}
+	}
+
+	for _, user := range m.users {
+		delete(user.fetchers, id)
+	}
+
+	if user, ok := m.users[id]; ok {
+		now := time.Now().Unix()
+		for _, device := range user.devices {
+			m.keyLog = append(m.keyLog, models.KeyLogEntry{User: id, Device: device.ID, PublicKey: device.PublicKey, Removed: true, Timestamp: now})
+		}
+	}
+
+	delete(m.users, id)
+	return nil
+}
+
+func (m *MemoryStore) SetHandle(userID string, handle string, skeleton string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, user := range m.users {
+		if id != userID && user.handle != "" && user.handleSkeleton == skeleton {
+			return ErrHandleTaken
+		}
+	}
+
+	if user, ok := m.users[userID]; ok {
+		user.handle = handle
+		user.handleSkeleton = skeleton
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteHandle(userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if user, ok := m.users[userID]; ok {
+		user.handle = ""
+		user.handleSkeleton = ""
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetHandle(userID string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok || user.handle == "" {
+		return "", ErrNotFound
+	}
+	return user.handle, nil
+}
+
+func (m *MemoryStore) GetHandleUser(handle string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, user := range m.users {
+		if user.handle != "" && user.handle == handle {
+			return id, nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+func (m *MemoryStore) AddDevice(userID string, publicKey string) (string, error) {
+	id, err := utils.RandomHex(4)
+	if err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return "", ErrNotFound
+	}
+
+	user.devices = append(user.devices, models.Device{ID: id, PublicKey: publicKey})
+	m.keyLog = append(m.keyLog, models.KeyLogEntry{User: userID, Device: id, PublicKey: publicKey, Timestamp: time.Now().Unix()})
+	return id, nil
+}
+
+func (m *MemoryStore) GetDevices(userID string) ([]models.Device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return nil, nil
+	}
+	return append([]models.Device(nil), user.devices...), nil
+}
+
+func (m *MemoryStore) GetDevicePublicKey(userID string, deviceID string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if user, ok := m.users[userID]; ok {
+		for _, device := range user.devices {
+			if device.ID == deviceID {
+				return device.PublicKey, nil
+			}
+		}
+	}
+	return "", ErrNotFound
+}
+
+func (m *MemoryStore) CreateGroup(owner string, members []string) (string, error) {
+	id, err := newGroupID()
+	if err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	group := &memoryGroup{owner: owner, members: map[string]bool{owner: true}}
+	for _, member := range members {
+		group.members[member] = true
+	}
+	m.groups[id] = group
+	return id, nil
+}
+
+func (m *MemoryStore) GetGroup(id string) (models.Group, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	group, ok := m.groups[id]
+	if !ok {
+		return models.Group{ID: id}, ErrNotFound
+	}
+
+	members := make([]string, 0, len(group.members))
+	for member := range group.members {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+
+	return models.Group{ID: id, Owner: group.owner, Members: members}, nil
+}
+
+func (m *MemoryStore) AddGroupMember(groupID string, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if group, ok := m.groups[groupID]; ok {
+		group.members[userID] = true
+	}
+	return nil
+}
+
+func (m *MemoryStore) RemoveGroupMember(groupID string, userID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if group, ok := m.groups[groupID]; ok {
+		delete(group.members, userID)
+	}
+	return nil
+}
+
+func (m *MemoryStore) SetSignedPreKey(userID string, key models.SignedPreKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if user, ok := m.users[userID]; ok {
+		user.signedPreKey = &key
+	}
+	return nil
+}
+
+func (m *MemoryStore) GetSignedPreKey(userID string) (models.SignedPreKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok || user.signedPreKey == nil {
+		return models.SignedPreKey{}, ErrNotFound
+	}
+	return *user.signedPreKey, nil
+}
+
+func (m *MemoryStore) AddOneTimePreKeys(userID string, keys []models.PreKey, max int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok {
+		return 0, nil
+	}
+
+	fresh, mark := newPreKeys(keys, user.preKeyMark, user.preKeyMarked)
+	if len(fresh) == 0 {
+		return len(user.oneTimePreKeys), nil
+	}
+	if len(user.oneTimePreKeys)+len(fresh) > max {
+		return 0, ErrTooManyPreKeys
+	}
+
+	user.oneTimePreKeys = append(user.oneTimePreKeys, fresh...)
+	user.preKeyMark, user.preKeyMarked = mark, true
+	return len(user.oneTimePreKeys), nil
+}
+
+func (m *MemoryStore) ConsumeOneTimePreKey(userID string) (models.PreKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userID]
+	if !ok || len(user.oneTimePreKeys) == 0 {
+		return models.PreKey{}, ErrNotFound
+	}
+
+	key := user.oneTimePreKeys[0]
+	user.oneTimePreKeys = user.oneTimePreKeys[1:]
+	return key, nil
+}
+
+func (m *MemoryStore) CountOneTimePreKeys(userID string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if user, ok := m.users[userID]; ok {
+		return len(user.oneTimePreKeys), nil
+	}
+	return 0, nil
+}
+
+func (m *MemoryStore) SavePendingMessage(message models.TransmissionData) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	devices := make(map[string]bool)
+	if user, ok := m.users[message.To]; ok {
+		for _, device := range user.devices {
+			devices[device.ID] = true
+		}
+	}
+
+	m.nextID++
+	m.messages = append(m.messages, &memoryMessage{
+		message: models.TransmissionData{
+			Type:    message.Type,
+			ID:      m.nextID,
+			From:    message.From,
+			To:      message.To,
+			Group:   message.Group,
+			Ref:     message.Ref,
+			Payload: message.Payload,
+		},
+		createdAt: time.Now(),
+		devices:   devices,
+		receipted: make(map[string]bool),
+	})
+	return m.nextID, nil
+}
+
+func (m *MemoryStore) GetPendingMessages(toUser string, device string) ([]models.TransmissionData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var messages []models.TransmissionData
+	for _, pending := range m.messages {
+		if pending.message.To == toUser && pending.devices[device] {
+			messages = append(messages, pending.message)
+		}
+	}
+	return messages, nil
+}
+
+func (m *MemoryStore) DeletePendingMessage(toUser string, device string, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, pending := range m.messages {
+		if pending.message.To == toUser && pending.message.ID == id {
+			delete(pending.devices, device)
+		}
+	}
+
+	m.deletePendingMessages(func(pending *memoryMessage) bool {
+		return len(pending.devices) == 0
+	})
+	return nil
+}
+
+func (m *MemoryStore) MarkDelivered(toUser string, device string, id int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, pending := range m.messages {
+		if pending.message.To == toUser && pending.message.ID == id && pending.devices[device] {
+			if pending.receipted[device] {
+				return false, nil
+			}
+			pending.receipted[device] = true
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *MemoryStore) DeletePendingMessages(toUser string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.deletePendingMessages(func(pending *memoryMessage) bool {
+		return pending.message.To == toUser
+	})
+	return nil
+}
+
+func (m *MemoryStore) PendingStats(toUser string) (int, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var count int
+	var size int64
+	for _, pending := range m.messages {
+		if pending.message.To == toUser {
+			count++
+			size += int64(len(pending.message.Payload))
+		}
+	}
+	return count, size, nil
+}
+
+func (m *MemoryStore) DeleteExpiredMessages(before time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count := len(m.messages)
+	m.deletePendingMessages(func(pending *memoryMessage) bool {
+		return pending.createdAt.Before(before)
+	})
+	return int64(count - len(m.messages)), nil
+}
+
+// deletePendingMessages removes the matching messages, m.mu must be held.
+func (m *MemoryStore) deletePendingMessages(match func(*memoryMessage) bool) {
+	messages := m.messages[:0]
+	for _, pending := range m.messages {
+		if !match(pending) {
+			messages = append(messages, pending)
+		}
+	}
+	m.messages = messages
+}
+
+func (m *MemoryStore) RevokeToken(id string, expiresAt time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.revoked[id]; ok {
+		return false, nil
+	}
+	m.revoked[id] = expiresAt
+	return true, nil
+}
+
+func (m *MemoryStore) IsTokenRevoked(id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.revoked[id]
+	return ok, nil
+}
+
+func (m *MemoryStore) DeleteExpiredRevocations(before time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var deleted int64
+	for id, expiresAt := range m.revoked {
+		if expiresAt.Before(before) {
+			delete(m.revoked, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+func (m *MemoryStore) UseNonce(nonce string, expiresAt time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.nonces[nonce]; ok {
+		return false, nil
+	}
+	m.nonces[nonce] = expiresAt
+	return true, nil
+}
+
+func (m *MemoryStore) DeleteExpiredNonces(before time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var deleted int64
+	for nonce, expiresAt := range m.nonces {
+		if expiresAt.Before(before) {
+			delete(m.nonces, nonce)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,169 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+var ErrSchemaTooNew = errors.New("database schema is newer than this binary")
+
+// migrationLockID identifies the advisory lock held while migrating.
+const migrationLockID = 0x656e69676d61
+
+// Migration is a single schema change, read from
+// migrations/<driver>/<version>_<name>.sql.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// loadMigrations returns the migrations of driver ordered by version.
+func loadMigrations(driver string) ([]Migration, error) {
+	dir := path.Join("migrations", driver)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".sql")
+		prefix, name, ok := strings.Cut(name, "_")
+		if !ok {
+			return nil, fmt.Errorf("invalid migration file name %s", entry.Name())
+		}
+
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration file name %s", entry.Name())
+		}
+
+		sql, err := fs.ReadFile(migrationFiles, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		migrations = append(migrations, Migration{Version: version, Name: name, SQL: string(sql)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// SchemaVersion returns the version of the last applied migration, 0 for
+// an empty database.
+func (d *Database) SchemaVersion() (int, error) {
+	_, err := d.conn.Exec(d.dialect.migrationsTable)
+	if err != nil {
+		return 0, err
+	}
+
+	var version int
+	err = d.conn.QueryRow("SELECT COALESCE(MAX(version), 0) FROM SchemaMigrations").Scan(&version)
+	return version, err
+}
+
+// PendingMigrations returns the migrations which are not applied yet. It
+// fails with ErrSchemaTooNew when the database was migrated by a newer
+// binary.
+func (d *Database) PendingMigrations() ([]Migration, error) {
+	migrations, err := loadMigrations(d.driver)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := d.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	if latest := migrations[len(migrations)-1].Version; version > latest {
+		return nil, fmt.Errorf("%w: database is at version %d, latest known is %d", ErrSchemaTooNew, version, latest)
+	}
+
+	var pending []Migration
+	for _, migration := range migrations {
+		if migration.Version > version {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies the pending migrations, each one in its own transaction.
+// Servers starting together against the same database apply each migration
+// once, the others wait for it.
+func (d *Database) Migrate() error {
+	ctx := context.Background()
+	conn, err := d.conn.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if d.dialect.migrationLock != "" {
+		_, err = conn.ExecContext(ctx, d.dialect.rebind(d.dialect.migrationLock), migrationLockID)
+		if err != nil {
+			return err
+		}
+		defer conn.ExecContext(ctx, d.dialect.rebind(d.dialect.migrationUnlock), migrationLockID)
+	}
+
+	pending, err := d.PendingMigrations()
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range pending {
+		err = d.applyMigration(ctx, conn, migration)
+		if err != nil {
+			return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+	}
+	return nil
+}
+
+// applyMigration applies migration unless another server applied it since
+// the pending migrations were read.
+func (d *Database) applyMigration(ctx context.Context, conn *sql.Conn, migration Migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var applied int
+	err = tx.QueryRow(d.dialect.rebind("SELECT COUNT(*) FROM SchemaMigrations WHERE version = ?"), migration.Version).Scan(&applied)
+	if err != nil || applied > 0 {
+		return err
+	}
+
+	_, err = tx.Exec(migration.SQL)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		d.dialect.rebind("INSERT INTO SchemaMigrations (version, name, applied_at) VALUES (?, ?, ?)"),
+		migration.Version, migration.Name, time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,203 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func latestVersion(t *testing.T, driver string) int {
+	migrations, err := loadMigrations(driver)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+func TestLoadMigrations(t *testing.T) {
+	for driver := range dialects {
+		migrations, err := loadMigrations(driver)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		for i, migration := range migrations {
+			if migration.Version != i+1 {
+				t.Errorf("Expected %s migration %d, got %d", driver, i+1, migration.Version)
+			}
+		}
+	}
+
+	// every dialect needs the same migrations
+	sqlite, _ := loadMigrations("sqlite3")
+	postgres, _ := loadMigrations("postgres")
+	if len(sqlite) != len(postgres) {
+		t.Fatalf("Expected the same number of migrations, got %d and %d", len(sqlite), len(postgres))
+	}
+	for i := range sqlite {
+		if sqlite[i].Name != postgres[i].Name {
+			t.Errorf("Expected migration %s, got %s", sqlite[i].Name, postgres[i].Name)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	uri := filepath.Join(t.TempDir(), "test.db")
+
+	db, err := NewDatabase(DatabaseOpts{Driver: "sqlite3", Uri: uri})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	version, err := db.SchemaVersion()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if expected := latestVersion(t, "sqlite3"); version != expected {
+		t.Errorf("Expected version %d, got %d", expected, version)
+	}
+	db.Close()
+
+	// opening an up to date database again does nothing
+	db, err = NewDatabase(DatabaseOpts{Driver: "sqlite3", Uri: uri})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer db.Close()
+
+	pending, err := db.PendingMigrations()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("Expected no pending migrations, got %v", pending)
+	}
+}
+
+func TestMigrateConcurrently(t *testing.T) {
+	uri := filepath.Join(t.TempDir(), "test.db")
+
+	// servers starting together migrate the same database
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			db, err := NewDatabase(DatabaseOpts{Driver: "sqlite3", Uri: uri})
+			if err == nil {
+				db.Close()
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Expected no error, got %v", err)
+		}
+	}
+
+	db, err := NewDatabase(DatabaseOpts{Driver: "sqlite3", Uri: uri})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer db.Close()
+
+	var count int
+	db.conn.QueryRow("SELECT COUNT(*) FROM SchemaMigrations").Scan(&count)
+	if expected := latestVersion(t, "sqlite3"); count != expected {
+		t.Errorf("Expected %d applied migrations, got %d", expected, count)
+	}
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	uri := filepath.Join(t.TempDir(), "test.db")
+
+	// tables created before migrations existed
+	conn, err := sql.Open("sqlite3", uri)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	_, err = conn.Exec("CREATE TABLE Users (id TEXT PRIMARY KEY, publicKey TEXT, last_activity DATE)")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	_, err = conn.Exec("INSERT INTO Users (id, publicKey) VALUES ('legacy', 'legacy-key')")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	_, err = conn.Exec("CREATE TABLE PendingMessages (id INTEGER PRIMARY KEY AUTOINCREMENT, fromUser TEXT, toUser TEXT, payload TEXT)")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	conn.Close()
+
+	db, err := NewDatabase(DatabaseOpts{Driver: "sqlite3", Uri: uri})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer db.Close()
+
+	key, err := db.GetPublicKey("legacy")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if key != "legacy-key" {
+		t.Errorf("Expected legacy-key, got %s", key)
+	}
+
+	// existing keys are the first entries of the key log
+	entries, err := db.GetKeyLog(0)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(entries) != 1 || entries[0].User != "legacy" || entries[0].PublicKey != "legacy-key" {
+		t.Errorf("Expected the legacy key in the key log, got %v", entries)
+	}
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	db, err := NewDatabase(DatabaseOpts{
+		Driver: "sqlite3",
+		Uri:    filepath.Join(t.TempDir(), "test.db"),
+		DryRun: true,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer db.Close()
+
+	pending, err := db.PendingMigrations()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(pending) != latestVersion(t, "sqlite3") {
+		t.Errorf("Expected all migrations to be pending, got %v", pending)
+	}
+
+	var count int
+	db.conn.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='Users'").Scan(&count)
+	if count != 0 {
+		t.Errorf("Expected no tables to be created in dry run")
+	}
+}
+
+func TestMigrateSchemaTooNew(t *testing.T) {
+	uri := filepath.Join(t.TempDir(), "test.db")
+
+	db, err := NewDatabase(DatabaseOpts{Driver: "sqlite3", Uri: uri})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	_, err = db.conn.Exec("INSERT INTO SchemaMigrations (version, name) VALUES (?, 'from_the_future')", latestVersion(t, "sqlite3")+1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	db.Close()
+
+	for _, dryRun := range []bool{false, true} {
+		_, err = NewDatabase(DatabaseOpts{Driver: "sqlite3", Uri: uri, DryRun: dryRun})
+		if !errors.Is(err, ErrSchemaTooNew) {
+			t.Errorf("Expected %v, got %v", ErrSchemaTooNew, err)
+		}
+	}
+}
@@ -0,0 +1,2 @@
+CREATE TABLE IF NOT EXISTS Users (id TEXT PRIMARY KEY, publicKey TEXT, last_activity TIMESTAMPTZ);
+CREATE TABLE IF NOT EXISTS PendingMessages (id BIGSERIAL PRIMARY KEY, fromUser TEXT, toUser TEXT, payload TEXT);
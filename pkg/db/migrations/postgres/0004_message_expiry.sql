@@ -0,0 +1,6 @@
+ALTER TABLE PendingMessages ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+ALTER TABLE PendingMessages ADD COLUMN size BIGINT NOT NULL DEFAULT 0;
+UPDATE PendingMessages SET size = OCTET_LENGTH(payload);
+
+CREATE INDEX PendingMessagesToUser ON PendingMessages (toUser);
+CREATE INDEX PendingMessagesCreatedAt ON PendingMessages (created_at);
@@ -0,0 +1,2 @@
+ALTER TABLE PendingMessages ADD COLUMN type TEXT;
+ALTER TABLE PendingMessages ADD COLUMN ref BIGINT;
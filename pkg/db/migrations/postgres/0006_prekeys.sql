@@ -0,0 +1,3 @@
+CREATE TABLE SignedPreKeys (userId TEXT PRIMARY KEY, keyId BIGINT NOT NULL, publicKey TEXT NOT NULL, signature TEXT NOT NULL, created_at TIMESTAMPTZ);
+
+CREATE TABLE OneTimePreKeys (id BIGSERIAL PRIMARY KEY, userId TEXT NOT NULL, keyId BIGINT NOT NULL, publicKey TEXT NOT NULL, UNIQUE (userId, keyId));
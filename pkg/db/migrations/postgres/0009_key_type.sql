@@ -0,0 +1 @@
+ALTER TABLE Users ADD COLUMN keyType TEXT;
@@ -0,0 +1 @@
+CREATE TABLE RevokedTokens (id TEXT PRIMARY KEY, expires_at BIGINT NOT NULL);
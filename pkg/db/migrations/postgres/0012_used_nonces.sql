@@ -0,0 +1 @@
+CREATE TABLE UsedNonces (nonce TEXT PRIMARY KEY, expires_at BIGINT NOT NULL);
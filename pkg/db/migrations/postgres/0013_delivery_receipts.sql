@@ -0,0 +1 @@
+ALTER TABLE PendingDeliveries ADD COLUMN receipted BOOLEAN NOT NULL DEFAULT FALSE;
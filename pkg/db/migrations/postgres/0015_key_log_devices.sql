@@ -0,0 +1,2 @@
+ALTER TABLE KeyLog ADD COLUMN device TEXT;
+ALTER TABLE KeyLog ADD COLUMN removed BOOLEAN NOT NULL DEFAULT FALSE;
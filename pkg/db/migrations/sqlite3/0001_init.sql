@@ -0,0 +1,2 @@
+CREATE TABLE IF NOT EXISTS Users (id TEXT PRIMARY KEY, publicKey TEXT, last_activity DATE);
+CREATE TABLE IF NOT EXISTS PendingMessages (id INTEGER PRIMARY KEY AUTOINCREMENT, fromUser TEXT, toUser TEXT, payload TEXT);
@@ -0,0 +1,5 @@
+CREATE TABLE Devices (userId TEXT NOT NULL, id TEXT NOT NULL, publicKey TEXT NOT NULL, created_at DATE, PRIMARY KEY (userId, id));
+INSERT INTO Devices (userId, id, publicKey, created_at) SELECT id, 'primary', publicKey, last_activity FROM Users;
+
+CREATE TABLE PendingDeliveries (messageId INTEGER NOT NULL, device TEXT NOT NULL, PRIMARY KEY (messageId, device));
+INSERT INTO PendingDeliveries (messageId, device) SELECT id, 'primary' FROM PendingMessages;
@@ -0,0 +1,4 @@
+CREATE TABLE Groups (id TEXT PRIMARY KEY, owner TEXT NOT NULL, created_at DATE);
+CREATE TABLE GroupMembers (groupId TEXT NOT NULL, userId TEXT NOT NULL, PRIMARY KEY (groupId, userId));
+
+ALTER TABLE PendingMessages ADD COLUMN groupId TEXT;
@@ -0,0 +1,6 @@
+ALTER TABLE PendingMessages ADD COLUMN created_at TIMESTAMP;
+ALTER TABLE PendingMessages ADD COLUMN size INTEGER NOT NULL DEFAULT 0;
+UPDATE PendingMessages SET created_at = CURRENT_TIMESTAMP, size = LENGTH(CAST(payload AS BLOB));
+
+CREATE INDEX PendingMessagesToUser ON PendingMessages (toUser);
+CREATE INDEX PendingMessagesCreatedAt ON PendingMessages (created_at);
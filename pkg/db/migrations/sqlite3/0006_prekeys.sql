@@ -0,0 +1,3 @@
+CREATE TABLE SignedPreKeys (userId TEXT PRIMARY KEY, keyId INTEGER NOT NULL, publicKey TEXT NOT NULL, signature TEXT NOT NULL, created_at DATE);
+
+CREATE TABLE OneTimePreKeys (id INTEGER PRIMARY KEY AUTOINCREMENT, userId TEXT NOT NULL, keyId INTEGER NOT NULL, publicKey TEXT NOT NULL, UNIQUE (userId, keyId));
@@ -0,0 +1,4 @@
+CREATE TABLE KeyHistory (userId TEXT NOT NULL, publicKey TEXT NOT NULL, replaced_at DATE NOT NULL);
+CREATE INDEX KeyHistoryUser ON KeyHistory (userId);
+
+CREATE TABLE KeyFetchers (userId TEXT NOT NULL, fetcherId TEXT NOT NULL, fetched_at DATE, PRIMARY KEY (userId, fetcherId));
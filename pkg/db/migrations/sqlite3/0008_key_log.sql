@@ -0,0 +1,5 @@
+CREATE TABLE KeyLog (seq INTEGER PRIMARY KEY, userId TEXT NOT NULL, publicKey TEXT NOT NULL, logged_at INTEGER NOT NULL);
+CREATE INDEX KeyLogUser ON KeyLog (userId);
+
+INSERT INTO KeyLog (seq, userId, publicKey, logged_at)
+SELECT ROW_NUMBER() OVER (ORDER BY id) - 1, id, publicKey, CAST(strftime('%s', 'now') AS INTEGER) FROM Users WHERE publicKey IS NOT NULL;
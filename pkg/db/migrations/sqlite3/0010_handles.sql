@@ -0,0 +1 @@
+CREATE TABLE Handles (userId TEXT PRIMARY KEY, handle TEXT NOT NULL UNIQUE, skeleton TEXT NOT NULL UNIQUE, claimed_at DATE);
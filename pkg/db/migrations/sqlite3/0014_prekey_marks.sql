@@ -0,0 +1 @@
+CREATE TABLE PreKeyMarks (userId TEXT PRIMARY KEY, maxKeyId BIGINT NOT NULL);
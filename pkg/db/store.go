@@ -0,0 +1,181 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"enigma-protocol-go/pkg/models"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	// ErrNoFreeID is returned when every id SaveUser tried is taken, the id
+	// format is too short for the number of users.
+	ErrNoFreeID = errors.New("no free user id found")
+	// ErrHandleTaken is returned when another user has a handle with the
+	// same skeleton.
+	ErrHandleTaken = errors.New("handle is taken")
+	// ErrTooManyPreKeys is returned when a user would store more one-time
+	// prekeys than allowed.
+	ErrTooManyPreKeys = errors.New("too many one-time prekeys")
+)
+
+// maxIDAttempts is how many ids SaveUser tries before giving up.
+const maxIDAttempts = 10
+
+// Store is the storage used by the API. It is implemented by Database for
+// SQL databases and by MemoryStore.
+type Store interface {
+	// SaveUser creates a user together with its primary device, the key is
+	// appended to the key log. keyType is empty when it is unknown. A new id
+	// is drawn when the id is taken.
+	SaveUser(publicKey string, keyType string) (string, error)
+	GetPublicKey(id string) (string, error)
+	// GetKeyType returns the type of the key of the user, one of the
+	// utils.KeyType constants or empty when it is unknown.
+	GetKeyType(id string) (string, error)
+	// GetTokenGeneration returns the random value the tokens of the user are
+	// bound to. It is drawn when the user is created, so the tokens of a
+	// deleted user are not accepted for a new user with the same id. It is
+	// empty for users created before tokens were bound.
+	GetTokenGeneration(id string) (string, error)
+	IsUserExists(id string) bool
+	UpdateActivity(id string) error
+	// UpdatePublicKey replaces the key of the user and its primary device,
+	// the old key is kept in the key history. The signed prekey is removed
+	// as it was signed by the old key. The new key is appended to the key
+	// log.
+	UpdatePublicKey(userID string, publicKey string, keyType string) error
+	// GetKeyHistory returns the previous keys of the user, newest first.
+	GetKeyHistory(userID string) ([]models.PreviousKey, error)
+	// AddKeyFetcher records that fetcher knows the key of the user.
+	AddKeyFetcher(userID string, fetcherID string) error
+	GetKeyFetchers(userID string) ([]string, error)
+	// GetKeyLog returns the keys registered or rotated to and the devices
+	// added or removed, in the order they were logged, starting with the
+	// entry at position from. The log is append-only, deleting a user keeps
+	// its entries and logs the removal of its devices.
+	GetKeyLog(from int) ([]models.KeyLogEntry, error)
+	// GetInactiveUsers returns the users which were last active before
+	// before, oldest first.
+	GetInactiveUsers(before time.Time) ([]models.InactiveUser, error)
+	// DeleteUser removes the user with its devices, prekeys, key history,
+	// handle, pending messages, group memberships and the groups it owns.
+	DeleteUser(id string) error
+
+	// SetHandle claims handle for the user or changes its handle, skeleton
+	// is what the handle looks like. It fails with ErrHandleTaken when
+	// another user has a handle with the same skeleton.
+	SetHandle(userID string, handle string, skeleton string) error
+	DeleteHandle(userID string) error
+	GetHandle(userID string) (string, error)
+	// GetHandleUser returns the user with handle.
+	GetHandleUser(handle string) (string, error)
+
+	AddDevice(userID string, publicKey string) (string, error)
+	GetDevices(userID string) ([]models.Device, error)
+	GetDevicePublicKey(userID string, deviceID string) (string, error)
+
+	// CreateGroup creates a group owned by owner, the owner is a member too.
+	CreateGroup(owner string, members []string) (string, error)
+	GetGroup(id string) (models.Group, error)
+	AddGroupMember(groupID string, userID string) error
+	RemoveGroupMember(groupID string, userID string) error
+
+	// SetSignedPreKey replaces the signed prekey of the user.
+	SetSignedPreKey(userID string, key models.SignedPreKey) error
+	GetSignedPreKey(userID string) (models.SignedPreKey, error)
+	// AddOneTimePreKeys stores the one-time prekeys with an id above the
+	// highest one the user ever uploaded and returns how many the user has.
+	// The other keys were uploaded before and are ignored, so keys which
+	// were consumed cannot be restored. It fails with ErrTooManyPreKeys when
+	// the user would have more than max keys.
+	AddOneTimePreKeys(userID string, keys []models.PreKey, max int) (int, error)
+	// ConsumeOneTimePreKey removes and returns the oldest one-time prekey of
+	// the user, every key is only returned once. It fails with ErrNotFound
+	// when none are left.
+	ConsumeOneTimePreKey(userID string) (models.PreKey, error)
+	CountOneTimePreKeys(userID string) (int, error)
+
+	// SavePendingMessage queues the message for every device of the
+	// receiver, it is removed once all of them acknowledged it.
+	SavePendingMessage(message models.TransmissionData) (int64, error)
+	GetPendingMessages(toUser string, device string) ([]models.TransmissionData, error)
+	DeletePendingMessage(toUser string, device string, id int64) error
+	DeletePendingMessages(toUser string) error
+	// MarkDelivered records that the message was delivered to device, it
+	// returns false when that was recorded already or the message is not
+	// pending for the device. The sender gets one receipt per device.
+	MarkDelivered(toUser string, device string, id int64) (bool, error)
+	// PendingStats returns the number and total payload size of the messages
+	// waiting for toUser.
+	PendingStats(toUser string) (int, int64, error)
+	// DeleteExpiredMessages removes the messages stored before before and
+	// returns how many were removed.
+	DeleteExpiredMessages(before time.Time) (int64, error)
+
+	// RevokeToken marks the session token or token session with id as
+	// revoked, expiresAt is when the token would have expired anyway. It
+	// returns false when id was revoked already, the first revocation is
+	// kept.
+	RevokeToken(id string, expiresAt time.Time) (bool, error)
+	IsTokenRevoked(id string) (bool, error)
+	// DeleteExpiredRevocations removes the revocations of the tokens which
+	// expired before before and returns how many were removed.
+	DeleteExpiredRevocations(before time.Time) (int64, error)
+
+	// UseNonce records the nonce of a signed request, expiresAt is when the
+	// request is too old to be accepted anyway. It returns false when the
+	// nonce was used already.
+	UseNonce(nonce string, expiresAt time.Time) (bool, error)
+	// DeleteExpiredNonces removes the nonces which expired before before and
+	// returns how many were removed.
+	DeleteExpiredNonces(before time.Time) (int64, error)
+
+	Close() error
+}
+
+// NewStore creates the store selected by dbopts.Driver, which is one of
+// "memory", "sqlite3" or "postgres".
+func NewStore(dbopts DatabaseOpts) (Store, error) {
+	if dbopts.Driver == "memory" {
+		if err := dbopts.UserIDs.Validate(); err != nil {
+			return nil, err
+		}
+
+		store := NewMemoryStore()
+		store.newUserID = dbopts.UserIDs.NewID
+		return store, nil
+	}
+
+	database, err := NewDatabase(dbopts)
+	if err != nil {
+		return nil, err
+	}
+	return database, nil
+}
+
+var (
+	_ Store = (*Database)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
+
+// newPreKeys returns the keys with an id above mark, the highest id uploaded
+// before, and the highest id among them. Without a mark every key is new.
+// Keys with the same id are only returned once.
+func newPreKeys(keys []models.PreKey, mark int64, marked bool) ([]models.PreKey, int64) {
+	var fresh []models.PreKey
+	seen := make(map[int64]bool)
+	for _, key := range keys {
+		if (marked && key.KeyID <= mark) || seen[key.KeyID] {
+			continue
+		}
+		seen[key.KeyID] = true
+		fresh = append(fresh, key)
+
+		if !marked || key.KeyID > mark {
+			mark, marked = key.KeyID, true
+		}
+	}
+	return fresh, mark
+}
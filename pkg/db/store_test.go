@@ -0,0 +1,797 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"enigma-protocol-go/pkg/models"
+)
+
+// storeFactories creates an empty store for every backend. PostgreSQL is
+// only tested when TEST_POSTGRES_URI points to a database that can be wiped.
+var storeFactories = map[string]func(t *testing.T) Store{
+	"memory": func(t *testing.T) Store {
+		return NewMemoryStore()
+	},
+	"sqlite3": func(t *testing.T) Store {
+		store, err := NewStore(DatabaseOpts{
+			Driver: "sqlite3",
+			Uri:    filepath.Join(t.TempDir(), "test.db"),
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		return store
+	},
+	"postgres": func(t *testing.T) Store {
+		uri := os.Getenv("TEST_POSTGRES_URI")
+		if uri == "" {
+			t.Skip("TEST_POSTGRES_URI is not set")
+		}
+
+		store, err := NewDatabase(DatabaseOpts{Driver: "postgres", Uri: uri})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		for _, table := range []string{"Users", "Devices", "Groups", "GroupMembers", "SignedPreKeys", "OneTimePreKeys", "PreKeyMarks", "KeyHistory", "KeyFetchers", "KeyLog", "Handles", "RevokedTokens", "UsedNonces", "PendingMessages", "PendingDeliveries"} {
+			_, err = store.conn.Exec("DELETE FROM " + table)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+		}
+		return store
+	},
+}
+
+var storeTests = []struct {
+	name string
+	test func(t *testing.T, store Store)
+}{
+	{"Users", testStoreUsers},
+	{"UserIDCollision", testStoreUserIDCollision},
+	{"InactiveUsers", testStoreInactiveUsers},
+	{"DeleteUser", testStoreDeleteUser},
+	{"Devices", testStoreDevices},
+	{"KeyRotation", testStoreKeyRotation},
+	{"KeyLog", testStoreKeyLog},
+	{"Handles", testStoreHandles},
+	{"Groups", testStoreGroups},
+	{"PreKeys", testStorePreKeys},
+	{"PendingMessages", testStorePendingMessages},
+	{"PendingDeliveries", testStorePendingDeliveries},
+	{"MarkDelivered", testStoreMarkDelivered},
+	{"DeletePendingMessages", testStoreDeletePendingMessages},
+	{"PendingExpiry", testStorePendingExpiry},
+	{"RevokedTokens", testStoreRevokedTokens},
+	{"UsedNonces", testStoreUsedNonces},
+}
+
+// TestStores is the conformance suite every Store implementation must pass.
+func TestStores(t *testing.T) {
+	for name, newStore := range storeFactories {
+		newStore := newStore
+		t.Run(name, func(t *testing.T) {
+			for _, tt := range storeTests {
+				tt := tt
+				t.Run(tt.name, func(t *testing.T) {
+					store := newStore(t)
+					defer store.Close()
+
+					tt.test(t, store)
+				})
+			}
+		})
+	}
+}
+
+func testStoreUsers(t *testing.T, store Store) {
+	id, err := store.SaveUser("test-public-key", "ed25519")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	key, err := store.GetPublicKey(id)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if key != "test-public-key" {
+		t.Errorf("Expected public key %s, got %s", "test-public-key", key)
+	}
+	if keyType, _ := store.GetKeyType(id); keyType != "ed25519" {
+		t.Errorf("Expected key type ed25519, got %q", keyType)
+	}
+
+	if !store.IsUserExists(id) {
+		t.Errorf("Expected user %s to exist", id)
+	}
+	if err := store.UpdateActivity(id); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	if store.IsUserExists("random-user") {
+		t.Errorf("Expected user random-user to not exist")
+	}
+	if _, err := store.GetPublicKey("random-user"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected %v, got %v", ErrNotFound, err)
+	}
+	if _, err := store.GetKeyType("random-user"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected %v, got %v", ErrNotFound, err)
+	}
+	if _, err := store.GetTokenGeneration("random-user"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected %v, got %v", ErrNotFound, err)
+	}
+
+	other, err := store.SaveUser("test-public-key", "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	generation, _ := store.GetTokenGeneration(id)
+	otherGeneration, _ := store.GetTokenGeneration(other)
+	if generation == "" || generation == otherGeneration {
+		t.Errorf("Expected users with their own token generation, got %q and %q", generation, otherGeneration)
+	}
+	if other == id {
+		t.Errorf("Expected a new user id, got %s", other)
+	}
+}
+
+func testStoreUserIDCollision(t *testing.T, store Store) {
+	ids := []string{"taken", "taken", "free"}
+	newUserID := func() (string, error) {
+		id := ids[0]
+		if len(ids) > 1 {
+			ids = ids[1:]
+		}
+		return id, nil
+	}
+
+	switch store := store.(type) {
+	case *Database:
+		store.newUserID = newUserID
+	case *MemoryStore:
+		store.newUserID = newUserID
+	}
+
+	for _, expected := range []string{"taken", "free"} {
+		id, err := store.SaveUser("test-public-key", "")
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if id != expected {
+			t.Errorf("Expected id %s, got %s", expected, id)
+		}
+	}
+
+	// only taken ids are left
+	if _, err := store.SaveUser("test-public-key", ""); !errors.Is(err, ErrNoFreeID) {
+		t.Errorf("Expected %v, got %v", ErrNoFreeID, err)
+	}
+}
+
+func testStoreInactiveUsers(t *testing.T, store Store) {
+	first, _ := store.SaveUser("test-public-key", "")
+	second, _ := store.SaveUser("test-public-key", "")
+
+	users, err := store.GetInactiveUsers(time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(users) != 0 {
+		t.Errorf("Expected no inactive users, got %v", users)
+	}
+
+	users, err = store.GetInactiveUsers(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(users) != 2 {
+		t.Fatalf("Expected 2 inactive users, got %v", users)
+	}
+	ids := map[string]bool{users[0].ID: true, users[1].ID: true}
+	if !ids[first] || !ids[second] {
+		t.Errorf("Expected users %s and %s, got %v", first, second, users)
+	}
+	if users[0].LastActivity.IsZero() || users[0].LastActivity.After(users[1].LastActivity) {
+		t.Errorf("Expected users ordered by last activity, got %v", users)
+	}
+}
+
+func testStoreDeleteUser(t *testing.T, store Store) {
+	id, _ := store.SaveUser("test-public-key", "")
+	other, _ := store.SaveUser("test-public-key", "")
+	store.AddDevice(id, "test-device-key")
+	store.SetSignedPreKey(id, models.SignedPreKey{KeyID: 1, PublicKey: "test-signed-key", Signature: "test-signature"})
+	store.AddOneTimePreKeys(id, []models.PreKey{{KeyID: 1, PublicKey: "test-key"}}, 10)
+	store.SavePendingMessage(models.TransmissionData{From: other, To: id, Payload: "payload"})
+	store.SavePendingMessage(models.TransmissionData{From: id, To: other, Payload: "payload"})
+	owned, _ := store.CreateGroup(id, []string{other})
+	joined, _ := store.CreateGroup(other, []string{id})
+
+	err := store.DeleteUser(id)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if store.IsUserExists(id) {
+		t.Errorf("Expected user %s to be deleted", id)
+	}
+	if devices, _ := store.GetDevices(id); len(devices) != 0 {
+		t.Errorf("Expected no devices, got %v", devices)
+	}
+	if count, _, _ := store.PendingStats(id); count != 0 {
+		t.Errorf("Expected no pending messages, got %d", count)
+	}
+	if _, err := store.GetSignedPreKey(id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected %v, got %v", ErrNotFound, err)
+	}
+	if count, _ := store.CountOneTimePreKeys(id); count != 0 {
+		t.Errorf("Expected no one-time prekeys, got %d", count)
+	}
+	if _, err := store.GetGroup(owned); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected %v, got %v", ErrNotFound, err)
+	}
+	if group, _ := store.GetGroup(joined); !reflect.DeepEqual(group.Members, []string{other}) {
+		t.Errorf("Expected members %v, got %v", []string{other}, group.Members)
+	}
+
+	// messages sent by the user are still delivered
+	if count, _, _ := store.PendingStats(other); count != 1 {
+		t.Errorf("Expected 1 pending message, got %d", count)
+	}
+}
+
+func testStoreDevices(t *testing.T, store Store) {
+	id, err := store.SaveUser("test-public-key", "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	device, err := store.AddDevice(id, "test-device-key")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	devices, err := store.GetDevices(id)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := []models.Device{
+		{ID: models.PrimaryDevice, PublicKey: "test-public-key"},
+		{ID: device, PublicKey: "test-device-key"},
+	}
+	if !reflect.DeepEqual(devices, expected) {
+		t.Errorf("Expected devices %v, got %v", expected, devices)
+	}
+
+	key, err := store.GetDevicePublicKey(id, device)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if key != "test-device-key" {
+		t.Errorf("Expected public key %s, got %s", "test-device-key", key)
+	}
+
+	if _, err := store.GetDevicePublicKey(id, "random-device"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected %v, got %v", ErrNotFound, err)
+	}
+	if _, err := store.AddDevice("random-user", "test-device-key"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected %v, got %v", ErrNotFound, err)
+	}
+}
+
+func testStoreKeyRotation(t *testing.T, store Store) {
+	id, _ := store.SaveUser("first-key", "")
+	fetcher, _ := store.SaveUser("test-public-key", "")
+	store.SetSignedPreKey(id, models.SignedPreKey{KeyID: 1, PublicKey: "test-signed-key", Signature: "test-signature"})
+
+	for _, key := range []string{"second-key", "third-key"} {
+		if err := store.UpdatePublicKey(id, key, "p256"); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	key, _ := store.GetPublicKey(id)
+	primary, _ := store.GetDevicePublicKey(id, models.PrimaryDevice)
+	if key != "third-key" || primary != "third-key" {
+		t.Errorf("Expected third-key, got %s and %s", key, primary)
+	}
+	if keyType, _ := store.GetKeyType(id); keyType != "p256" {
+		t.Errorf("Expected key type p256, got %q", keyType)
+	}
+	if _, err := store.GetSignedPreKey(id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected %v, got %v", ErrNotFound, err)
+	}
+
+	history, err := store.GetKeyHistory(id)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(history) != 2 || history[0].PublicKey != "second-key" || history[1].PublicKey != "first-key" || history[0].ReplacedAt.IsZero() {
+		t.Errorf("Expected second-key and first-key, got %v", history)
+	}
+
+	if err := store.UpdatePublicKey("random-user", "key", ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected %v, got %v", ErrNotFound, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := store.AddKeyFetcher(id, fetcher); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+	fetchers, err := store.GetKeyFetchers(id)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(fetchers, []string{fetcher}) {
+		t.Errorf("Expected fetchers %v, got %v", []string{fetcher}, fetchers)
+	}
+
+	store.DeleteUser(fetcher)
+	if fetchers, _ := store.GetKeyFetchers(id); len(fetchers) != 0 {
+		t.Errorf("Expected no fetchers, got %v", fetchers)
+	}
+}
+
+func testStoreKeyLog(t *testing.T, store Store) {
+	id, _ := store.SaveUser("first-key", "")
+	other, _ := store.SaveUser("other-key", "")
+	store.UpdatePublicKey(id, "second-key", "")
+	store.UpdatePublicKey("random-user", "key", "")
+	device, _ := store.AddDevice(other, "device-key")
+	store.DeleteUser(other)
+
+	entries, err := store.GetKeyLog(0)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expected := []models.KeyLogEntry{
+		{User: id, PublicKey: "first-key"},
+		{User: other, PublicKey: "other-key"},
+		{User: id, PublicKey: "second-key"},
+		{User: other, Device: device, PublicKey: "device-key"},
+		{User: other, Device: models.PrimaryDevice, PublicKey: "other-key", Removed: true},
+		{User: other, Device: device, PublicKey: "device-key", Removed: true},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("Expected %d entries, got %v", len(expected), entries)
+	}
+	for i, entry := range entries {
+		if entry.Timestamp == 0 {
+			t.Errorf("Expected a timestamp for entry %d", i)
+		}
+		entry.Timestamp = 0
+		if entry != expected[i] {
+			t.Errorf("Expected entry %v, got %v", expected[i], entry)
+		}
+	}
+
+	// the log is read from a position on
+	if entries, err := store.GetKeyLog(4); err != nil || len(entries) != 2 || entries[0].Device != models.PrimaryDevice {
+		t.Errorf("Expected the last 2 entries, got %v, %v", entries, err)
+	}
+	if entries, err := store.GetKeyLog(len(expected)); err != nil || len(entries) != 0 {
+		t.Errorf("Expected no entries, got %v, %v", entries, err)
+	}
+}
+
+func testStoreHandles(t *testing.T, store Store) {
+	alice, _ := store.SaveUser("test-public-key", "")
+	bob, _ := store.SaveUser("test-public-key", "")
+
+	if err := store.SetHandle(alice, "alice", "allce"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := store.SetHandle(bob, "a1ice", "allce"); !errors.Is(err, ErrHandleTaken) {
+		t.Errorf("Expected %v, got %v", ErrHandleTaken, err)
+	}
+
+	// a user can change to a handle looking like its own
+	if err := store.SetHandle(alice, "a1ice", "allce"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if user, err := store.GetHandleUser("a1ice"); err != nil || user != alice {
+		t.Errorf("Expected %s, got %s and %v", alice, user, err)
+	}
+	if _, err := store.GetHandleUser("alice"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected %v, got %v", ErrNotFound, err)
+	}
+	if handle, _ := store.GetHandle(alice); handle != "a1ice" {
+		t.Errorf("Expected handle a1ice, got %s", handle)
+	}
+
+	// released handles can be claimed again
+	if err := store.DeleteHandle(alice); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := store.GetHandle(alice); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected %v, got %v", ErrNotFound, err)
+	}
+	if err := store.SetHandle(bob, "alice", "allce"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	store.DeleteUser(bob)
+	if _, err := store.GetHandleUser("alice"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected %v, got %v", ErrNotFound, err)
+	}
+}
+
+func testStoreGroups(t *testing.T, store Store) {
+	id, err := store.CreateGroup("owner", []string{"member1", "member2", "owner"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	group, err := store.GetGroup(id)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := models.Group{ID: id, Owner: "owner", Members: []string{"member1", "member2", "owner"}}
+	if !reflect.DeepEqual(group, expected) {
+		t.Errorf("Expected group %v, got %v", expected, group)
+	}
+
+	if err := store.AddGroupMember(id, "member3"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	// adding a member twice does nothing
+	if err := store.AddGroupMember(id, "member3"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err := store.RemoveGroupMember(id, "member1"); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	group, _ = store.GetGroup(id)
+	expected.Members = []string{"member2", "member3", "owner"}
+	if !reflect.DeepEqual(group, expected) {
+		t.Errorf("Expected group %v, got %v", expected, group)
+	}
+
+	if _, err := store.GetGroup("random-group"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected %v, got %v", ErrNotFound, err)
+	}
+}
+
+func testStorePreKeys(t *testing.T, store Store) {
+	id, _ := store.SaveUser("test-public-key", "")
+
+	if _, err := store.GetSignedPreKey(id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected %v, got %v", ErrNotFound, err)
+	}
+
+	for _, key := range []models.SignedPreKey{
+		{KeyID: 1, PublicKey: "first-signed-key", Signature: "first-signature"},
+		{KeyID: 2, PublicKey: "second-signed-key", Signature: "second-signature"},
+	} {
+		if err := store.SetSignedPreKey(id, key); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		signed, err := store.GetSignedPreKey(id)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if signed != key {
+			t.Errorf("Expected signed prekey %v, got %v", key, signed)
+		}
+	}
+
+	keys := []models.PreKey{{KeyID: 1, PublicKey: "first-key"}, {KeyID: 2, PublicKey: "second-key"}}
+	if count, err := store.AddOneTimePreKeys(id, keys, 3); err != nil || count != 2 {
+		t.Fatalf("Expected 2 one-time prekeys, got %d, %v", count, err)
+	}
+	// uploading a key again does nothing
+	if count, err := store.AddOneTimePreKeys(id, keys[1:], 3); err != nil || count != 2 {
+		t.Fatalf("Expected 2 one-time prekeys, got %d, %v", count, err)
+	}
+	// the keys are checked against max before any is stored
+	more := []models.PreKey{{KeyID: 3, PublicKey: "third-key"}, {KeyID: 4, PublicKey: "fourth-key"}}
+	if _, err := store.AddOneTimePreKeys(id, more, 3); !errors.Is(err, ErrTooManyPreKeys) {
+		t.Errorf("Expected %v, got %v", ErrTooManyPreKeys, err)
+	}
+
+	if count, _ := store.CountOneTimePreKeys(id); count != 2 {
+		t.Errorf("Expected 2 one-time prekeys, got %d", count)
+	}
+
+	for _, expected := range keys {
+		key, err := store.ConsumeOneTimePreKey(id)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if key != expected {
+			t.Errorf("Expected one-time prekey %v, got %v", expected, key)
+		}
+	}
+
+	if _, err := store.ConsumeOneTimePreKey(id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected %v, got %v", ErrNotFound, err)
+	}
+	if count, _ := store.CountOneTimePreKeys(id); count != 0 {
+		t.Errorf("Expected no one-time prekeys, got %d", count)
+	}
+
+	// consumed keys are not restored by uploading them again
+	if count, err := store.AddOneTimePreKeys(id, append(keys, more[0]), 3); err != nil || count != 1 {
+		t.Fatalf("Expected 1 one-time prekey, got %d, %v", count, err)
+	}
+	if key, _ := store.ConsumeOneTimePreKey(id); key != more[0] {
+		t.Errorf("Expected one-time prekey %v, got %v", more[0], key)
+	}
+}
+
+func testStorePendingMessages(t *testing.T, store Store) {
+	to, _ := store.SaveUser("test-public-key", "")
+	other, _ := store.SaveUser("test-public-key", "")
+
+	messages := []models.TransmissionData{
+		{Type: models.FrameMessage, From: "test-from", To: to, Group: "test-group", Payload: "first"},
+		{Type: models.FrameRead, From: "test-from", To: to, Ref: 42},
+		{From: "test-from", To: other, Payload: "third"},
+	}
+
+	for i := range messages {
+		id, err := store.SavePendingMessage(messages[i])
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if id == 0 {
+			t.Fatalf("Expected message id to be assigned")
+		}
+		messages[i].ID = id
+	}
+
+	pending, err := store.GetPendingMessages(to, models.PrimaryDevice)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(pending) != 2 || pending[0] != messages[0] || pending[1] != messages[1] {
+		t.Fatalf("Expected messages %v, got %v", messages[:2], pending)
+	}
+
+	// only the receiver can acknowledge a message
+	err = store.DeletePendingMessage(other, models.PrimaryDevice, messages[0].ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	err = store.DeletePendingMessage(to, models.PrimaryDevice, messages[0].ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	pending, err = store.GetPendingMessages(to, models.PrimaryDevice)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(pending) != 1 || pending[0] != messages[1] {
+		t.Fatalf("Expected messages %v, got %v", messages[1:2], pending)
+	}
+}
+
+func testStorePendingDeliveries(t *testing.T, store Store) {
+	to, _ := store.SaveUser("test-public-key", "")
+	laptop, _ := store.AddDevice(to, "test-laptop-key")
+
+	message := models.TransmissionData{From: "test-from", To: to, Payload: "payload"}
+	message.ID, _ = store.SavePendingMessage(message)
+
+	// devices added after the message was sent do not receive it
+	phone, _ := store.AddDevice(to, "test-phone-key")
+	pending, _ := store.GetPendingMessages(to, phone)
+	if len(pending) != 0 {
+		t.Errorf("Expected no messages, got %v", pending)
+	}
+
+	err := store.DeletePendingMessage(to, models.PrimaryDevice, message.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	pending, _ = store.GetPendingMessages(to, models.PrimaryDevice)
+	if len(pending) != 0 {
+		t.Errorf("Expected no messages, got %v", pending)
+	}
+
+	// still waiting for the laptop
+	pending, _ = store.GetPendingMessages(to, laptop)
+	if len(pending) != 1 || pending[0] != message {
+		t.Fatalf("Expected messages %v, got %v", []models.TransmissionData{message}, pending)
+	}
+
+	err = store.DeletePendingMessage(to, laptop, message.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	pending, _ = store.GetPendingMessages(to, laptop)
+	if len(pending) != 0 {
+		t.Errorf("Expected no messages, got %v", pending)
+	}
+}
+
+func testStoreMarkDelivered(t *testing.T, store Store) {
+	to, _ := store.SaveUser("test-public-key", "")
+	laptop, _ := store.AddDevice(to, "test-laptop-key")
+
+	id, _ := store.SavePendingMessage(models.TransmissionData{From: "test-from", To: to, Payload: "payload"})
+
+	tests := []struct {
+		name     string
+		to       string
+		device   string
+		id       int64
+		expected bool
+	}{
+		{"first", to, models.PrimaryDevice, id, true},
+		{"again", to, models.PrimaryDevice, id, false},
+		{"other device", to, laptop, id, true},
+		{"other user", "test-from", models.PrimaryDevice, id, false},
+		{"unknown message", to, models.PrimaryDevice, id + 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, err := store.MarkDelivered(tt.to, tt.device, tt.id)
+			if err != nil || first != tt.expected {
+				t.Errorf("Expected %v, got %v, %v", tt.expected, first, err)
+			}
+		})
+	}
+
+	// acknowledged messages are not delivered anymore
+	store.DeletePendingMessage(to, laptop, id)
+	if first, err := store.MarkDelivered(to, laptop, id); err != nil || first {
+		t.Errorf("Expected false, got %v, %v", first, err)
+	}
+}
+
+func testStoreDeletePendingMessages(t *testing.T, store Store) {
+	to, _ := store.SaveUser("test-public-key", "")
+	other, _ := store.SaveUser("test-public-key", "")
+
+	for _, to := range []string{to, to, other} {
+		_, err := store.SavePendingMessage(models.TransmissionData{From: "test-from", To: to, Payload: "payload"})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	err := store.DeletePendingMessages(to)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	pending, err := store.GetPendingMessages(to, models.PrimaryDevice)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(pending) != 0 {
+		t.Errorf("Expected no messages, got %v", pending)
+	}
+
+	pending, err = store.GetPendingMessages(other, models.PrimaryDevice)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(pending) != 1 {
+		t.Errorf("Expected 1 message, got %v", pending)
+	}
+}
+
+func testStorePendingExpiry(t *testing.T, store Store) {
+	to, _ := store.SaveUser("test-public-key", "")
+	other, _ := store.SaveUser("test-public-key", "")
+
+	for _, message := range []models.TransmissionData{
+		{From: "test-from", To: to, Payload: "first"},
+		{From: "test-from", To: to, Payload: "second"},
+		{From: "test-from", To: other, Payload: "third"},
+	} {
+		_, err := store.SavePendingMessage(message)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	count, size, err := store.PendingStats(to)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if count != 2 || size != 11 {
+		t.Errorf("Expected 2 messages of 11 bytes, got %d messages of %d bytes", count, size)
+	}
+
+	deleted, err := store.DeleteExpiredMessages(time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if deleted != 0 {
+		t.Errorf("Expected no expired messages, got %d", deleted)
+	}
+
+	deleted, err = store.DeleteExpiredMessages(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if deleted != 3 {
+		t.Errorf("Expected 3 expired messages, got %d", deleted)
+	}
+
+	pending, _ := store.GetPendingMessages(to, models.PrimaryDevice)
+	if len(pending) != 0 {
+		t.Errorf("Expected no messages, got %v", pending)
+	}
+	count, size, _ = store.PendingStats(to)
+	if count != 0 || size != 0 {
+		t.Errorf("Expected an empty mailbox, got %d messages of %d bytes", count, size)
+	}
+}
+
+func testStoreRevokedTokens(t *testing.T, store Store) {
+	now := time.Now()
+
+	if revoked, err := store.IsTokenRevoked("test-token"); err != nil || revoked {
+		t.Fatalf("Expected the token not to be revoked, got %v and %v", revoked, err)
+	}
+
+	if revoked, err := store.RevokeToken("test-token", now.Add(-time.Hour)); err != nil || !revoked {
+		t.Fatalf("Expected the token to be revoked, got %v and %v", revoked, err)
+	}
+	if revoked, err := store.RevokeToken("test-token", now.Add(time.Hour)); err != nil || revoked {
+		t.Fatalf("Expected the token to be revoked already, got %v and %v", revoked, err)
+	}
+	if _, err := store.RevokeToken("other-token", now.Add(time.Hour)); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if revoked, err := store.IsTokenRevoked("test-token"); err != nil || !revoked {
+		t.Fatalf("Expected the token to be revoked, got %v and %v", revoked, err)
+	}
+
+	// the first revocation is kept, so test-token is forgotten
+	deleted, err := store.DeleteExpiredRevocations(now)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if deleted != 1 {
+		t.Errorf("Expected 1 deleted revocation, got %d", deleted)
+	}
+	if revoked, _ := store.IsTokenRevoked("test-token"); revoked {
+		t.Errorf("Expected the expired revocation to be deleted")
+	}
+	if revoked, _ := store.IsTokenRevoked("other-token"); !revoked {
+		t.Errorf("Expected other-token to stay revoked")
+	}
+}
+
+func testStoreUsedNonces(t *testing.T, store Store) {
+	now := time.Now()
+
+	if fresh, err := store.UseNonce("test-nonce", now.Add(-time.Minute)); err != nil || !fresh {
+		t.Fatalf("Expected the nonce to be new, got %v and %v", fresh, err)
+	}
+	if fresh, err := store.UseNonce("test-nonce", now.Add(time.Minute)); err != nil || fresh {
+		t.Fatalf("Expected the nonce to be used already, got %v and %v", fresh, err)
+	}
+	if _, err := store.UseNonce("other-nonce", now.Add(time.Minute)); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	deleted, err := store.DeleteExpiredNonces(now)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if deleted != 1 {
+		t.Errorf("Expected 1 deleted nonce, got %d", deleted)
+	}
+	if fresh, _ := store.UseNonce("other-nonce", now.Add(time.Minute)); fresh {
+		t.Errorf("Expected other-nonce to stay used")
+	}
+}
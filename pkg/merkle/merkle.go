@@ -0,0 +1,164 @@
+// Package merkle implements the Merkle tree of RFC 6962, used by certificate
+// transparency logs, with inclusion and consistency proofs.
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+)
+
+// LeafHash returns the hash of a leaf with data.
+func LeafHash(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x00})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func nodeHash(left []byte, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x01})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// splitPoint returns the largest power of two smaller than n.
+func splitPoint(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// RootHash returns the root of the tree with the leaf hashes leaves.
+func RootHash(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	case 1:
+		return leaves[0]
+	}
+
+	k := splitPoint(len(leaves))
+	return nodeHash(RootHash(leaves[:k]), RootHash(leaves[k:]))
+}
+
+// InclusionProof returns the audit path of the leaf at index in the tree
+// with the leaf hashes leaves.
+func InclusionProof(leaves [][]byte, index int) [][]byte {
+	if len(leaves) <= 1 {
+		return nil
+	}
+
+	k := splitPoint(len(leaves))
+	if index < k {
+		return append(InclusionProof(leaves[:k], index), RootHash(leaves[k:]))
+	}
+	return append(InclusionProof(leaves[k:], index-k), RootHash(leaves[:k]))
+}
+
+// ConsistencyProof returns the proof that the tree with the first m leaves
+// is a prefix of the tree with the leaf hashes leaves.
+func ConsistencyProof(leaves [][]byte, m int) [][]byte {
+	if m <= 0 || m >= len(leaves) {
+		return nil
+	}
+	return subProof(m, leaves, true)
+}
+
+func subProof(m int, leaves [][]byte, complete bool) [][]byte {
+	if m == len(leaves) {
+		if complete {
+			return nil
+		}
+		return [][]byte{RootHash(leaves)}
+	}
+
+	k := splitPoint(len(leaves))
+	if m <= k {
+		return append(subProof(m, leaves[:k], complete), RootHash(leaves[k:]))
+	}
+	return append(subProof(m-k, leaves[k:], false), RootHash(leaves[:k]))
+}
+
+// VerifyInclusion checks that leafHash is the leaf at index of the tree of
+// size with root, following RFC 9162 section 2.1.3.2.
+func VerifyInclusion(index int, size int, leafHash []byte, proof [][]byte, root []byte) bool {
+	if index < 0 || index >= size {
+		return false
+	}
+
+	fn, sn := index, size-1
+	r := leafHash
+	for _, p := range proof {
+		if sn == 0 {
+			return false
+		}
+
+		if fn&1 == 1 || fn == sn {
+			r = nodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = nodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	return sn == 0 && bytes.Equal(r, root)
+}
+
+// VerifyConsistency checks that the tree of size first with firstRoot is a
+// prefix of the tree of size second with secondRoot, following RFC 9162
+// section 2.1.4.2.
+func VerifyConsistency(first int, second int, firstRoot []byte, secondRoot []byte, proof [][]byte) bool {
+	switch {
+	case first < 0 || first > second:
+		return false
+	case first == second:
+		return len(proof) == 0 && bytes.Equal(firstRoot, secondRoot)
+	case first == 0:
+		return len(proof) == 0
+	case len(proof) == 0:
+		return false
+	}
+
+	// a power of two is a complete subtree, its root is not in the proof
+	if first&(first-1) == 0 {
+		proof = append([][]byte{firstRoot}, proof...)
+	}
+
+	fn, sn := first-1, second-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return false
+		}
+
+		if fn&1 == 1 || fn == sn {
+			fr = nodeHash(c, fr)
+			sr = nodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = nodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	return sn == 0 && bytes.Equal(fr, firstRoot) && bytes.Equal(sr, secondRoot)
+}
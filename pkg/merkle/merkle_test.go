@@ -0,0 +1,85 @@
+package merkle
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// testLeaves are the leaves of the RFC 6962 test vectors of the certificate
+// transparency reference implementation.
+var testLeaves = []string{"", "00", "10", "2021", "3031", "40414243", "5051525354555657", "606162636465666768696a6b6c6d6e6f"}
+
+func leafHashes(t *testing.T, n int) [][]byte {
+	var leaves [][]byte
+	for i := 0; i < n; i++ {
+		data, err := hex.DecodeString(testLeaves[i%len(testLeaves)])
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		leaves = append(leaves, LeafHash(append(data, byte(i/len(testLeaves)))))
+	}
+	return leaves
+}
+
+func TestRootHash(t *testing.T) {
+	var leaves [][]byte
+	for _, leaf := range testLeaves {
+		data, _ := hex.DecodeString(leaf)
+		leaves = append(leaves, LeafHash(data))
+	}
+
+	tests := []struct {
+		size int
+		root string
+	}{
+		{0, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{1, "6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d"},
+		{8, "5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328"},
+	}
+
+	for _, tt := range tests {
+		root := hex.EncodeToString(RootHash(leaves[:tt.size]))
+		if root != tt.root {
+			t.Errorf("Expected root %s for %d leaves, got %s", tt.root, tt.size, root)
+		}
+	}
+}
+
+var tampered = LeafHash([]byte("tampered"))
+
+func TestInclusionProof(t *testing.T) {
+	for size := 1; size <= 20; size++ {
+		leaves := leafHashes(t, size)
+		root := RootHash(leaves)
+
+		for index := 0; index < size; index++ {
+			proof := InclusionProof(leaves, index)
+			if !VerifyInclusion(index, size, leaves[index], proof, root) {
+				t.Errorf("Expected proof of leaf %d in tree of size %d to verify", index, size)
+			}
+
+			if VerifyInclusion(index, size, tampered, proof, root) {
+				t.Errorf("Expected proof of leaf %d in tree of size %d to fail for another leaf", index, size)
+			}
+		}
+	}
+}
+
+func TestConsistencyProof(t *testing.T) {
+	for second := 1; second <= 20; second++ {
+		leaves := leafHashes(t, second)
+		secondRoot := RootHash(leaves)
+
+		for first := 1; first <= second; first++ {
+			firstRoot := RootHash(leaves[:first])
+			proof := ConsistencyProof(leaves, first)
+			if !VerifyConsistency(first, second, firstRoot, secondRoot, proof) {
+				t.Errorf("Expected consistency proof from %d to %d to verify", first, second)
+			}
+
+			if VerifyConsistency(first, second, tampered, secondRoot, proof) {
+				t.Errorf("Expected consistency proof from %d to %d to fail for another root", first, second)
+			}
+		}
+	}
+}
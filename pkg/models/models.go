@@ -1,26 +1,415 @@
 package models
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type APIError struct {
 	Code    int          `json:"code"`
 	Message ErrorMessage `json:"message"`
 }
 
 type ErrorMessage struct {
+	// Type is only set for websocket frames
+	Type   string `json:"type,omitempty"`
 	Error  string `json:"error"`
+	Code   string `json:"code,omitempty"`
 	Detail string `json:"detail,omitempty"`
+	// Field is the member of the request body which failed validation
+	Field string `json:"field,omitempty"`
+}
+
+// RegisterRequest creates a user. The key is either PublicKey, as PEM SPKI,
+// base64 SPKI DER or raw base64, or a JWK. KeyType tells raw X25519 keys from
+// Ed25519 ones, when set the key must be of that type.
+type RegisterRequest struct {
+	PublicKey string          `json:"publicKey,omitempty"`
+	JWK       json.RawMessage `json:"jwk,omitempty"`
+	KeyType   string          `json:"keyType,omitempty"`
+}
+
+// RegisterResponse returns the key as it was stored, base64 SPKI DER, and
+// the first session tokens of the user.
+type RegisterResponse struct {
+	User      string `json:"user"`
+	PublicKey string `json:"publicKey"`
+	KeyType   string `json:"keyType"`
+	Tokens
 }
 
 type LoginResponse struct {
 	User string `json:"user"`
+	Tokens
+}
+
+// Tokens are the session tokens of a user. AccessToken authenticates
+// requests for ExpiresIn seconds, RefreshToken gets new tokens until it
+// expires, is used or its session is revoked.
+type Tokens struct {
+	TokenType    string `json:"tokenType"`
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+	ExpiresIn    int64  `json:"expiresIn"`
+}
+
+// TokenRequest starts a session for the user with the id Login, it is
+// signed with the key of the user.
+type TokenRequest struct {
+	SignedRequest
+	Login string `json:"login"`
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// RevokeTokenRequest ends the session of Token, an access or refresh token.
+type RevokeTokenRequest struct {
+	Token string `json:"token"`
 }
 
 type ConnectResponse struct {
+	User      string   `json:"user"`
+	Handle    string   `json:"handle,omitempty"`
+	Publickey string   `json:"publicKey"`
+	KeyType   string   `json:"keyType,omitempty"`
+	Devices   []Device `json:"devices,omitempty"`
+}
+
+// PrimaryDevice is the device created with the user, it uses the key the
+// user registered with.
+const PrimaryDevice = "primary"
+
+type Device struct {
+	ID        string `json:"id"`
+	PublicKey string `json:"publicKey"`
+}
+
+// SignedRequest is embedded in request bodies which are signed by the
+// user's key, requests older than a few minutes are rejected. Method and
+// Path must be those of the request and Nonce a random value which is only
+// accepted once, so a signed body cannot be sent again.
+type SignedRequest struct {
+	Timestamp int64  `json:"timestamp"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Nonce     string `json:"nonce"`
+}
+
+type RegisterDeviceRequest struct {
+	SignedRequest
+	PublicKey string `json:"publicKey"`
+}
+
+// HandleRequest claims, changes or releases the handle of a user, it is
+// signed with the key of the user. The leading @ is optional.
+type HandleRequest struct {
+	SignedRequest
+	Handle string `json:"handle"`
+}
+
+// HandleResponse has the normalized handle of User, without the leading @.
+// Handle is empty once it was released.
+type HandleResponse struct {
+	User   string `json:"user"`
+	Handle string `json:"handle,omitempty"`
+}
+
+// DeleteUserRequest deletes the user with the id Delete, it is signed with
+// the key of the user.
+type DeleteUserRequest struct {
+	SignedRequest
+	Delete string `json:"delete"`
+}
+
+// DeletionReceipt confirms that User and everything stored for it was
+// deleted at DeletedAt.
+type DeletionReceipt struct {
+	User      string    `json:"user"`
+	DeletedAt time.Time `json:"deletedAt"`
+}
+
+// RotateKeyRequest replaces the key of a user, it is signed with the
+// current key.
+type RotateKeyRequest struct {
+	SignedRequest
+	PublicKey string `json:"publicKey"`
+}
+
+// PreviousKey is a key the user used until ReplacedAt.
+type PreviousKey struct {
+	PublicKey  string    `json:"publicKey"`
+	ReplacedAt time.Time `json:"replacedAt"`
+}
+
+// KeyHistory lists the current key of User and its previous keys, newest
+// first.
+type KeyHistory struct {
+	User      string        `json:"user"`
+	PublicKey string        `json:"publicKey"`
+	Previous  []PreviousKey `json:"previous"`
+}
+
+// KeyLogEntry is a leaf of the key transparency log, it records that User
+// registered or rotated to PublicKey at Timestamp, in seconds since the
+// epoch. Entries with Device record that the device was added with
+// PublicKey or, with Removed, that it was removed. The leaf data is the JSON
+// encoding of the entry.
+type KeyLogEntry struct {
 	User      string `json:"user"`
-	Publickey string `json:"publicKey"`
+	Device    string `json:"device,omitempty"`
+	PublicKey string `json:"publicKey"`
+	Removed   bool   `json:"removed,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// SignedTreeHead is the root of the key log with TreeSize entries, signed by
+// the log key at Timestamp, in milliseconds since the epoch.
+type SignedTreeHead struct {
+	TreeSize  int64  `json:"treeSize"`
+	Timestamp int64  `json:"timestamp"`
+	RootHash  string `json:"rootHash"`
+	Signature string `json:"signature"`
+}
+
+// InclusionProof proves that Entry is the leaf at LeafIndex of the key log
+// with TreeSize entries.
+type InclusionProof struct {
+	LeafIndex int64       `json:"leafIndex"`
+	TreeSize  int64       `json:"treeSize"`
+	Entry     KeyLogEntry `json:"entry"`
+	AuditPath []string    `json:"auditPath"`
 }
 
+// ConsistencyProof proves that the key log with First entries is a prefix of
+// the one with Second entries.
+type ConsistencyProof struct {
+	First  int64    `json:"first"`
+	Second int64    `json:"second"`
+	Proof  []string `json:"proof"`
+}
+
+// LogKey is the key which signs the tree heads of the key log.
+type LogKey struct {
+	PublicKey string `json:"publicKey"`
+}
+
+// SafetyNumber is compared by Users out of band to verify each other's keys,
+// it changes when either key changes.
+type SafetyNumber struct {
+	Users        []string `json:"users"`
+	SafetyNumber string   `json:"safetyNumber"`
+}
+
+type DeviceResponse struct {
+	User   string `json:"user"`
+	Device string `json:"device"`
+}
+
+// InactiveUser is a user which was not active since LastActivity.
+type InactiveUser struct {
+	ID           string    `json:"id"`
+	LastActivity time.Time `json:"lastActivity"`
+}
+
+// RetentionReport lists the users the retention job would delete, the ones
+// inactive since before Cutoff.
+type RetentionReport struct {
+	Cutoff time.Time      `json:"cutoff"`
+	Users  []InactiveUser `json:"users"`
+}
+
+// PreKey is a one-time prekey, each one is handed out once.
+type PreKey struct {
+	KeyID     int64  `json:"keyId"`
+	PublicKey string `json:"publicKey"`
+}
+
+// SignedPreKey is a medium-term prekey signed by the identity key of the
+// user.
+type SignedPreKey struct {
+	KeyID     int64  `json:"keyId"`
+	PublicKey string `json:"publicKey"`
+	Signature string `json:"signature"`
+}
+
+// UploadPreKeysRequest replaces the signed prekey when set and adds the
+// one-time prekeys.
+type UploadPreKeysRequest struct {
+	SignedRequest
+	SignedPreKey   *SignedPreKey `json:"signedPreKey,omitempty"`
+	OneTimePreKeys []PreKey      `json:"oneTimePreKeys,omitempty"`
+}
+
+// PreKeyCount is the number of one-time prekeys left for a user.
+type PreKeyCount struct {
+	Type  string `json:"type,omitempty"`
+	Count int    `json:"count"`
+}
+
+// PreKeyBundle is what a user needs to start a session with User while it
+// is offline, OneTimePreKey is missing once they ran out.
+type PreKeyBundle struct {
+	User          string       `json:"user"`
+	IdentityKey   string       `json:"identityKey"`
+	SignedPreKey  SignedPreKey `json:"signedPreKey"`
+	OneTimePreKey *PreKey      `json:"oneTimePreKey,omitempty"`
+}
+
+// TransmissionData is routed from one user to another. Type is a message
+// or, with Ref set to the id of the message, a sent, delivered or read
+// receipt.
 type TransmissionData struct {
+	Type    string `json:"type,omitempty"`
+	ID      int64  `json:"id,omitempty"`
 	From    string `json:"from"`
 	To      string `json:"to"`
-	Payload string `json:"payload"`
+	Group   string `json:"group,omitempty"`
+	Ref     int64  `json:"ref,omitempty"`
+	Payload string `json:"payload,omitempty"`
+}
+
+// GroupMessage is sent by clients to a group, with one payload per member
+// as every member has its own key. It is delivered to each member as a
+// TransmissionData with Group set.
+type GroupMessage struct {
+	Type     string            `json:"type,omitempty"`
+	From     string            `json:"from"`
+	To       string            `json:"to"`
+	Payloads map[string]string `json:"payloads"`
+}
+
+type Group struct {
+	ID      string   `json:"id"`
+	Owner   string   `json:"owner"`
+	Members []string `json:"members"`
+}
+
+type CreateGroupRequest struct {
+	SignedRequest
+	Owner   string   `json:"owner"`
+	Members []string `json:"members"`
+}
+
+// GroupMemberRequest is signed by User, the owner of the group or, when
+// leaving a group, the member itself. Group, Member and Action must match
+// the request, so a signed request cannot be used for another change.
+type GroupMemberRequest struct {
+	SignedRequest
+	User   string `json:"user"`
+	Group  string `json:"group"`
+	Member string `json:"member"`
+	Action string `json:"action"`
+}
+
+const (
+	GroupActionAdd    = "add"
+	GroupActionRemove = "remove"
+)
+
+const (
+	CodeUserNotFound     = "user_not_found"
+	CodeInvalidUserID    = "invalid_user_id"
+	CodeInvalidHandle    = "invalid_handle"
+	CodeHandleTaken      = "handle_taken"
+	CodeHandleReserved   = "handle_reserved"
+	CodeHandleNotFound   = "handle_not_found"
+	CodeDeviceNotFound   = "device_not_found"
+	CodeDeviceConnected  = "device_connected"
+	CodeShuttingDown     = "shutting_down"
+	CodeGroupNotFound    = "group_not_found"
+	CodeNotGroupMember   = "not_group_member"
+	CodeMissingPayload   = "missing_payload"
+	CodeMailboxFull      = "mailbox_full"
+	CodeSenderMismatch   = "sender_mismatch"
+	CodePreKeysNotFound  = "prekeys_not_found"
+	CodeTooManyPreKeys   = "too_many_prekeys"
+	CodeInvalidPreKey    = "invalid_prekey"
+	CodeLogEntryNotFound = "log_entry_not_found"
+	CodeInvalidTreeSize  = "invalid_tree_size"
+	CodeRetentionOff     = "retention_disabled"
+	CodeForbidden        = "forbidden"
+	CodeInvalidRequest   = "invalid_request"
+	CodeExpiredRequest   = "expired_request"
+	CodeRequestMismatch  = "request_mismatch"
+	CodeReplayedRequest  = "replayed_request"
+	CodeInvalidPublicKey = "invalid_public_key"
+	CodeUnsupportedKey   = "unsupported_key_type"
+	CodeKeyTypeMismatch  = "key_type_mismatch"
+	CodeInvalidChallenge = "invalid_challenge"
+	CodeInvalidToken     = "invalid_token"
+	CodeExpiredToken     = "expired_token"
+	CodeInvalidSignature = "invalid_signature"
+	CodeInvalidMessage   = "invalid_message"
+	CodeInternalError    = "internal_error"
+)
+
+const (
+	FrameChallenge         = "challenge"
+	FrameChallengeResponse = "challenge_response"
+	FrameAuthenticated     = "authenticated"
+	FrameMessage           = "message"
+	FrameAck               = "ack"
+	FrameSent              = "sent"
+	FrameDelivered         = "delivered"
+	FrameRead              = "read"
+	FrameError             = "error"
+	FrameSubscribe         = "subscribe"
+	FrameUnsubscribe       = "unsubscribe"
+	FrameOnline            = "online"
+	FrameOffline           = "offline"
+	FrameTyping            = "typing"
+	FramePreKeysLow        = "prekeys_low"
+	FrameKeyChanged        = "key_changed"
+	FrameGoingAway         = "server_going_away"
+)
+
+// Frame is used to peek at the type of an incoming websocket frame,
+// frames without a type are treated as messages.
+type Frame struct {
+	Type string `json:"type"`
+}
+
+type Challenge struct {
+	Type  string `json:"type"`
+	Nonce string `json:"nonce"`
+}
+
+type ChallengeResponse struct {
+	Type      string `json:"type"`
+	Signature string `json:"signature"`
+}
+
+type Authenticated struct {
+	Type   string `json:"type"`
+	User   string `json:"user"`
+	Device string `json:"device"`
+}
+
+// Ack acknowledges that the client has processed the message with ID,
+// until then the message is redelivered on every reconnect.
+type Ack struct {
+	Type string `json:"type"`
+	ID   int64  `json:"id"`
+}
+
+// Subscribe subscribes to or, with the unsubscribe type, unsubscribes from
+// the presence of Users.
+type Subscribe struct {
+	Type  string   `json:"type"`
+	Users []string `json:"users"`
+}
+
+// GoingAway tells a client that the server is shutting down, it should
+// reconnect after ReconnectAfter milliseconds.
+type GoingAway struct {
+	Type           string `json:"type"`
+	ReconnectAfter int64  `json:"reconnectAfter"`
+}
+
+// Presence tells a subscriber that User came online or went offline.
+type Presence struct {
+	Type string `json:"type"`
+	User string `json:"user"`
 }
@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	minHandleLength = 3
+	maxHandleLength = 30
+)
+
+var ErrInvalidHandle = errors.New("handles have 3 to 30 characters out of a-z, 0-9, _ and ., start with a letter and have no . at the end or twice in a row")
+
+// DefaultReservedHandles cannot be claimed as they could be mistaken for the
+// operators of the server.
+var DefaultReservedHandles = []string{
+	"admin", "administrator", "api", "enigma", "everyone", "help", "here",
+	"moderator", "null", "official", "root", "security", "staff", "support",
+	"system", "undefined",
+}
+
+// confusables are replaced in the skeleton of a handle by what they look
+// like, longest first.
+var confusables = strings.NewReplacer(
+	"rn", "m",
+	"vv", "w",
+	"0", "o",
+	"1", "l",
+	"i", "l",
+	"5", "s",
+	"_", "",
+	".", "",
+)
+
+// NormalizeHandle returns handle without the leading @ and in lower case. Only
+// ASCII letters, digits, _ and . are allowed, which rules out look-alike
+// characters from other scripts.
+func NormalizeHandle(handle string) (string, error) {
+	handle = strings.ToLower(strings.TrimPrefix(handle, "@"))
+	if len(handle) < minHandleLength || len(handle) > maxHandleLength {
+		return "", ErrInvalidHandle
+	}
+
+	for i, c := range handle {
+		switch {
+		case c >= 'a' && c <= 'z':
+		case i == 0:
+			return "", ErrInvalidHandle
+		case c >= '0' && c <= '9', c == '_', c == '.':
+		default:
+			return "", ErrInvalidHandle
+		}
+	}
+
+	if strings.HasSuffix(handle, ".") || strings.Contains(handle, "..") {
+		return "", ErrInvalidHandle
+	}
+	return handle, nil
+}
+
+// HandleSkeleton returns what a normalized handle looks like, handles with
+// the same skeleton are easily confused.
+func HandleSkeleton(handle string) string {
+	// replacing until nothing changes catches sequences formed by earlier
+	// replacements, like "r_n"
+	for {
+		skeleton := confusables.Replace(handle)
+		if skeleton == handle {
+			return skeleton
+		}
+		handle = skeleton
+	}
+}
@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalizeHandle(t *testing.T) {
+	tests := []struct {
+		handle     string
+		normalized string
+		err        error
+	}{
+		{"@Alice", "alice", nil},
+		{"bob_smith.99", "bob_smith.99", nil},
+		{"аlice", "", ErrInvalidHandle},
+		{"1alice", "", ErrInvalidHandle},
+		{"al", "", ErrInvalidHandle},
+		{"alice.", "", ErrInvalidHandle},
+		{"al..ice", "", ErrInvalidHandle},
+		{"al ice", "", ErrInvalidHandle},
+	}
+
+	for _, tt := range tests {
+		normalized, err := NormalizeHandle(tt.handle)
+		if normalized != tt.normalized || !errors.Is(err, tt.err) {
+			t.Errorf("Expected %q and %v for %q, got %q and %v", tt.normalized, tt.err, tt.handle, normalized, err)
+		}
+	}
+}
+
+func TestHandleSkeleton(t *testing.T) {
+	for _, handles := range [][]string{
+		{"alice", "a1ice", "al.ice", "a_l_i_c_e"},
+		{"modern", "rnodern", "mode_rn"},
+		{"wave", "vvave"},
+		{"boss", "b055"},
+	} {
+		for _, handle := range handles[1:] {
+			if HandleSkeleton(handle) != HandleSkeleton(handles[0]) {
+				t.Errorf("Expected %s to look like %s, got %s and %s", handle, handles[0], HandleSkeleton(handle), HandleSkeleton(handles[0]))
+			}
+		}
+	}
+
+	if HandleSkeleton("alice") == HandleSkeleton("bob") {
+		t.Errorf("Expected alice and bob to look different")
+	}
+}
@@ -0,0 +1,173 @@
+package utils
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Alphabets of the generated user ids.
+const (
+	IDAlphabetHex       = "hex"
+	IDAlphabetCrockford = "crockford"
+	IDAlphabetWords     = "words"
+)
+
+var ErrInvalidIDChecksum = errors.New("invalid id checksum")
+
+// wordList holds 256 short words, so every word of an id carries 8 bits.
+//
+//go:embed words.txt
+var wordList string
+
+// idAlphabet has a power of two symbols so random bytes map to symbols
+// without bias.
+type idAlphabet struct {
+	symbols   []string
+	separator string
+	// lookalikes replaces the letters read as a symbol, nil when there are
+	// none
+	lookalikes *strings.Replacer
+	// defaultLength gives ids with 40 random bits
+	defaultLength int
+}
+
+var idAlphabets = map[string]idAlphabet{
+	IDAlphabetHex:       {symbols: strings.Split("0123456789abcdef", ""), defaultLength: 10},
+	IDAlphabetCrockford: {symbols: strings.Split("0123456789abcdefghjkmnpqrstvwxyz", ""), lookalikes: strings.NewReplacer("i", "1", "l", "1", "o", "0"), defaultLength: 8},
+	IDAlphabetWords:     {symbols: strings.Fields(wordList), separator: "-", defaultLength: 5},
+}
+
+// IDFormat describes how user ids are generated, the zero value gives 10
+// random hex characters.
+type IDFormat struct {
+	// Alphabet is one of the IDAlphabet constants, hex when empty.
+	Alphabet string
+	// Length is the number of random characters, or words, zero picks the
+	// length with 40 random bits.
+	Length int
+	// Checksum appends a check symbol of the same alphabet, which catches
+	// a mistyped symbol and most swapped neighbours.
+	Checksum bool
+}
+
+func (f IDFormat) alphabet() (idAlphabet, error) {
+	name := f.Alphabet
+	if name == "" {
+		name = IDAlphabetHex
+	}
+
+	alphabet, ok := idAlphabets[name]
+	if !ok {
+		return idAlphabet{}, fmt.Errorf("unknown id alphabet %q", f.Alphabet)
+	}
+	if f.Length < 0 {
+		return idAlphabet{}, fmt.Errorf("invalid id length %d", f.Length)
+	}
+	return alphabet, nil
+}
+
+// Validate checks that ids can be generated in the format.
+func (f IDFormat) Validate() error {
+	_, err := f.alphabet()
+	return err
+}
+
+// NewID returns a random id in the format.
+func (f IDFormat) NewID() (string, error) {
+	alphabet, err := f.alphabet()
+	if err != nil {
+		return "", err
+	}
+
+	length := f.Length
+	if length == 0 {
+		length = alphabet.defaultLength
+	}
+
+	random, err := RandomBytes(length)
+	if err != nil {
+		return "", err
+	}
+
+	digits := make([]int, length)
+	for i, b := range random {
+		digits[i] = int(b) % len(alphabet.symbols)
+	}
+	if f.Checksum {
+		digits = append(digits, luhnCheckDigit(digits, len(alphabet.symbols)))
+	}
+
+	symbols := make([]string, len(digits))
+	for i, digit := range digits {
+		symbols[i] = alphabet.symbols[digit]
+	}
+	return strings.Join(symbols, alphabet.separator), nil
+}
+
+// Normalize returns id the way the format generates it, so ids typed by
+// hand are found. Letters are made lower case and, for crockford ids, i and
+// l are read as 1 and o as 0.
+func (f IDFormat) Normalize(id string) string {
+	alphabet, err := f.alphabet()
+	if err != nil {
+		return id
+	}
+
+	id = strings.ToLower(id)
+	if alphabet.lookalikes != nil {
+		id = alphabet.lookalikes.Replace(id)
+	}
+	return id
+}
+
+// CheckID returns ErrInvalidIDChecksum when the format has a checksum and id
+// is not a valid id of the format, most likely because of a typo.
+func (f IDFormat) CheckID(id string) error {
+	alphabet, err := f.alphabet()
+	if err != nil || !f.Checksum {
+		return err
+	}
+
+	var symbols []string
+	if alphabet.separator == "" {
+		symbols = strings.Split(id, "")
+	} else {
+		symbols = strings.Split(id, alphabet.separator)
+	}
+
+	digits := make([]int, len(symbols))
+	for i, symbol := range symbols {
+		digits[i] = -1
+		for digit, s := range alphabet.symbols {
+			if s == symbol {
+				digits[i] = digit
+				break
+			}
+		}
+		if digits[i] < 0 {
+			return ErrInvalidIDChecksum
+		}
+	}
+
+	last := len(digits) - 1
+	if last < 1 || luhnCheckDigit(digits[:last], len(alphabet.symbols)) != digits[last] {
+		return ErrInvalidIDChecksum
+	}
+	return nil
+}
+
+// luhnCheckDigit computes the check digit of digits with the Luhn mod n
+// algorithm, every other digit is doubled starting from the right.
+func luhnCheckDigit(digits []int, n int) int {
+	factor := 2
+	sum := 0
+	for i := len(digits) - 1; i >= 0; i-- {
+		addend := factor * digits[i]
+		addend = addend/n + addend%n
+		sum += addend
+		factor = 3 - factor
+	}
+	return (n - sum%n) % n
+}
@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestNewID(t *testing.T) {
+	tests := []struct {
+		format  IDFormat
+		pattern string
+	}{
+		{IDFormat{}, `^[0-9a-f]{10}$`},
+		{IDFormat{Alphabet: IDAlphabetHex, Length: 16}, `^[0-9a-f]{16}$`},
+		{IDFormat{Alphabet: IDAlphabetCrockford}, `^[0-9a-hjkmnp-tv-z]{8}$`},
+		{IDFormat{Alphabet: IDAlphabetCrockford, Checksum: true}, `^[0-9a-hjkmnp-tv-z]{9}$`},
+		{IDFormat{Alphabet: IDAlphabetWords}, `^[a-z]+(-[a-z]+){4}$`},
+		{IDFormat{Alphabet: IDAlphabetWords, Length: 3, Checksum: true}, `^[a-z]+(-[a-z]+){3}$`},
+	}
+
+	for _, tt := range tests {
+		id, err := tt.format.NewID()
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if !regexp.MustCompile(tt.pattern).MatchString(id) {
+			t.Errorf("Expected id matching %s for %+v, got %s", tt.pattern, tt.format, id)
+		}
+		if err := tt.format.CheckID(id); err != nil {
+			t.Errorf("Expected %s to be valid, got %v", id, err)
+		}
+	}
+
+	if _, err := (IDFormat{Alphabet: "emoji"}).NewID(); err == nil {
+		t.Errorf("Expected an error for an unknown alphabet")
+	}
+}
+
+func TestNormalizeID(t *testing.T) {
+	tests := []struct {
+		format IDFormat
+		id     string
+		want   string
+	}{
+		{IDFormat{}, "0A1B2C3D4E", "0a1b2c3d4e"},
+		{IDFormat{Alphabet: IDAlphabetCrockford}, "IL0O9ZXQ", "11009zxq"},
+		{IDFormat{Alphabet: IDAlphabetCrockford}, "g-0a1b2c3d4e", "g-0a1b2c3d4e"},
+		{IDFormat{Alphabet: IDAlphabetWords}, "Acid-Acorn-Actor", "acid-acorn-actor"},
+		{IDFormat{Alphabet: "emoji"}, "ABC", "ABC"},
+	}
+
+	for _, tt := range tests {
+		if id := tt.format.Normalize(tt.id); id != tt.want {
+			t.Errorf("Expected %s for %s in %+v, got %s", tt.want, tt.id, tt.format, id)
+		}
+	}
+
+	// a crockford id read back with lookalike letters is valid
+	format := IDFormat{Alphabet: IDAlphabetCrockford, Checksum: true}
+	for i := 0; i < 20; i++ {
+		id, _ := format.NewID()
+		typed := strings.NewReplacer("1", "l", "0", "O").Replace(strings.ToUpper(id))
+		if normalized := format.Normalize(typed); normalized != id || format.CheckID(normalized) != nil {
+			t.Errorf("Expected %s to be read as %s, got %s", typed, id, normalized)
+		}
+	}
+}
+
+func TestCheckID(t *testing.T) {
+	for _, name := range []string{IDAlphabetHex, IDAlphabetCrockford, IDAlphabetWords} {
+		format := IDFormat{Alphabet: name, Checksum: true}
+		alphabet := idAlphabets[name]
+
+		for i := 0; i < 20; i++ {
+			id, _ := format.NewID()
+			symbols := strings.Split(id, "")
+			if alphabet.separator != "" {
+				symbols = strings.Split(id, alphabet.separator)
+			}
+
+			// every single symbol typo is caught
+			for pos, symbol := range symbols {
+				for _, typo := range alphabet.symbols {
+					if typo == symbol {
+						continue
+					}
+					mistyped := append([]string(nil), symbols...)
+					mistyped[pos] = typo
+					if err := format.CheckID(strings.Join(mistyped, alphabet.separator)); !errors.Is(err, ErrInvalidIDChecksum) {
+						t.Fatalf("Expected %v for %v, got %v", ErrInvalidIDChecksum, mistyped, err)
+					}
+				}
+			}
+		}
+	}
+
+	if err := (IDFormat{}).CheckID("anything"); err != nil {
+		t.Errorf("Expected no error without checksum, got %v", err)
+	}
+	if err := (IDFormat{Checksum: true}).CheckID("xyz"); !errors.Is(err, ErrInvalidIDChecksum) {
+		t.Errorf("Expected %v, got %v", ErrInvalidIDChecksum, err)
+	}
+}
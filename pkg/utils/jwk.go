@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+)
+
+// Key types stored with the users, X25519 keys can only be used for key
+// agreement, the others also sign.
+const (
+	KeyTypeEd25519 = "ed25519"
+	KeyTypeX25519  = "x25519"
+	KeyTypeP256    = "p256"
+)
+
+// jwk holds the members of a JSON Web Key used by the supported key types.
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// ParseJWK parses a public JSON Web Key, either an OKP key on Ed25519 or
+// X25519 or an EC key on P-256.
+func ParseJWK(data []byte) (crypto.PublicKey, error) {
+	var key jwk
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, ErrInvalidPublicKey
+	}
+
+	x, err := base64.RawURLEncoding.DecodeString(key.X)
+	if err != nil {
+		return nil, ErrInvalidPublicKey
+	}
+
+	switch {
+	case key.Kty == "OKP" && key.Crv == "Ed25519":
+		if len(x) != ed25519.PublicKeySize {
+			return nil, ErrInvalidPublicKey
+		}
+		return ed25519.PublicKey(x), nil
+	case key.Kty == "OKP" && key.Crv == "X25519":
+		pub, err := ecdh.X25519().NewPublicKey(x)
+		if err != nil {
+			return nil, ErrInvalidPublicKey
+		}
+		return pub, nil
+	case key.Kty == "EC" && key.Crv == "P-256":
+		y, err := base64.RawURLEncoding.DecodeString(key.Y)
+		if err != nil || len(x) != 32 || len(y) != 32 {
+			return nil, ErrInvalidPublicKey
+		}
+
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if _, err := pub.ECDH(); err != nil {
+			return nil, ErrInvalidPublicKey
+		}
+		return pub, nil
+	}
+	return nil, ErrUnsupportedPublicKey
+}
+
+// ParseKeyOfType parses key like ParsePublicKey but also accepts X25519 keys.
+// A raw 32 byte key is an X25519 key when keyType is KeyTypeX25519 and an
+// Ed25519 key otherwise.
+func ParseKeyOfType(key string, keyType string) (crypto.PublicKey, error) {
+	var der []byte
+	if block, _ := pem.Decode([]byte(key)); block != nil {
+		der = block.Bytes
+	} else {
+		data, err := DecodeBase64(key)
+		if err != nil {
+			return nil, ErrInvalidPublicKey
+		}
+		if len(data) == 32 && keyType == KeyTypeX25519 {
+			pub, err := ecdh.X25519().NewPublicKey(data)
+			if err != nil {
+				return nil, ErrInvalidPublicKey
+			}
+			return pub, nil
+		}
+		if len(data) == ed25519.PublicKeySize {
+			return ed25519.PublicKey(data), nil
+		}
+		der = data
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, ErrInvalidPublicKey
+	}
+
+	if _, err := PublicKeyType(pub); err != nil {
+		return nil, err
+	}
+	return pub, nil
+}
+
+// PublicKeyType returns the key type of pub.
+func PublicKeyType(pub crypto.PublicKey) (string, error) {
+	switch pub := pub.(type) {
+	case ed25519.PublicKey:
+		return KeyTypeEd25519, nil
+	case *ecdsa.PublicKey:
+		if pub.Curve == elliptic.P256() {
+			return KeyTypeP256, nil
+		}
+	case *ecdh.PublicKey:
+		if pub.Curve() == ecdh.X25519() {
+			return KeyTypeX25519, nil
+		}
+	}
+	return "", ErrUnsupportedPublicKey
+}
+
+// NormalizePublicKey returns the base64 encoded SPKI DER of pub, which
+// ParseKeyOfType reads back, and its key type.
+func NormalizePublicKey(pub crypto.PublicKey) (string, string, error) {
+	keyType, err := PublicKeyType(pub)
+	if err != nil {
+		return "", "", err
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(der), keyType, nil
+}
@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+var (
+	ErrInvalidPublicKey     = errors.New("invalid public key")
+	ErrUnsupportedPublicKey = errors.New("unsupported public key type")
+	ErrInvalidSignature     = errors.New("invalid signature")
+)
+
+// DecodeBase64 accepts standard and URL-safe base64, with or without padding.
+func DecodeBase64(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	encodings := []*base64.Encoding{
+		base64.RawURLEncoding,
+		base64.URLEncoding,
+		base64.RawStdEncoding,
+		base64.StdEncoding,
+	}
+
+	var err error
+	for _, enc := range encodings {
+		var data []byte
+		data, err = enc.DecodeString(s)
+		if err == nil {
+			return data, nil
+		}
+	}
+	return nil, err
+}
+
+// ParsePublicKey parses a public key stored for a user. The key can be a PEM
+// encoded SPKI block, base64 encoded SPKI DER or a base64 encoded raw Ed25519
+// key. Only Ed25519 and ECDSA P-256 keys are supported.
+func ParsePublicKey(key string) (crypto.PublicKey, error) {
+	pub, err := ParseKeyOfType(key, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// X25519 keys cannot sign
+	if keyType, _ := PublicKeyType(pub); keyType == KeyTypeX25519 {
+		return nil, ErrUnsupportedPublicKey
+	}
+	return pub, nil
+}
+
+// VerifySignature checks that signature was produced over message by the
+// private key matching publicKey. ECDSA signatures may be ASN.1 encoded or
+// the raw r||s form produced by WebCrypto.
+func VerifySignature(publicKey string, message, signature []byte) error {
+	pub, err := ParsePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+
+	switch pub := pub.(type) {
+	case ed25519.PublicKey:
+		if ed25519.Verify(pub, message, signature) {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(message)
+		if len(signature) == 64 {
+			r := new(big.Int).SetBytes(signature[:32])
+			s := new(big.Int).SetBytes(signature[32:])
+			if ecdsa.Verify(pub, digest[:], r, s) {
+				return nil
+			}
+		} else if ecdsa.VerifyASN1(pub, digest[:], signature) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
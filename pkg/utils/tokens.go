@@ -0,0 +1,156 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Types of the session tokens, access tokens authenticate requests and
+// refresh tokens get new access tokens.
+const (
+	TokenTypeAccess  = "access"
+	TokenTypeRefresh = "refresh"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("token expired")
+)
+
+// MinTokenSecretSize is the smallest secret tokens can be signed with, the
+// size of a HMAC-SHA256.
+const MinTokenSecretSize = 32
+
+// TokenKey signs session tokens with HMAC-SHA256. The ID is part of every
+// token, so tokens signed by a previous key stay valid while it is kept.
+type TokenKey struct {
+	ID     string
+	Secret []byte
+}
+
+// TokenClaims are the claims of a session token, which is a JWT signed with
+// HS256. The access and refresh tokens of a login share the Session.
+type TokenClaims struct {
+	Subject string `json:"sub"`
+	// Generation is the token generation of the subject when the token was
+	// issued
+	Generation string `json:"gen,omitempty"`
+	Session    string `json:"sid"`
+	ID         string `json:"jti"`
+	Type       string `json:"typ"`
+	IssuedAt   int64  `json:"iat"`
+	ExpiresAt  int64  `json:"exp"`
+}
+
+type tokenHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// ParseTokenKeys parses a comma separated list of id:secret pairs, the
+// secrets are base64 and at least MinTokenSecretSize bytes long.
+func ParseTokenKeys(value string) ([]TokenKey, error) {
+	var keys []TokenKey
+	ids := make(map[string]bool)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		id, encoded, ok := strings.Cut(pair, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("token key %q is not of the form id:secret", pair)
+		}
+		if ids[id] {
+			return nil, fmt.Errorf("duplicate token key id %q", id)
+		}
+
+		secret, err := DecodeBase64(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("token key %q: %w", id, err)
+		}
+		if len(secret) < MinTokenSecretSize {
+			return nil, fmt.Errorf("token key %q is shorter than %d bytes", id, MinTokenSecretSize)
+		}
+
+		ids[id] = true
+		keys = append(keys, TokenKey{ID: id, Secret: secret})
+	}
+	return keys, nil
+}
+
+func (k TokenKey) sign(data string) []byte {
+	mac := hmac.New(sha256.New, k.Secret)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// SignToken encodes claims as a JWT signed by key.
+func SignToken(key TokenKey, claims TokenClaims) (string, error) {
+	header, err := json.Marshal(tokenHeader{Algorithm: "HS256", Type: "JWT", KeyID: key.ID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	data := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return data + "." + base64.RawURLEncoding.EncodeToString(key.sign(data)), nil
+}
+
+// ParseToken verifies token with the key of keys it was signed by and
+// returns its claims. Tokens expired at now fail with ErrExpiredToken.
+func ParseToken(keys []TokenKey, token string, now time.Time) (TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return TokenClaims{}, ErrInvalidToken
+	}
+
+	var header tokenHeader
+	if err := decodeTokenPart(parts[0], &header); err != nil || header.Algorithm != "HS256" {
+		return TokenClaims{}, ErrInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return TokenClaims{}, ErrInvalidToken
+	}
+
+	verified := false
+	for _, key := range keys {
+		if key.ID == header.KeyID {
+			verified = hmac.Equal(signature, key.sign(parts[0]+"."+parts[1]))
+			break
+		}
+	}
+	if !verified {
+		return TokenClaims{}, ErrInvalidToken
+	}
+
+	var claims TokenClaims
+	if err := decodeTokenPart(parts[1], &claims); err != nil {
+		return TokenClaims{}, ErrInvalidToken
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return TokenClaims{}, ErrExpiredToken
+	}
+	return claims, nil
+}
+
+func decodeTokenPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
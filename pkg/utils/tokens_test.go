@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokens(t *testing.T) {
+	now := time.Now()
+	oldKey := TokenKey{ID: "old", Secret: bytes.Repeat([]byte{1}, MinTokenSecretSize)}
+	newKey := TokenKey{ID: "new", Secret: bytes.Repeat([]byte{2}, MinTokenSecretSize)}
+	claims := TokenClaims{
+		Subject:   "test-user",
+		Session:   "test-session",
+		ID:        "test-id",
+		Type:      TokenTypeAccess,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(time.Minute).Unix(),
+	}
+
+	token, err := SignToken(oldKey, claims)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// tokens of a previous key stay valid while it is configured
+	parsed, err := ParseToken([]TokenKey{newKey, oldKey}, token, now)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if parsed != claims {
+		t.Errorf("Expected claims %+v, got %+v", claims, parsed)
+	}
+
+	if _, err := ParseToken([]TokenKey{newKey}, token, now); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected %v without the key, got %v", ErrInvalidToken, err)
+	}
+	forged := TokenKey{ID: "old", Secret: newKey.Secret}
+	if _, err := ParseToken([]TokenKey{forged}, token, now); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected %v with another secret, got %v", ErrInvalidToken, err)
+	}
+	if _, err := ParseToken([]TokenKey{oldKey}, token, now.Add(time.Minute)); !errors.Is(err, ErrExpiredToken) {
+		t.Errorf("Expected %v, got %v", ErrExpiredToken, err)
+	}
+
+	// the signature of the token does not match other claims
+	other, _ := SignToken(oldKey, TokenClaims{Subject: "other-user", ExpiresAt: claims.ExpiresAt})
+	parts := strings.Split(token, ".")
+	tampered := parts[0] + "." + strings.Split(other, ".")[1] + "." + parts[2]
+	for _, invalid := range []string{"", "a.b", tampered, token + "x"} {
+		if _, err := ParseToken([]TokenKey{oldKey}, invalid, now); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("Expected %v for %q, got %v", ErrInvalidToken, invalid, err)
+		}
+	}
+}
+
+func TestParseTokenKeys(t *testing.T) {
+	secret := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, MinTokenSecretSize))
+
+	keys, err := ParseTokenKeys("new:" + secret + ", old:" + secret)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(keys) != 2 || keys[0].ID != "new" || keys[1].ID != "old" || len(keys[0].Secret) != MinTokenSecretSize {
+		t.Errorf("Expected the keys new and old, got %+v", keys)
+	}
+
+	short := base64.StdEncoding.EncodeToString([]byte("short"))
+	for _, invalid := range []string{secret, ":" + secret, "a:" + short, "a:" + secret + ",a:" + secret, "a:!"} {
+		if _, err := ParseTokenKeys(invalid); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
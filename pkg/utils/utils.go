@@ -5,9 +5,17 @@ import (
 	"encoding/hex"
 )
 
-func RandomHex(n int) (string, error) {
+func RandomBytes(n int) ([]byte, error) {
 	bytes := make([]byte, n)
 	if _, err := rand.Read(bytes); err != nil {
+		return nil, err
+	}
+	return bytes, nil
+}
+
+func RandomHex(n int) (string, error) {
+	bytes, err := RandomBytes(n)
+	if err != nil {
 		return "", err
 	}
 	return hex.EncodeToString(bytes), nil